@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"io"
 	"math/rand"
 	"net"
@@ -15,7 +16,7 @@ import (
 type ClientConn struct {
 	id               uint32
 	conn             net.Conn                                      // 与server 的tcp连接
-	dp               *znet.DataPack                                // 封包解包的结构体
+	dp               ziface.IDataPack                              // 封包解包的模块，可以替换成自己的实现
 	handler          map[uint32]func(ziface.IMessage, *ClientConn) // 给客户端就写简单的handler 完成消息的处理把
 	msgChan          chan []byte                                   // handler把消息处理后可能会需要给server回复一些信息，于是把消息放在此通道中
 	exitChan         chan bool                                     // 退出的通道，无缓冲
@@ -24,19 +25,23 @@ type ClientConn struct {
 	fileTrans        *FileTransfer                                 // 正在传输的 文件对象，每个客户端每次只能接收一个文件
 	saveFile         bool                                          // 确认保存文件，为false表示只将文件传过来而不保存
 	ticker           *time.Ticker                                  // 文件传输时，等待时间的定时器
+	calls            *znet.CallTable                               // 本客户端发起的 Call 正在等待回复的调用表
+	readVersion      uint8                                         // server 发来的帧的格式版本，收到它对协商帧格式的回复后变为 v2，只在 reader 中使用
 }
 
-func newClientConn(conn net.Conn, id uint32) *ClientConn {
+func newClientConn(conn net.Conn, id uint32, dp ziface.IDataPack) *ClientConn {
 	return &ClientConn{
 		id:   id,
 		conn: conn,
-		dp:   znet.NewDataPack(),
+		dp:   dp,
 		handler: map[uint32]func(ziface.IMessage, *ClientConn){
 			utils.MSGID_HEARTBEAT:    heartBeatHandler,
 			utils.MSGID_GENERAL_MSG:  generalMsgHandler,
 			utils.MSGID_PING:         pingHandler,
 			utils.MSGID_FILE_REQUEST: nil, // CLIENT 不会收到文件请求，只会发出
 			utils.MSGID_FILE_RESPOND: fileRespondHandler,
+			utils.MSGID_ERROR:        errorMsgHandler,
+			utils.MSGID_AUTH:         authHandler,
 		},
 		msgChan:          make(chan []byte), // 无阻塞通道即可，每次只处理一个消息
 		exitChan:         make(chan bool),
@@ -45,9 +50,34 @@ func newClientConn(conn net.Conn, id uint32) *ClientConn {
 		fileTrans:        &FileTransfer{fileWriter: nil},
 		saveFile:         false,                                    // 默认只传文件而不保存。
 		ticker:           time.NewTicker(time.Duration(1<<63 - 1)), // 因为默认不开启文件传输，故此定时器触发时间是无限大
+		calls:            znet.NewCallTable(),
+		readVersion:      znet.MsgVersion1,
 	}
 }
 
+// 连接建立后第一个发送协商帧格式的帧（v1 格式），告诉 server 之后发的都是 v2 的帧。在 reader、writer 启动之前调用
+func (c *ClientConn) offerFrameVersion() error {
+	buf, err := c.dp.Pack(&znet.Message{
+		Version: znet.MsgVersion1,
+		MsgId:   utils.MSGID_FRAME_VERSION,
+		Length:  1,
+		Data:    []byte{znet.MsgVersion2},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(buf)
+	return err
+}
+
+// 按 server 发来的帧的格式版本拆包
+func (c *ClientConn) unpack() (ziface.IMessage, error) {
+	if dp, ok := c.dp.(*znet.DataPack); ok {
+		return dp.UnpackVersion(c.conn, c.readVersion)
+	}
+	return c.dp.Unpack(c.conn)
+}
+
 func (c *ClientConn) clientReader() {
 	logrus.Debugf("client %d started READER !", c.id)
 	defer func() {
@@ -56,22 +86,26 @@ func (c *ClientConn) clientReader() {
 		c.exitChan <- true
 	}()
 	for {
-		// 先接收首部，再根据首部判断之后的内容如何接收
-		headData := make([]byte, c.dp.GetFixedHeadLen())
-		_, err := io.ReadFull(c.conn, headData)
+		// 在Unpack 中先接收首部，再调用 io.ReadFull 按照头部中定义的数据长度去读取
+		msgReceived, err := c.unpack()
 		if err != nil {
 			if err == io.EOF {
 				logrus.Info("远端server 已关闭!")
 				return
 			}
-			logrus.Errorf("client %d read err : %v", c.id, err)
+			logrus.Errorf("client %d read Unpack err : %v", c.id, err)
 			return
 		}
-		// 在Unpack 中再次调用 io.ReadFull 按照头部中定义的数据长度去读取
-		msgReceived, err := c.dp.Unpack(headData, c.conn)
-		if err != nil {
-			logrus.Error("server read Unpack err :", err)
-			return
+		// server 同意了协商的帧格式，之后它发来的帧都按 v2 拆包
+		if msgReceived.GetMsgId() == utils.MSGID_FRAME_VERSION {
+			if len(msgReceived.GetData()) == 1 {
+				c.readVersion = msgReceived.GetData()[0]
+			}
+			continue
+		}
+		// Call 发出的请求的回复直接交给等待它的 Call，不再走 handler
+		if c.calls.Deliver(msgReceived) {
+			continue
 		}
 		c.handler[msgReceived.GetMsgId()](msgReceived, c) // 根据消息ID 调用对应的handler, 不开额外线程去处理
 	}
@@ -102,6 +136,7 @@ func (c *ClientConn) stopClientConn() {
 	// 连接退出，释放资源
 	// 但是没有在主函数的 conns 切片中删除自己，但懒得管了
 	logrus.Debug("连接退出，释放资源")
+	c.calls.Close(nil) // 正在等待回复的 Call 都直接返回
 	c.conn.Close()
 	close(c.msgChan)
 	close(c.exitChan)
@@ -151,13 +186,45 @@ func (c *ClientConn) StartFileRequest() {
 }
 
 func (c *ClientConn) SendMsg(msgID uint32, length uint32, data []byte) error {
-	msg := &znet.Message{
-		MsgId:  msgID,
-		Length: length,
-		Data:   data,
+	return c.sendMessage(&znet.Message{
+		Version: znet.MsgVersion2, // 客户端连接后就协商了 v2 的帧格式，server 回复之后也会用 v2
+		MsgId:   msgID,
+		Length:  length,
+		Data:    data,
+	})
+}
+
+// 向server 发起一次请求并等待它的回复，返回回复的数据
+func (c *ClientConn) Call(ctx context.Context, msgID uint32, data []byte) ([]byte, error) {
+	return c.calls.Call(ctx, func(seqId uint32) error {
+		return c.sendMessage(&znet.Message{
+			Version: znet.MsgVersion2,
+			SeqId:   seqId,
+			MsgId:   msgID,
+			Length:  uint32(len(data)),
+			Data:    data,
+		})
+	})
+}
+
+// 每隔 interval 向server 发一次 PING 并等待回复，打印往返时间。连接关闭后 Call 会返回错误，随之退出
+func (c *ClientConn) StartPing(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		start := time.Now()
+		data, err := c.Call(context.Background(), utils.MSGID_PING, []byte("client ping"))
+		if err != nil {
+			logrus.Warnf("[client %d] PING 出错，停止 PING，err = %v", c.id, err)
+			return
+		}
+		logrus.Infof("[client %d] 收到 PING 的回复：%s，往返时间 %v", c.id, string(data), time.Since(start))
 	}
-	dp := znet.DataPack{}
-	sendData, err := dp.Pack(msg)
+}
+
+// 把消息封包后交给 writer 线程发出去
+func (c *ClientConn) sendMessage(msg *znet.Message) error {
+	sendData, err := c.dp.Pack(msg)
 	if err != nil {
 		logrus.Error("when SendMsg Pack msg, err = ", err)
 		return err
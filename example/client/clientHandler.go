@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	"github.com/myZinx/utils"
@@ -12,12 +14,15 @@ import (
 // 不同消息的handler
 func heartBeatHandler(msg ziface.IMessage, c *ClientConn) {
 	logrus.Debugf("[remote: %v | msgId: %s]: %s ", c.conn.RemoteAddr(), utils.GlobalObj.MsgIdDesc[msg.GetMsgId()], string(msg.GetData()))
-	// 心跳包需要回复
+	// 心跳包需要回复：server 的心跳检测器收到回复就知道客户端还在，并用回复中带回的序列号计算 RTT
 	data := []byte("来自 [客户端] 的心跳包")
 	msgSend := &znet.Message{ // 测试心跳包
-		MsgId:  utils.MSGID_HEARTBEAT,
-		Length: uint32(len(data)),
-		Data:   data}
+		Version: znet.MsgVersion2,
+		Flags:   znet.MsgFlagResponse,
+		SeqId:   msg.GetSeqId(), // 带上心跳包的序列号，表示这是对它的回复
+		MsgId:   utils.MSGID_HEARTBEAT,
+		Length:  uint32(len(data)),
+		Data:    data}
 	buf, err := c.dp.Pack(msgSend)
 	if err != nil {
 		logrus.Error("client Pack err,err = ", err)
@@ -26,9 +31,24 @@ func heartBeatHandler(msg ziface.IMessage, c *ClientConn) {
 	c.msgChan <- buf
 }
 
+// server 开启了认证时，连接建立后会先发来 HMAC 的挑战，用 -auth_key 指定的密钥回复；回复在另外的 goroutine 中用 Call 发出，不阻塞 reader
+func authHandler(msg ziface.IMessage, c *ClientConn) {
+	response := znet.HMACAuthResponse(fmt.Sprintf("client-%d", c.id), []byte(*authKey), msg.GetData())
+	go func() {
+		if _, err := c.Call(context.Background(), utils.MSGID_AUTH, response); err != nil {
+			logrus.Warnf("[client %d] 认证失败，err = %v", c.id, err)
+			return
+		}
+		logrus.Infof("[client %d] 认证成功", c.id)
+	}()
+}
+
 func generalMsgHandler(msg ziface.IMessage, c *ClientConn) {
 	logrus.Infof("[remote: %v | msgId: %s]: %s ", c.conn.RemoteAddr(), utils.GlobalObj.MsgIdDesc[msg.GetMsgId()], string(msg.GetData()))
 }
+func errorMsgHandler(msg ziface.IMessage, c *ClientConn) {
+	logrus.Warnf("[remote: %v | msgId: %s]: %s ", c.conn.RemoteAddr(), utils.GlobalObj.MsgIdDesc[msg.GetMsgId()], string(msg.GetData()))
+}
 func pingHandler(msg ziface.IMessage, c *ClientConn) {
 	logrus.Infof("[remote: %v | msgId: %s]: %s ", c.conn.RemoteAddr(), utils.GlobalObj.MsgIdDesc[msg.GetMsgId()], string(msg.GetData()))
 }
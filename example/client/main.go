@@ -10,22 +10,26 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/myZinx/utils"
+	"github.com/myZinx/znet"
 	"github.com/sirupsen/logrus"
 )
 
 var (
 	// server_ip = flag.String("server_ip", "192.168.199.164", "server IP")
 	// client_ip = flag.String("client_ip", "192.168.199.162", "client IP")
-	server_ip   = flag.String("server_ip", utils.GlobalObj.Host, "server IP")
-	client_ip   = flag.String("client_ip", "127.0.0.1", "client IP")
-	connections = flag.Int("conn", 3, "number of tcp connections")
-	lambda      = flag.Float64("lambda", 1/utils.GlobalObj.MeanWaitTimt, "lambda in neg exp") // 平均等待时间的倒数是 lambda
-	maxWaitTime = flag.Int("mwt", utils.GlobalObj.MaxWaitTimt, "max Wait Time")
-	cdf         []float64      // 根据上述两个值算得的负指数分布的cdf，放在全局变量这儿以供其他地方算随机等待时间
-	wg          sync.WaitGroup // 等待组
+	server_ip    = flag.String("server_ip", utils.GlobalObj.Host, "server IP")
+	client_ip    = flag.String("client_ip", "127.0.0.1", "client IP")
+	connections  = flag.Int("conn", 3, "number of tcp connections")
+	lambda       = flag.Float64("lambda", 1/utils.GlobalObj.MeanWaitTimt, "lambda in neg exp") // 平均等待时间的倒数是 lambda
+	maxWaitTime  = flag.Int("mwt", utils.GlobalObj.MaxWaitTimt, "max Wait Time")
+	pingInterval = flag.Int("ping", 0, "interval (seconds) of PING calls, 0 means no ping")
+	authKey      = flag.String("auth_key", "", "key answering the server's HMAC challenge, must be the same as the server's")
+	cdf          []float64      // 根据上述两个值算得的负指数分布的cdf，放在全局变量这儿以供其他地方算随机等待时间
+	wg           sync.WaitGroup // 等待组
 )
 
 type ClientConnMgr struct {
@@ -65,12 +69,19 @@ func main() {
 			return
 		}
 		newcId := atomic.AddUint32(&cmgr.cId, 1)
-		c := newClientConn(conn, newcId)
+		c := newClientConn(conn, newcId, znet.NewDataPack())
+		if err := c.offerFrameVersion(); err != nil {
+			logrus.Error("发送协商帧格式的帧 Error：", i, err)
+			return
+		}
 		cmgr.conns = append(cmgr.conns, c)
 		go c.clientReader()
 		go c.clientWriter()
 		wg.Add(2)
 		go c.StartFileRequest() // 每个连接的文件请求的goroutine一直是开着的，但默认是阻塞的，通过 给fileReqSignal 通道传值来开启
+		if *pingInterval > 0 {
+			go c.StartPing(time.Duration(*pingInterval) * time.Second)
+		}
 	}
 	go startGin(cmgr) // 开启 控制文件传输的接口
 	logrus.Infof("完成初始化 %d 条连接，最大端口号是：%d", len(cmgr.conns), *connections+cmgr.beginPort)
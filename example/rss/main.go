@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/myZinx/utils"
+	"github.com/myZinx/znet"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+对比 goroutine 模式和反应堆模式下大量空闲连接占用的内存，运行：go run ./example/rss
+server 在子进程中运行，父进程建立 -conns 个连接后读取子进程的 RSS（/proc/self/status 中的 VmRSS），
+这样客户端的 socket 不会算进 server 的内存。每种模式各跑一次，输出每 1 万个空闲连接增加的 RSS 和 goroutine 数。
+连接数较多时需要先调大文件描述符的限制（ulimit -n）
+*/
+
+var (
+	conns     = flag.Int("conns", 10000, "建立的空闲连接数")
+	port      = flag.Int("port", 9980, "server 监听的端口")
+	heartbeat = flag.Bool("heartbeat", true, "server 是否给每个连接开启心跳检测器")
+	role      = flag.String("role", "", "内部使用：为 server 时作为子进程运行 server")
+	mode      = flag.String("mode", "", "内部使用：子进程 server 的模式，goroutine 或 reactor")
+)
+
+func main() {
+	flag.Parse()
+	if *role == "server" {
+		runServer()
+		return
+	}
+	fmt.Printf("%d 个空闲连接，心跳检测器：%v\n", *conns, *heartbeat)
+	for _, m := range []string{"goroutine", "reactor"} {
+		if err := measure(m); err != nil {
+			fmt.Printf("%-9s 测试失败：%v\n", m, err)
+		}
+	}
+}
+
+// 启动子进程中的 server，建立连接，读取连接前后 server 的 RSS
+func measure(m string) error {
+	cmd := exec.Command(os.Args[0], "-role", "server", "-mode", m,
+		"-port", strconv.Itoa(*port), "-conns", strconv.Itoa(*conns), "-heartbeat="+strconv.FormatBool(*heartbeat))
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer cmd.Wait()
+	defer stdin.Close() // 子进程读到 EOF 后退出
+	lines := bufio.NewScanner(stdout)
+	// 子进程的每个请求都回复一行
+	ask := func(req string) (rss, goroutines int64, err error) {
+		fmt.Fprintln(stdin, req)
+		if !lines.Scan() {
+			return 0, 0, fmt.Errorf("server exited")
+		}
+		_, err = fmt.Sscan(lines.Text(), &rss, &goroutines)
+		return
+	}
+	before, g0, err := ask("measure")
+	if err != nil {
+		return err
+	}
+	var clients []net.Conn
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	for i := 0; i < *conns; i++ {
+		c, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", *port))
+		if err != nil {
+			return fmt.Errorf("dial %d err: %v", i, err)
+		}
+		clients = append(clients, c)
+	}
+	if _, _, err := ask("wait"); err != nil {
+		return err
+	}
+	after, g1, err := ask("measure")
+	if err != nil {
+		return err
+	}
+	per10k := float64(after-before) * 10000 / float64(*conns)
+	fmt.Printf("%-9s RSS %6.1f MB -> %6.1f MB，每 1 万个连接 %6.1f MB（每个连接 %5.2f KB），每个连接 %.2f 个 goroutine\n",
+		m, mb(before), mb(after), per10k/(1<<20), float64(after-before)/float64(*conns)/1024, float64(g1-g0)/float64(*conns))
+	return nil
+}
+
+func mb(n int64) float64 {
+	return float64(n) / (1 << 20)
+}
+
+// 子进程：启动 server，按父进程的请求回复 RSS 和 goroutine 数
+func runServer() {
+	logrus.SetLevel(logrus.WarnLevel)
+	utils.GlobalObj.Port = *port
+	utils.GlobalObj.MaxConn = *conns + 100
+	utils.GlobalObj.UseReactor = *mode == "reactor"
+	s := znet.NewServer("[RSS SERVER]")
+	s.UseHeartBeat = *heartbeat
+	if err := s.Start(); err != nil {
+		logrus.Fatal(err)
+	}
+	defer s.Stop()
+	lines := bufio.NewScanner(os.Stdin)
+	for lines.Scan() {
+		switch lines.Text() {
+		case "wait": // 等所有连接都被连接管理器接收
+			for s.GetConnMgr().Len() < *conns {
+				time.Sleep(10 * time.Millisecond)
+			}
+			fmt.Println(0, 0)
+		case "measure":
+			debug.FreeOSMemory()
+			fmt.Println(readRSS(), runtime.NumGoroutine())
+		}
+	}
+}
+
+// 读取本进程的 RSS，以字节为单位，没有 /proc 时返回 0
+func readRSS() int64 {
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "VmRSS:" {
+			kb, _ := strconv.ParseInt(fields[1], 10, 64)
+			return kb << 10
+		}
+	}
+	return 0
+}
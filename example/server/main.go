@@ -1,25 +1,65 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/myZinx/utils"
+	"github.com/myZinx/ziface"
 	"github.com/myZinx/znet"
 	"github.com/sirupsen/logrus"
 )
 
+// 不为空时开启 HMAC 挑战-应答认证，所有客户端共用这个密钥，客户端用相同的 -auth_key 启动
+var authKey = flag.String("auth_key", "", "shared key of HMAC authentication, empty means no authentication")
+
 // 基于 zinx开发的服务器端应用程序
 func main() {
+	flag.Parse()
 	// logrus.SetLevel(logrus.InfoLevel)
 	logrus.SetLevel(logrus.DebugLevel)
 	log.SetPrefix("[服务端]：")
 	// 1 创建一个server 句柄，使用 zinx 的api
 	s := znet.NewServer("[MILLION TCP CONN SERVER]")
+	// 提出压缩的 v2 客户端优先用 snappy，其次 gzip；文件数据（mp4）本来就压缩过，默认不压缩
+	utils.GlobalObj.Compression = []ziface.CompressionCodec{ziface.CompressSnappy, ziface.CompressGzip}
+	// 每个连接每秒最多请求 2 个文件（最多突发 5 个），超过的请求回复错误帧；同一个 IP 的所有连接每秒最多 1000 个消息
+	s.GetConnMgr().SetRateLimit(ziface.RateLimitPerConn, utils.MSGID_FILE_REQUEST, ziface.RateLimit{MsgRate: 2, MsgBurst: 5, Action: ziface.RateLimitReply})
+	s.GetConnMgr().SetRateLimit(ziface.RateLimitPerIP, ziface.RateLimitAllMsgs, ziface.RateLimit{MsgRate: 1000, Action: ziface.RateLimitDelay})
+	// 被拒绝的连接（黑白名单、每个 IP 的连接数等，在 GlobalObj 中配置）关闭前先告诉对端原因
+	s.SetOnConnReject(func(conn net.Conn, reason ziface.RejectReason) {
+		logrus.Infof("拒绝来自 %v 的连接：%v", conn.RemoteAddr(), reason)
+		znet.SendRejectReason(conn, s.GetDataPack(), reason)
+	})
+	if *authKey != "" {
+		s.SetAuthenticator(&znet.HMACAuthenticator{
+			Key: func(identity string) ([]byte, error) { return []byte(*authKey), nil },
+		})
+		s.SetOnConnAuth(func(conn ziface.IConnection) {
+			identity, _ := conn.GetProperty(znet.PropAuthIdentity)
+			logrus.Infof("连接 %d 认证成功，identity = %v", conn.GetConnID(), identity)
+		})
+	}
 	go startGin(s)
-	s.Serve()
+	// 收到 SIGINT/SIGTERM 后优雅地关闭服务器，Serve 会在关闭完成后返回
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigChan
+		logrus.Infof("收到信号 %v，开始关闭服务器", sig)
+		s.Stop()
+	}()
+	if err := s.Serve(); err != nil {
+		logrus.Fatal("服务器运行出错，err = ", err)
+	}
+	logrus.Info("服务器已关闭")
 }
 
 // 开一个 gin 服务器去等待命令去开启或关闭 文件请求
@@ -35,11 +75,35 @@ func startGin(s *znet.Server) {
 			"err": "",
 		})
 	})
+	// 没有给 WebSocket 单独配置端口的话，就挂在 gin 上与它共用端口，浏览器可以连接 ws://host:ServerGinPort/ws
+	if utils.GlobalObj.WsPort == 0 {
+		r.GET(utils.GlobalObj.WsPath, gin.WrapH(s.WebSocketHandler()))
+	}
 	r.GET("/StopFileReq", func(ctx *gin.Context) {
 		s.AllowFileReq = false
 		ctx.JSON(http.StatusOK, gin.H{
 			"err": "",
 		})
 	})
+	// 给所有客户端广播一条普通消息，例如 /Broadcast?msg=hello
+	r.GET("/Broadcast", func(ctx *gin.Context) {
+		n := s.GetConnMgr().Broadcast(utils.MSGID_GENERAL_MSG, []byte(ctx.Query("msg")))
+		ctx.JSON(http.StatusOK, gin.H{
+			"err":   "",
+			"conns": n,
+		})
+	})
+	// 查看限流的统计数据
+	r.GET("/RateLimitStats", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.GetConnMgr().GetRateLimitStats())
+	})
+	// 查看所有连接一起的压缩统计，ratio 是压缩后的字节数 / 压缩前的字节数
+	r.GET("/CompressionStats", func(ctx *gin.Context) {
+		stats := s.GetCompressionStats()
+		ctx.JSON(http.StatusOK, gin.H{
+			"stats": stats,
+			"ratio": stats.Ratio(),
+		})
+	})
 	r.Run(addr)
 }
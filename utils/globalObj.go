@@ -2,6 +2,7 @@ package utils
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 
 	"github.com/myZinx/ziface"
@@ -14,11 +15,15 @@ import (
 
 // 消息ID 定义。不同消息的默认处理路由在router.go 中定义，同时在server.go中newServer的时候给默认路由加入
 const (
-	MSGID_HEARTBEAT    = 0
-	MSGID_GENERAL_MSG  = 1
-	MSGID_PING         = 2
-	MSGID_FILE_REQUEST = 3
-	MSGID_FILE_RESPOND = 4
+	MSGID_HEARTBEAT     = 0
+	MSGID_GENERAL_MSG   = 1
+	MSGID_PING          = 2
+	MSGID_FILE_REQUEST  = 3
+	MSGID_FILE_RESPOND  = 4
+	MSGID_ERROR         = 5 // 出错时回复给对端的消息，data 是错误信息
+	MSGID_AUTH          = 6 // 连接认证的消息，server 设置了认证器时，连接要先用它完成认证
+	MSGID_COMPRESSION   = 7 // 协商压缩算法的消息，客户端连接后发送它支持的压缩算法，server 回复选中的
+	MSGID_FRAME_VERSION = 8 // 协商帧格式版本的消息，总是 v1 的帧，data 是一个字节的版本号。客户端连接后第一个发送，server 回复同意的版本
 )
 
 type GlobalObject struct {
@@ -29,18 +34,75 @@ type GlobalObject struct {
 	ServerGinPort int            // Server 使用 gin 部署额外的服务
 	ClientGinPort int            // client 使用 gin 部署额外的服务
 	Name          string         // 当前服务器名称
+	WsPort        int            // WebSocket 监听的端口，为 0 时不单独监听（可以把 Server.WebSocketHandler 挂到 gin 上共用端口）
+	WsPath        string         // WebSocket 的路径
+	// 允许发起 WebSocket 连接的网页来源（比如 "https://example.com"），"*" 表示全部允许。
+	// 没有 Origin 头的请求（非浏览器的客户端）和与请求的 Host 同源的总是允许，其他的拒绝，防止跨站劫持 WebSocket
+	WsAllowedOrigins []string
+	UdpPort          int // UDP 监听的端口，为 0 时不开启 UDP
+	// TLS 的配置，证书和私钥都不为空时 server 使用 TLS；ClientCAFile 不为空时开启双向认证（要求客户端提供证书）
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	// 监听的网络："tcp4"（默认）、"tcp"、"tcp6" 监听 Host:Port；"unix" 监听 UnixSocketPath，以 "@" 开头时使用 Linux 的抽象命名空间
+	Network        string
+	UnixSocketPath string
+	// 接收连接时的访问控制，含义见 ziface.AccessPolicy；运行中可以用 Server.SetAccessPolicy 重新设置
+	AllowCIDRs    []string
+	DenyCIDRs     []string
+	MaxConnsPerIP int
+	AcceptRate    float64
+	AcceptBurst   int
 	// zinx 的配置
 	Version            string // 当前 zinx 版本号
 	MaxConn            int    // 当前服务器主机允许的最大连接数
 	MaxPackageSize     uint32 // 当前框架数据包的最大值
 	MaxFilePackageSize uint32 // 当前框架中发送文件数据包的最大值
+	// 消息处理的工作池配置
+	WorkerPoolSize   uint32 // 工作池中 worker 的数量，为 0 时退回到每个消息单独开一个 goroutine 的模式
+	MaxWorkerTaskLen uint32 // 每个 worker 对应的任务队列的最大长度，队列满时 reader 会阻塞（背压）
+	ClosePanicConn   bool   // router 处理消息时发生 panic 后是否关闭该连接
+	CallTimeout      int    // Call 等待回复的默认超时时间，以秒为单位，传入的 ctx 没有设置超时时间时使用
+	// server 设置了认证器时，连接要在 AuthTimeout 秒内、在收到的前 AuthMaxFrames 个帧（不算心跳包）内完成认证，否则关闭连接，为 0 时不限制
+	AuthTimeout   int
+	AuthMaxFrames int
+	// 消息的压缩（只对 v2 的帧）：Compression 是支持的压缩算法，按优先顺序排列，为空时不压缩；
+	// 数据达到 CompressThreshold 字节的帧才压缩，CompressLevel 是 flate 和 gzip 的压缩级别，CompressSkipMsgIDs 中的消息不压缩（比如本来就压缩过的文件数据），是 NewServer、NewClient 时的默认值
+	Compression        []ziface.CompressionCodec
+	CompressThreshold  int
+	CompressLevel      int
+	CompressSkipMsgIDs []uint32
+	// 反应堆模式（只支持 Linux）：用 ReactorLoops 个 epoll 事件循环读取所有 TCP 和 Unix domain socket 的连接，
+	// 连接不再各自占一个 reader goroutine，适合大量空闲的长连接。ReactorLoops 为 0 时等于 CPU 核数
+	UseReactor   bool
+	ReactorLoops int
+	// 每个连接的发送队列配置
+	MaxMsgChanLen   uint32                // 发送队列的最大长度
+	SendQueuePolicy ziface.OverflowPolicy // 发送队列满时的处理策略
+	SendTimeout     int                   // 策略为 OverflowBlock 时最长的等待时间，以秒为单位，为 0 时一直等待
+	// writer 把队列中的多条消息合并成一次写入：最多合并 WriteBatchSize 字节；
+	// 队列空了之后再最多等待 WriteFlushInterval 毫秒看有没有新的消息，为 0 时不等待，立即写入
+	WriteBatchSize     uint32
+	WriteFlushInterval int
+	// 客户端断线重连的退避时间，以秒为单位，从最小值开始每次失败翻倍，直到最大值。最小值为 0 时从 100 毫秒开始
+	ClientReconnectMinInterval int
+	ClientReconnectMaxInterval int
+	TLSHandshakeTimeout        int // TLS 握手的超时时间，以秒为单位
+	UdpSessionTimeout          int // UDP 会话的空闲超时时间，以秒为单位，超过这个时间没有收到数据的会话会过期（代替心跳检测），为 0 时不过期
+	ShutdownTimeout            int // 关闭服务器时等待正在处理的请求（包括正在传输的文件）完成的最长时间，以秒为单位，超时后强制关闭所有连接
 	// 心跳检测器配置,定义全局的心跳包发送间隔
 	// （设定最大值和最小值，具体连接的发送间隔去其中的随机数。因为设定唯一值会使所有连接同时发心跳包，当连接过多时会导致突发流量）
 	MinSendInterval int
 	MaxSendInterval int     // 心跳包发送最大间隔  以秒为单位
+	HeartbeatTick   int     // 所有连接共用的心跳时间轮的精度，以毫秒为单位
 	MinWaitTimt     int     // 文件传输中的最小等待时间，与下面两个不会冲突，它是加在随机出来的时间上的
 	MeanWaitTimt    float64 // 文件传输中的平均等待时间
 	MaxWaitTimt     int     // 文件传输中的最长等待时间
+	// 判断对端已经不在了的策略：超过 HeartbeatIdleTimeout 秒没有收到数据，或者连续 MaxMissedHeartbeats 个心跳包之后都没有收到数据，
+	// 就调用 OnRemoteNotAlive 并关闭连接，为 0 时不做对应的检查。默认都是 0，只发送心跳包，不会因为对端没有回应而关闭连接：
+	// 对端不回复心跳包也不发数据的话（比如只接收推送的客户端），打开 MaxMissedHeartbeats 会把它当成已经不在了
+	HeartbeatIdleTimeout int
+	MaxMissedHeartbeats  int
 
 	FileNames []string // 认为客户端是知道所有文件名和文件大小的
 	FileSizes []int64
@@ -54,29 +116,65 @@ var GlobalObj *GlobalObject
 // 提供init方法 初始化对象
 func init() {
 	GlobalObj = &GlobalObject{ // 现在配置一些默认值
-		Name:               "Zinx Server App",
-		Host:               "127.0.0.1",
-		Port:               8990, // TCP 服务器断开
-		ServerGinPort:      8991, // 服务器程序接收 文件传输命令 的服务器端口
-		ClientGinPort:      8992, // 客户端程序接收 文件传输命令 的服务器端口
-		Version:            "V1.0",
-		MaxConn:            60000,
-		MaxPackageSize:     1024,
-		MaxFilePackageSize: 1 << 15, // 暂定32KB，本机器的tcp发送缓存大小为200KB；修改此处可以明显改变文件传输速度
-		MinSendInterval:    100,     // 心跳包发送时间间隔设置
-		MaxSendInterval:    200,
-		MinWaitTimt:        2, // 最小等待时间是直接加在下面两个值算出来的随机等待时间上的
-		MeanWaitTimt:       30,
-		MaxWaitTimt:        60,
-		FileNames:          []string{"bigfile.mp4", "v1_hpzg.mp4", "v2_hpzg.mp4", "v3_4k.mp4", "v4_4k.mp4"},
-		FileSizes:          []int64{2147479552, 5949948, 75313964, 124565867, 324563298},
+		Name:                       "Zinx Server App",
+		Host:                       "127.0.0.1",
+		Port:                       8990, // TCP 服务器断开
+		Network:                    "tcp4",
+		UnixSocketPath:             "/tmp/zinx.sock",
+		MaxConnsPerIP:              0, // 默认不限制每个 IP 的连接数和接收新连接的速率
+		AcceptRate:                 0,
+		WsPort:                     0,
+		WsPath:                     "/ws",
+		UdpPort:                    0,
+		ServerGinPort:              8991, // 服务器程序接收 文件传输命令 的服务器端口
+		ClientGinPort:              8992, // 客户端程序接收 文件传输命令 的服务器端口
+		Version:                    "V1.0",
+		MaxConn:                    60000,
+		MaxPackageSize:             1024,
+		MaxFilePackageSize:         1 << 15, // 暂定32KB，本机器的tcp发送缓存大小为200KB；修改此处可以明显改变文件传输速度
+		WorkerPoolSize:             16,      // 同一个连接的消息总是交给同一个 worker，保证单个连接内消息的处理顺序
+		MaxWorkerTaskLen:           1024,
+		ClosePanicConn:             false, // 默认只恢复 panic 并打印日志，不关闭连接
+		MaxMsgChanLen:              128,   // 文件传输时每条消息最大 MaxFilePackageSize，队列不宜太长
+		SendQueuePolicy:            ziface.OverflowBlock,
+		SendTimeout:                10,
+		WriteBatchSize:             64 << 10,
+		WriteFlushInterval:         0,
+		CallTimeout:                10,
+		AuthTimeout:                10,
+		AuthMaxFrames:              3,
+		Compression:                nil, // 默认不压缩
+		CompressThreshold:          1024,
+		CompressLevel:              1, // flate.BestSpeed
+		CompressSkipMsgIDs:         []uint32{MSGID_FILE_RESPOND},
+		UseReactor:                 false,
+		ReactorLoops:               0,
+		ClientReconnectMinInterval: 1,
+		ClientReconnectMaxInterval: 30,
+		TLSHandshakeTimeout:        10,
+		UdpSessionTimeout:          60,
+		ShutdownTimeout:            30,
+		MinSendInterval:            100, // 心跳包发送时间间隔设置
+		MaxSendInterval:            200,
+		HeartbeatTick:              100,
+		HeartbeatIdleTimeout:       0,
+		MaxMissedHeartbeats:        0,
+		MinWaitTimt:                2, // 最小等待时间是直接加在下面两个值算出来的随机等待时间上的
+		MeanWaitTimt:               30,
+		MaxWaitTimt:                60,
+		FileNames:                  []string{"bigfile.mp4", "v1_hpzg.mp4", "v2_hpzg.mp4", "v3_4k.mp4", "v4_4k.mp4"},
+		FileSizes:                  []int64{2147479552, 5949948, 75313964, 124565867, 324563298},
 	}
 	GlobalObj.MsgIdDesc = map[uint32]string{
-		MSGID_HEARTBEAT:    "HEARTBEAT",
-		MSGID_GENERAL_MSG:  "GENERAL_MSG",
-		MSGID_PING:         "PING",
-		MSGID_FILE_REQUEST: "FILE_REQUEST",
-		MSGID_FILE_RESPOND: "FILE_RESPOND",
+		MSGID_HEARTBEAT:     "HEARTBEAT",
+		MSGID_GENERAL_MSG:   "GENERAL_MSG",
+		MSGID_PING:          "PING",
+		MSGID_FILE_REQUEST:  "FILE_REQUEST",
+		MSGID_FILE_RESPOND:  "FILE_RESPOND",
+		MSGID_ERROR:         "ERROR",
+		MSGID_AUTH:          "AUTH",
+		MSGID_COMPRESSION:   "COMPRESSION",
+		MSGID_FRAME_VERSION: "FRAME_VERSION",
 	}
 	// GlobalObj.Reload("")
 }
@@ -94,4 +192,19 @@ func (g *GlobalObject) Reload(filePath string) {
 	if err != nil {
 		panic(err)
 	}
+	if err = g.Check(); err != nil {
+		panic(err)
+	}
+}
+
+// 检查配置的取值是否合法，不合法的配置会让 server 运行时出错（比如用它创建 time.Ticker 时 panic）
+func (g *GlobalObject) Check() error {
+	if g.UdpSessionTimeout < 0 {
+		return fmt.Errorf("UdpSessionTimeout must not be negative, got %d", g.UdpSessionTimeout)
+	}
+	if g.ClientReconnectMinInterval < 0 || g.ClientReconnectMaxInterval < g.ClientReconnectMinInterval {
+		return fmt.Errorf("ClientReconnectMinInterval must not be negative or greater than ClientReconnectMaxInterval, got %d and %d",
+			g.ClientReconnectMinInterval, g.ClientReconnectMaxInterval)
+	}
+	return nil
 }
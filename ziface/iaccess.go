@@ -0,0 +1,38 @@
+package ziface
+
+// 接收连接时的访问控制策略，运行中可以用 SetAccessPolicy 整个替换，之后接收的连接按新的策略检查，已经建立的连接不受影响。
+// 网段可以写成 CIDR（"10.0.0.0/8"）或单个 IP；Unix domain socket 的连接没有 IP，只受 MaxConn 和 AcceptRate 的限制
+type AccessPolicy struct {
+	AllowCIDRs    []string // 不为空时只接收来自这些网段的连接
+	DenyCIDRs     []string // 拒绝来自这些网段的连接，优先于 AllowCIDRs
+	MaxConnsPerIP int      // 每个 IP 同时最多的连接数，为 0 时不限制
+	AcceptRate    float64  // 每秒最多接收的新连接数（所有 IP 一起计算），为 0 时不限制
+	AcceptBurst   int      // 允许突发的新连接数，为 0 时等于 AcceptRate（至少为 1）
+}
+
+// 拒绝连接的原因
+type RejectReason int
+
+const (
+	RejectDenied        RejectReason = iota + 1 // 在 DenyCIDRs 中
+	RejectNotAllowed                            // 不在 AllowCIDRs 中
+	RejectAcceptRate                            // 新连接太多，超过了 AcceptRate
+	RejectMaxConn                               // 总连接数达到了 MaxConn
+	RejectMaxConnsPerIP                         // 该 IP 的连接数达到了 MaxConnsPerIP
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectDenied:
+		return "ip denied"
+	case RejectNotAllowed:
+		return "ip not allowed"
+	case RejectAcceptRate:
+		return "too many new connections"
+	case RejectMaxConn:
+		return "too many connections"
+	case RejectMaxConnsPerIP:
+		return "too many connections from this ip"
+	}
+	return "unknown"
+}
@@ -0,0 +1,12 @@
+package ziface
+
+// 认证器。server 设置了认证器后，新连接要先用 MSGID_AUTH 的帧完成认证，之后其他消息ID 的消息才会交给 router。
+// 所有连接共用一个认证器，每个连接自己的认证状态可以保存在连接属性中
+type IAuthenticator interface {
+	// 连接建立后调用，返回先发给对端的数据（比如随机的挑战），为 nil 时不发送，等待对端先发来凭证；返回错误时关闭连接
+	Challenge(conn IConnection) ([]byte, error)
+	// 验证对端发来的一个认证帧。done 为 true 时认证成功，identity 是对端的身份；done 为 false 且没有错误时认证还没结束（多轮认证）。
+	// reply 不为 nil 时作为这个认证帧的回复发给对端；返回错误时认证失败，连接会被关闭。
+	// 在读取该连接的 goroutine（反应堆模式下是事件循环）中调用，不能阻塞太久
+	Verify(conn IConnection, data []byte) (identity string, reply []byte, done bool, err error)
+}
@@ -0,0 +1,36 @@
+package ziface
+
+import (
+	"context"
+	"crypto/tls"
+)
+
+// 定义客户端接口。客户端与server 使用同样的 Connection、MessageHandler、router 和心跳检测器
+type IClient interface {
+	// 连接server，第一次连接失败时返回错误；之后连接断开会按退避时间自动重连
+	Start() error
+	// 关闭客户端，不再重连
+	Stop()
+	// 运行，阻塞直到客户端被 Stop
+	Serve() error
+	// 路由功能：给客户端注册一个路由，处理server 发来的消息
+	AddRouter(msgID uint32, router IRouter)
+	// 添加全局的中间件
+	Use(...MiddlewareFunc)
+	// 添加只对某个消息ID 生效的中间件
+	UseFor(msgID uint32, middlewares ...MiddlewareFunc)
+	// 设置客户端使用的封包拆包模块，需要与server 一致
+	SetDataPack(IDataPack)
+	// 设置客户端使用的 TLS 配置，不为 nil 时使用 TLS 连接server
+	SetTLSConfig(*tls.Config)
+	// 得到当前的连接，尚未连接或者断线重连中时返回 nil
+	GetConnection() IConnection
+
+	// 设置连接建立之后自动调用 hook 函数（每次重连成功都会调用）
+	SetOnConnStart(func(IConnection))
+	// 设置连接断开之后自动调用 hook 函数
+	SetOnConnStop(func(IConnection))
+
+	// 得到客户端的上下文，客户端 Stop 时会被取消
+	Context() context.Context
+}
@@ -0,0 +1,43 @@
+package ziface
+
+// 消息的压缩算法，压缩后的数据的第一个字节就是它
+type CompressionCodec uint8
+
+const (
+	CompressNone   CompressionCodec = iota // 不压缩
+	CompressFlate                          // compress/flate（DEFLATE，没有 gzip 的头和校验和）
+	CompressGzip                           // compress/gzip
+	CompressSnappy                         // snappy 的块格式，压缩率不如 flate，但快得多
+)
+
+func (c CompressionCodec) String() string {
+	switch c {
+	case CompressNone:
+		return "none"
+	case CompressFlate:
+		return "flate"
+	case CompressGzip:
+		return "gzip"
+	case CompressSnappy:
+		return "snappy"
+	}
+	return "unknown"
+}
+
+// 压缩的统计数据
+type CompressionStats struct {
+	Codec              CompressionCodec // 连接协商出的压缩算法，server 所有连接一起的统计中为 CompressNone
+	CompressedFrames   uint64           // 压缩后发送的帧数
+	SkippedFrames      uint64           // 达到了压缩的阈值但没有压缩的帧数（消息ID 不压缩，或者压缩后没有变小）
+	RawBytes           uint64           // 压缩的帧压缩前的数据字节数
+	CompressedBytes    uint64           // 压缩的帧压缩后的数据字节数
+	DecompressedFrames uint64           // 收到并解压的帧数
+}
+
+// 压缩率：压缩后的字节数 / 压缩前的字节数，越小越好，还没有压缩过时为 0
+func (s CompressionStats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 0
+	}
+	return float64(s.CompressedBytes) / float64(s.RawBytes)
+}
@@ -1,6 +1,11 @@
 package ziface
 
-import "net"
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"time"
+)
 
 // 定义连接 模块的抽象层
 
@@ -9,16 +14,35 @@ type IConnection interface {
 	Start()
 	// 关闭连接。结束连接的工作
 	Stop()
-	// 获取当前连接绑定的 conn
+	// 获取当前连接绑定的 socket（TCP 或 TLS 连接）
+	GetConnection() net.Conn
+	// 获取当前连接底层的 TCP 连接，TLS 连接返回它下层的 TCP 连接，不是基于 TCP 的连接返回 nil
 	GetTCPConnection() *net.TCPConn
+	// 获取对端的证书，开启了双向认证的 TLS 连接才有，否则返回 nil
+	GetPeerCertificate() *x509.Certificate
 	// 获取连接ID
 	GetConnID() uint32
 	// 获取客户端的TCP状态 IP和Port
 	RemoteAddr() net.Addr
-	// 发送数据
+	// 发送数据，按该连接协商出的帧格式封包
 	SendMsg(uint32, uint32, []byte) error
+	// 发送一个完整的消息（可以带标志位和序列号），消息的版本为 0 时使用该连接协商出的帧格式
+	SendMessage(IMessage) error
+	// 发送数据，发送队列满时不阻塞，直接返回错误
+	TrySendMsg(uint32, uint32, []byte) error
+	// 发送队列中还没写入 socket 的消息数
+	QueueDepth() int
+	// 设置发送队列满时的处理策略，timeout 是 OverflowBlock 时的最长等待时间，为 0 时一直等待
+	SetSendPolicy(policy OverflowPolicy, timeout time.Duration)
+	// 向对端发起一次请求并等待它的回复（对端回复时需要带上相同的序列号和回复标志），返回回复的数据。
+	// 需要连接已经协商为 v2 的帧格式；ctx 没有设置超时时间时使用 GlobalObj.CallTimeout
+	Call(ctx context.Context, msgID uint32, data []byte) ([]byte, error)
+	// 得到该连接发送时使用的帧格式版本。连接开始时是 v1，双方用 MSGID_FRAME_VERSION 协商之后是 v2
+	GetFrameVersion() uint8
 	// 绑定心跳检测器
 	BindHeartBeatChecker(IHeartBeatChecker)
+	// 得到绑定的心跳检测器，可以读取 RTT 和丢失的心跳数，没有开启心跳检测时返回 nil
+	GetHeartBeatChecker() IHeartBeatChecker
 
 	// 设置连接属性
 	SetProperty(string, any)
@@ -28,11 +52,31 @@ type IConnection interface {
 	RemoveProperty(string)
 	// 是否还存活
 	IsAlive() bool
+	// 是否已经认证成功。server 没有设置认证器时总是 true；设置了的话，OnConnStart 时一般还是 false，认证成功后调用 OnConnAuth
+	IsAuthenticated() bool
+	// 得到该连接协商出的压缩算法和压缩统计
+	GetCompressionStats() CompressionStats
+	// 最后一次收到对端数据的时间
+	GetLastActiveTime() time.Time
+	// 连接是从 server 的哪个监听器进来的（AddListener 时的名称），客户端的连接为空
+	GetListenerName() string
+	// 得到连接的上下文，连接关闭或者服务器关闭时会被取消
+	Context() context.Context
 	// 虽然这样耦合太严重了，但为了实现在服务器关闭正在传输的文件，必须把server 加到每个连接中
 	SetServer(IServer)
 	GetServer() IServer
 }
 
+// 连接的发送队列满时的处理策略
+type OverflowPolicy int
+
+const (
+	OverflowBlock      OverflowPolicy = iota // 阻塞等待队列空出位置，超时后返回错误
+	OverflowDropNewest                       // 丢弃要发送的这条消息，返回错误
+	OverflowDropOldest                       // 丢弃队列中最早的一条消息，腾出位置
+	OverflowCloseConn                        // 关闭这个处理不过来的连接
+)
+
 // 定义一个处理连接所绑定的业务的方法
 // 通过第一个参数得到连接的信息，通过第二三个参数得到处理的数据
 // 每一个IConnection 的实现都应该有这个成员属性
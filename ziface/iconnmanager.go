@@ -1,5 +1,7 @@
 package ziface
 
+import "time"
+
 // 消息管理模块
 
 type IConnManager interface {
@@ -13,10 +15,37 @@ type IConnManager interface {
 	Len() int
 	// 终止并清楚所有连接，关闭服务器时
 	Clear()
+	// 关闭超过 timeout 没有收到数据的连接，filter 不为 nil 时只检查它返回 true 的连接，返回关闭的连接数
+	SweepIdle(timeout time.Duration, filter func(IConnection) bool) int
+	// 等待所有连接删除完毕后，结束连接管理的方法
+	Stop(time.Duration)
 	// 连接管理的方法，每次客户端连接成功或断开连接会将会连接信息放进通道，connManage方法从通道中读取后才去添加或删除这个连接
 	ConnManage()
+	// 给所有连接发送消息，每个连接的发送互不阻塞，返回消息成功放进发送队列的连接数（不包括已经关闭的和发送队列已满的）
+	Broadcast(msgID uint32, data []byte) int
+	// 给指定的连接发送消息，返回消息成功放进发送队列的连接数
+	SendTo(connIDs []uint32, msgID uint32, data []byte) int
+	// 把连接加入一个组（房间），连接断开时会自动离开所有的组
+	JoinGroup(group string, conn IConnection) error
+	// 让连接离开一个组
+	LeaveGroup(group string, conn IConnection)
+	// 得到组内的所有连接
+	GetGroupMembers(group string) []IConnection
+	// 得到所有组的名称
+	GetGroups() []string
+	// 给组内的所有连接发送消息，返回消息成功放进发送队列的连接数
+	SendToGroup(group string, msgID uint32, data []byte) int
+	// 设置限流规则：scope 指定按连接还是按 IP 计算，msgID 为 RateLimitAllMsgs 时限制所有消息的总量，否则只限制这个消息ID。
+	// 一个消息要同时满足所有对它生效的规则。运行中也可以修改，下一个消息就按新的规则计算
+	SetRateLimit(scope RateLimitScope, msgID uint32, limit RateLimit)
+	// 删除限流规则
+	RemoveRateLimit(scope RateLimitScope, msgID uint32)
+	// 得到限流的统计数据
+	GetRateLimitStats() RateLimitStats
 	// 得到 与连接管理器通信的通道
 	GetConnMgrChan() chan IConnection
+	// 得到 连接管理器退出时关闭的通道，关闭后连接不能再向 ConnMgrChan 写入
+	GetExitChan() <-chan bool
 	// 设置连接管理模块对应的server
 	SetServer(IServer)
 }
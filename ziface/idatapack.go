@@ -1,11 +1,10 @@
 package ziface
 
-import "net"
+import "io"
 
+// 封包、拆包模块的抽象层，server 和 client 都可以替换成自己的实现（比如大端序、变长长度、额外的包头字段）
 type IDataPack interface {
-	GetHeadLen() uint32 // 得到应用层包头的长度
-	Pack(IMessage) ([]byte, error)
-	Unpack([]byte) (IMessage, error)
-	UnpackText(IMessage, net.Conn) (IMessage, error)
-	UnpackFile(IMessage, net.Conn) (IMessage, error)
+	GetHeadLen() uint32                 // 得到应用层包头的长度（固定部分）
+	Pack(IMessage) ([]byte, error)      // 封包，把消息序列化为要发送的字节
+	Unpack(io.Reader) (IMessage, error) // 拆包，从 reader 中读出一个完整的数据包（包头和数据）
 }
@@ -1,5 +1,7 @@
 package ziface
 
+import "time"
+
 type IHeartBeatChecker interface {
 	// 给该心跳检测器绑定对应连接的方法
 	BindConn(IConnection)
@@ -18,4 +20,12 @@ type IHeartBeatChecker interface {
 	SendHeartbeat() error
 	// 更新心跳检测器活跃时间的方法
 	UpdateActiveTime()
+	// 设置判断对端已经不在了的策略：超过 idleTimeout 没有收到数据，或者连续 maxMissed 个心跳包之后都没有收到数据，为 0 时不做对应的检查
+	SetDeadPeerPolicy(idleTimeout time.Duration, maxMissed int)
+	// 收到对端对心跳包的回复时调用，用来计算 RTT
+	HandleReply(IMessage)
+	// 最近一次心跳包的往返时间，对端还没有回复过时为 0
+	GetRTT() time.Duration
+	// 连续丢失的心跳数
+	GetMissCount() int
 }
@@ -7,4 +7,15 @@ type IMessage interface {
 	GetData() []byte
 	// 这俩需要额外的set方法
 	SetBodyContent(buf []byte)
+
+	// 帧格式的版本
+	GetVersion() uint8
+	SetVersion(uint8)
+	// 标志位（压缩、加密、回复、流式数据块）
+	GetFlags() uint8
+	SetFlags(uint8)
+	HasFlag(uint8) bool
+	// 序列号，用来把回复和请求对应起来
+	GetSeqId() uint32
+	SetSeqId(uint32)
 }
@@ -1,9 +1,31 @@
 package ziface
 
+import "time"
+
+// 中间件。每个消息在交给 router 之前都会按顺序经过中间件链，调用 next 进入下一个中间件（最后是 router 本身）。
+// 不调用 next 就会短路后面的中间件和 router；返回的错误会以 MSGID_ERROR 消息回复给对端
+type MiddlewareFunc func(req IRequest, next func() error) error
+
 // 此接口要放在在server 中
 type IMessageHandler interface {
 	// 调度，执行对应的router消息处理方法
 	DoMsgHandler(IRequest)
 	// 给server添加具体的router 处理逻辑
 	AddRouter(msgID uint32, router IRouter)
+	// 添加全局的中间件，对所有消息生效，按添加的顺序执行。server 运行中也可以添加，从下一个消息开始生效
+	Use(...MiddlewareFunc)
+	// 添加只对某个消息ID 生效的中间件，在全局中间件之后执行
+	UseFor(msgID uint32, middlewares ...MiddlewareFunc)
+	// 设置某个消息ID 的处理超时时间，超时后该请求的上下文会被取消
+	SetHandlerTimeout(msgID uint32, timeout time.Duration)
+	// 设置某个消息ID 的消息是否在工作池之外处理（会长时间占用 worker 的 router），同一个连接的这类消息仍然按顺序处理
+	SetAsync(msgID uint32, async bool)
+	// 启动工作池
+	StartWorkerPool()
+	// 将请求交给工作池的任务队列，由 worker 去处理（未开启工作池时每个消息开一个 goroutine 处理）
+	SendMsgToTaskQueue(IRequest)
+	// 不再接收新的请求，并等待已经接收的请求处理完，超时返回 false
+	Drain(time.Duration) bool
+	// 关闭工作池
+	StopWorkerPool()
 }
@@ -0,0 +1,48 @@
+package ziface
+
+// 限流规则按什么计算
+type RateLimitScope int
+
+const (
+	RateLimitPerConn RateLimitScope = iota // 每个连接单独计算
+	RateLimitPerIP                         // 来自同一个 IP 的所有连接一起计算
+)
+
+// 设置限流规则时用这个消息ID 表示所有消息共用的限额
+const RateLimitAllMsgs = ^uint32(0)
+
+// 消息超过限额时的处理方式
+type RateLimitAction int
+
+const (
+	RateLimitDrop       RateLimitAction = iota // 丢弃这个消息
+	RateLimitDelay                             // 等到有额度了再处理，期间不再读取该连接的数据（反应堆模式下事件循环暂时不再监听这个连接，不会等待）
+	RateLimitReply                             // 丢弃这个消息，并给对端回复一个 MSGID_ERROR 的错误帧
+	RateLimitDisconnect                        // 关闭连接
+)
+
+// 令牌桶的限流规则，速率为 0 的一项不限制
+type RateLimit struct {
+	MsgRate   float64         // 每秒允许的消息数
+	MsgBurst  int             // 允许突发的消息数，为 0 时等于 MsgRate（至少为 1）
+	ByteRate  float64         // 每秒允许的字节数（消息的数据部分）
+	ByteBurst int             // 允许突发的字节数，为 0 时等于 ByteRate
+	Action    RateLimitAction // 超过限额时的处理方式
+}
+
+// 限流的各种处理的次数
+type RateLimitCounters struct {
+	Allowed      uint64 // 通过检查的消息数
+	Dropped      uint64 // 被丢弃的消息数（不包括回复了错误帧的）
+	Delayed      uint64 // 被推迟处理的消息数
+	Replied      uint64 // 被丢弃并回复了错误帧的消息数
+	Disconnected uint64 // 因为超过限额被关闭的连接数
+}
+
+// 限流的统计数据
+type RateLimitStats struct {
+	RateLimitCounters                              // 所有连接的总数
+	Violations        map[uint32]uint64            // 每个消息ID 超过限额的次数
+	Conns             map[uint32]RateLimitCounters // 每个连接的计数，key 是连接ID。只包括还没有断开、检查过限流的连接
+	IPs               map[string]RateLimitCounters // 每个 IP 的计数，该 IP 的所有连接都断开后清零
+}
@@ -1,5 +1,7 @@
 package ziface
 
+import "context"
+
 type IRequest interface {
 	// 得到当前连接
 	GetConnection() IConnection
@@ -8,4 +10,19 @@ type IRequest interface {
 
 	GetMsgId() uint32
 	GetMsgLen() uint32
+	// 得到当前请求的完整消息，可以读取版本、标志位和序列号
+	GetMessage() IMessage
+
+	// 回复当前请求：使用相同的消息ID 和序列号，并带上回复标志，对端的 Call 会收到这个回复
+	Reply([]byte) error
+
+	// 得到当前请求的上下文。连接关闭、服务器关闭或者该消息的处理超时都会取消它
+	Context() context.Context
+	// 替换当前请求的上下文，router 可以由 Context() 派生出子上下文后再设置回来，传给之后的处理流程
+	SetContext(context.Context)
+
+	// 请求的数据来自缓冲池，处理完后会被回收。router 在处理结束后还要使用数据时先调用 Retain，用完后调用 Release
+	Retain()
+	// 释放请求的数据，工作池处理完请求后会自动调用一次
+	Release()
 }
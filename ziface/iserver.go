@@ -1,17 +1,46 @@
 package ziface
 
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
 // 定义服务器接口
 type IServer interface {
-	// 开始
-	Start()
-	// 结束
+	// 开始，监听失败时返回错误
+	Start() error
+	// 结束，等待正在处理的请求完成（有超时）后关闭所有连接
 	Stop()
-	// 运行
-	Serve()
+	// 运行，阻塞直到服务器被 Stop
+	Serve() error
 	// 路由功能：给当前的服务注册一个路由功能，供客户端的连接使用
 	AddRouter(msgID uint32, router IRouter)
+	// 给当前的服务添加全局的中间件
+	Use(...MiddlewareFunc)
+	// 给当前的服务添加只对某个消息ID 生效的中间件
+	UseFor(msgID uint32, middlewares ...MiddlewareFunc)
+	// 设置当前服务使用的 TLS 配置，之后建立的连接都使用 TLS
+	SetTLSConfig(*tls.Config)
+	// 添加一个监听器，所有监听器共用路由和连接管理器；Start 之后添加的立即开始监听。tlsConfig 不为 nil 时这个监听器使用 TLS
+	AddListener(name string, network string, address string, tlsConfig *tls.Config) error
+	// 删除一个监听器并停止监听，已经建立的连接不受影响
+	RemoveListener(name string) error
+	// 得到所有监听器的名称
+	GetListenerNames() []string
+	// 设置当前服务使用的封包拆包模块，之后建立的连接都会使用它
+	SetDataPack(IDataPack)
+	// 得到当前服务使用的封包拆包模块
+	GetDataPack() IDataPack
 	// 得到连接管理器
 	GetConnMgr() IConnManager
+	// 设置接收连接时的访问控制策略，运行中也可以重新设置；网段写错时返回错误，原来的策略不变
+	SetAccessPolicy(AccessPolicy) error
+	// 得到当前的访问控制策略
+	GetAccessPolicy() AccessPolicy
+	// 得到所有连接一起的压缩统计
+	GetCompressionStats() CompressionStats
 
 	// 设置该server 创建连接之后自动调用 hook 函数
 	SetOnConnStart(func(IConnection))
@@ -22,5 +51,26 @@ type IServer interface {
 	// 调用该server 断开连接之前自动调用 hook 函数
 	CallOnConnStop(IConnection)
 
+	// 设置认证器，之后建立的连接要先完成认证；为 nil 时不需要认证
+	SetAuthenticator(IAuthenticator)
+	// 设置该server 的连接认证成功之后自动调用的 hook 函数，在另外的 goroutine 中调用。没有设置认证器时不调用，连接建立时就已经认证过了
+	SetOnConnAuth(func(IConnection))
+	// 调用该server 的连接认证成功之后自动调用的 hook 函数
+	CallOnConnAuth(IConnection)
+
+	// 设置拒绝连接时调用的 hook 函数，可以在里面记录日志或者给对端发一个说明原因的帧，hook 返回后连接会被关闭。UDP 的会话被拒绝时不调用
+	SetOnConnReject(func(net.Conn, RejectReason))
+
+	// 设置 router（或中间件）处理消息发生 panic 时调用的 hook 函数
+	SetOnHandlerPanic(func(IRequest, any))
+	// 调用 router 处理消息发生 panic 时的 hook 函数
+	CallOnHandlerPanic(IRequest, any)
+
 	IsAllowFileReq() bool
+	// 得到server 的上下文，服务器关闭时等待正在处理的请求超时后会被取消
+	Context() context.Context
+	// 设置某个消息ID 的处理超时时间，超时后该请求的上下文会被取消
+	SetHandlerTimeout(msgID uint32, timeout time.Duration)
+	// 设置某个消息ID 的消息是否在工作池之外处理，会长时间占用 worker 的 router（比如传输整个文件）应该设置
+	SetAsync(msgID uint32, async bool)
 }
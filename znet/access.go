@@ -0,0 +1,211 @@
+package znet
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/myZinx/utils"
+	"github.com/myZinx/ziface"
+	"github.com/sirupsen/logrus"
+)
+
+// 拒绝连接时 OnConnReject 最多可以用多长时间给对端发送说明原因的帧，超时后直接关闭连接
+const rejectWriteTimeout = time.Second
+
+/*
+接收连接时的访问控制：黑白名单、每个 IP 同时的连接数和接收新连接的速率。
+所有监听器、WebSocket 和 UDP 的新连接都先经过 admit，通过的连接计入它的 IP 的连接数，连接关闭时用 release 减去
+*/
+type accessControl struct {
+	lock        sync.Mutex
+	configured  bool // 是否设置过策略，没有的话 Start 时使用 GlobalObj 中的配置
+	policy      ziface.AccessPolicy
+	allow, deny []*net.IPNet
+	// 接收新连接的令牌桶，AcceptRate 为 0 时不使用
+	acceptBucket limitBucket
+	// 每个 IP 当前的连接数（包括还在 TLS 握手的）。不管有没有限制都统计，运行中打开 MaxConnsPerIP 时也是准确的
+	ipConns map[string]int
+}
+
+func newAccessControl() *accessControl {
+	return &accessControl{
+		ipConns: make(map[string]int),
+	}
+}
+
+// 替换访问控制策略，网段写错时返回错误，原来的策略不变
+func (ac *accessControl) setPolicy(policy ziface.AccessPolicy) error {
+	allow, err := parseCIDRs(policy.AllowCIDRs)
+	if err != nil {
+		return err
+	}
+	deny, err := parseCIDRs(policy.DenyCIDRs)
+	if err != nil {
+		return err
+	}
+	// 复制一份，调用方之后修改自己的切片不会影响这里
+	policy.AllowCIDRs = append([]string(nil), policy.AllowCIDRs...)
+	policy.DenyCIDRs = append([]string(nil), policy.DenyCIDRs...)
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	// 原来不限制接收速率的话，令牌桶从满的开始
+	if ac.policy.AcceptRate <= 0 {
+		ac.acceptBucket = limitBucket{last: time.Now()}
+		ac.acceptBucket.msgTokens = msgBurst(ziface.RateLimit{MsgRate: policy.AcceptRate, MsgBurst: policy.AcceptBurst})
+	}
+	ac.acceptBucket.update(ziface.RateLimit{MsgRate: policy.AcceptRate, MsgBurst: policy.AcceptBurst}, 0)
+	ac.policy, ac.allow, ac.deny = policy, allow, deny
+	ac.configured = true
+	return nil
+}
+
+func (ac *accessControl) getPolicy() ziface.AccessPolicy {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	policy := ac.policy
+	policy.AllowCIDRs = append([]string(nil), policy.AllowCIDRs...)
+	policy.DenyCIDRs = append([]string(nil), policy.DenyCIDRs...)
+	return policy
+}
+
+func (ac *accessControl) isConfigured() bool {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	return ac.configured
+}
+
+// 检查来自 addr 的新连接，conns 是当前的总连接数。允许时计入该 IP 的连接数，之后要用 release 减去
+func (ac *accessControl) admit(addr net.Addr, conns int) (ziface.RejectReason, bool) {
+	ip := remoteIP(addr)
+	parsedIP := net.ParseIP(ip)
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	if parsedIP != nil {
+		if containsIP(ac.deny, parsedIP) {
+			return ziface.RejectDenied, false
+		}
+		if len(ac.allow) > 0 && !containsIP(ac.allow, parsedIP) {
+			return ziface.RejectNotAllowed, false
+		}
+	}
+	if conns >= utils.GlobalObj.MaxConn {
+		return ziface.RejectMaxConn, false
+	}
+	if ip != "" && ac.policy.MaxConnsPerIP > 0 && ac.ipConns[ip] >= ac.policy.MaxConnsPerIP {
+		return ziface.RejectMaxConnsPerIP, false
+	}
+	// 接收速率的令牌最后才取，被上面的检查拒绝的连接不占用速率的额度
+	if ac.policy.AcceptRate > 0 {
+		ac.acceptBucket.refill(time.Now())
+		if ac.acceptBucket.msgTokens < 1 {
+			return ziface.RejectAcceptRate, false
+		}
+		ac.acceptBucket.msgTokens--
+	}
+	if ip != "" {
+		ac.ipConns[ip]++
+	}
+	return 0, true
+}
+
+// 来自 addr 的连接关闭了，减去该 IP 的连接数
+func (ac *accessControl) release(addr net.Addr) {
+	ip := remoteIP(addr)
+	if ip == "" {
+		return
+	}
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	if ac.ipConns[ip]--; ac.ipConns[ip] <= 0 {
+		delete(ac.ipConns, ip)
+	}
+}
+
+// 解析网段，单个 IP 按 /32（IPv6 为 /128）处理
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查一个新连接是否可以接收，不能接收时返回拒绝的原因
+func (s *Server) admitConn(addr net.Addr) (ziface.RejectReason, bool) {
+	reason, ok := s.access.admit(addr, s.ConnMgr.Len())
+	if !ok {
+		if reason == ziface.RejectMaxConn {
+			logrus.Warnln("连接数已到达上限!!!")
+		} else {
+			logrus.Debugf("拒绝来自 %v 的连接：%v", addr, reason)
+		}
+	}
+	return reason, ok
+}
+
+// 拒绝一个连接：有 OnConnReject 的话先调用它（最多 rejectWriteTimeout），然后关闭连接
+func (s *Server) rejectConn(conn net.Conn, reason ziface.RejectReason) {
+	if s.OnConnReject != nil {
+		conn.SetDeadline(time.Now().Add(rejectWriteTimeout))
+		s.OnConnReject(conn, reason)
+	}
+	conn.Close()
+}
+
+// 给被拒绝的连接发送一个说明原因的 MSGID_ERROR 帧，可以在 OnConnReject 中使用
+func SendRejectReason(conn net.Conn, dp ziface.IDataPack, reason ziface.RejectReason) error {
+	data := []byte(reason.String())
+	buf, err := dp.Pack(&Message{
+		MsgId:  utils.MSGID_ERROR,
+		Length: uint32(len(data)),
+		Data:   data,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buf)
+	return err
+}
+
+// 设置接收连接时的访问控制策略，运行中也可以重新设置，之后接收的连接按新的策略检查
+func (s *Server) SetAccessPolicy(policy ziface.AccessPolicy) error {
+	return s.access.setPolicy(policy)
+}
+
+// 得到当前的访问控制策略
+func (s *Server) GetAccessPolicy() ziface.AccessPolicy {
+	return s.access.getPolicy()
+}
+
+// 设置拒绝连接时调用的 hook 函数
+func (s *Server) SetOnConnReject(hookFunc func(net.Conn, ziface.RejectReason)) {
+	s.OnConnReject = hookFunc
+}
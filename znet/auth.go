@@ -0,0 +1,278 @@
+package znet
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/myZinx/utils"
+	"github.com/myZinx/ziface"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+连接认证：server 设置了认证器（SetAuthenticator）时，连接建立后先发送认证器的挑战，然后只接受 MSGID_AUTH 的帧（和心跳包），
+交给认证器验证；其他消息回复 MSGID_ERROR 后丢弃。认证成功后把对端的身份保存为连接属性 PropAuthIdentity，调用 OnConnAuth，
+之后的消息才交给 router。超过 GlobalObj.AuthTimeout 秒或者前 GlobalObj.AuthMaxFrames 个帧内没有认证成功就关闭连接。
+对端发来的认证帧带序列号时（v2 的 Call），回复也带上它和回复标志，客户端用 Call 发送凭证就能直接拿到认证结果
+*/
+
+// 认证成功后保存对端身份的连接属性名，值是 string
+const PropAuthIdentity = "auth_identity"
+
+// 连接的认证状态
+const (
+	authOK      int32 = iota // 已经认证成功，或者不需要认证
+	authPending              // 正在认证
+	authFailed               // 认证失败，连接正在关闭
+)
+
+// 认证失败时等待说明原因的错误帧发出去的最长时间，超过后直接关闭连接
+const authRejectTimeout = time.Second
+
+// 是否已经认证成功
+func (c *Connection) IsAuthenticated() bool {
+	return atomic.LoadInt32(&c.authState) == authOK
+}
+
+// 设置连接使用的认证器，只在 Start 之前调用
+func (c *Connection) setAuthenticator(authenticator ziface.IAuthenticator) {
+	c.authenticator = authenticator
+	if authenticator != nil {
+		c.authState = authPending
+		c.connStarted = make(chan struct{})
+	}
+}
+
+// 开始认证的计时，在 reader 开始之前调用，reader 中认证成功时可以直接停止计时器
+func (c *Connection) startAuthTimer() {
+	if timeout := time.Duration(utils.GlobalObj.AuthTimeout) * time.Second; timeout > 0 {
+		c.authTimer = time.AfterFunc(timeout, func() {
+			c.rejectAuth(0, "authentication timeout")
+		})
+	}
+}
+
+// 发送认证器的挑战，在 reader、writer 都已经开始之后调用
+func (c *Connection) sendAuthChallenge() {
+	challenge, err := c.authenticator.Challenge(c)
+	if err != nil {
+		c.rejectAuth(0, err.Error())
+		return
+	}
+	if challenge != nil {
+		c.SendMsg(utils.MSGID_AUTH, uint32(len(challenge)), challenge)
+	}
+}
+
+// 认证成功之前处理收到的消息：认证帧交给认证器，心跳包照常处理，其他消息回复错误后丢弃。
+// 压缩过的帧在认证之前不解压，心跳包和认证帧压缩过的话也当成其他消息。返回 false 时消息已经处理完了，调用方不要再使用它
+func (c *Connection) checkAuth(msg ziface.IMessage) bool {
+	compressed := msg.HasFlag(MsgFlagCompressed)
+	if c.IsAuthenticated() || (msg.GetMsgId() == utils.MSGID_HEARTBEAT && !compressed) {
+		return true
+	}
+	defer freeMessage(msg)
+	if atomic.LoadInt32(&c.authState) != authPending {
+		return false // 认证已经失败，连接正在关闭
+	}
+	c.authFrames++
+	// 这是允许的最后一个帧的话，它没有让认证成功就不用再回复了，直接关闭连接
+	max := utils.GlobalObj.AuthMaxFrames
+	last := max > 0 && c.authFrames >= max
+	if msg.GetMsgId() == utils.MSGID_AUTH && !compressed {
+		identity, reply, done, err := c.authenticator.Verify(c, msg.GetData())
+		if err != nil {
+			c.rejectAuth(msg.GetSeqId(), "authentication failed: "+err.Error())
+			return false
+		}
+		if done {
+			c.authSucceed(msg, identity, reply)
+			return false
+		}
+		if reply != nil && !last {
+			c.replyAuth(msg, utils.MSGID_AUTH, reply)
+		}
+	} else if !last {
+		c.replyAuth(msg, utils.MSGID_ERROR, []byte("unauthenticated"))
+	}
+	if last {
+		c.rejectAuth(msg.GetSeqId(), fmt.Sprintf("not authenticated within %d frames", max))
+	}
+	return false
+}
+
+// 认证成功：保存身份，回复对端，然后调用 OnConnAuth。超时的计时器可能刚好同时认为认证失败了，以先改变状态的为准
+func (c *Connection) authSucceed(msg ziface.IMessage, identity string, reply []byte) {
+	c.SetProperty(PropAuthIdentity, identity)
+	if !atomic.CompareAndSwapInt32(&c.authState, authPending, authOK) {
+		return
+	}
+	if c.authTimer != nil {
+		c.authTimer.Stop()
+	}
+	logrus.Debugf("连接 %d 认证成功，identity = %s", c.ConnID, identity)
+	c.replyAuth(msg, utils.MSGID_AUTH, reply)
+	if c.server != nil {
+		go c.callOnConnAuth()
+	}
+}
+
+// 调用 OnConnAuth。在另外的 goroutine 中调用，不占用 reader 或反应堆的事件循环。
+// OnConnStart 是连接管理器在另外的 goroutine 中调用的，先等它调用完，保证 OnConnAuth 总是在 OnConnStart 之后
+func (c *Connection) callOnConnAuth() {
+	select {
+	case <-c.connStarted:
+	case <-c.ExitChan:
+		return
+	}
+	c.server.CallOnConnAuth(c)
+}
+
+// 连接管理器调用完 OnConnStart 之后调用
+func (c *Connection) markStarted() {
+	if c.connStarted != nil {
+		close(c.connStarted)
+	}
+}
+
+// 回复对端的一个帧，带上它的序列号和回复标志；发送队列满了就不回复了
+func (c *Connection) replyAuth(msg ziface.IMessage, msgID uint32, data []byte) {
+	reply := &Message{
+		SeqId:  msg.GetSeqId(),
+		MsgId:  msgID,
+		Length: uint32(len(data)),
+		Data:   data,
+	}
+	if msg.GetSeqId() != 0 {
+		reply.Flags = MsgFlagResponse
+	}
+	c.sendMessage(reply, ziface.OverflowDropNewest)
+}
+
+// 认证失败：把说明原因的 MSGID_ERROR 帧放进发送队列，writer 把它发出去之后关闭连接，最多等 authRejectTimeout。
+// 不直接写 socket，reader、事件循环和计时器都不会阻塞在这里
+func (c *Connection) rejectAuth(seqId uint32, reason string) {
+	if !atomic.CompareAndSwapInt32(&c.authState, authPending, authFailed) {
+		return
+	}
+	logrus.Warnf("连接 %d（%v）认证失败：%s，关闭连接", c.ConnID, c.RemoteAddr(), reason)
+	data := []byte(reason)
+	msg := &Message{
+		SeqId:  seqId,
+		MsgId:  utils.MSGID_ERROR,
+		Length: uint32(len(data)),
+		Data:   data,
+	}
+	if seqId != 0 {
+		msg.Flags = MsgFlagResponse
+	}
+	// 连接反正要关了，队列满的话丢掉最早的消息也要把原因发出去
+	if err := c.sendAndClose(msg, ziface.OverflowDropOldest, authRejectTimeout); err != nil {
+		c.Stop()
+	}
+}
+
+// 令牌认证：对端连接后发来一个 MSGID_AUTH 的帧，数据是令牌，Lookup 返回令牌对应的身份，令牌无效时返回错误
+type TokenAuthenticator struct {
+	Lookup func(token string) (identity string, err error)
+}
+
+// 用固定的令牌表创建令牌认证器，key 是令牌，value 是对应的身份
+func NewTokenAuthenticator(tokens map[string]string) *TokenAuthenticator {
+	table := make(map[string]string, len(tokens))
+	for token, identity := range tokens {
+		table[token] = identity
+	}
+	return &TokenAuthenticator{
+		Lookup: func(token string) (string, error) {
+			if identity, has := table[token]; has {
+				return identity, nil
+			}
+			return "", errors.New("invalid token")
+		},
+	}
+}
+
+// 令牌认证不需要挑战，等待对端先发来令牌
+func (a *TokenAuthenticator) Challenge(conn ziface.IConnection) ([]byte, error) {
+	return nil, nil
+}
+
+func (a *TokenAuthenticator) Verify(conn ziface.IConnection, data []byte) (string, []byte, bool, error) {
+	identity, err := a.Lookup(string(data))
+	if err != nil {
+		return "", nil, false, err
+	}
+	return identity, nil, true, nil
+}
+
+// HMAC 挑战的长度
+const hmacChallengeLen = 32
+
+// 保存发给对端的 HMAC 挑战的连接属性名，认证结束后删除
+const propAuthChallenge = "auth_challenge"
+
+// HMAC 挑战-应答认证：连接建立后 server 发送一个随机的挑战，对端回复 "身份:HMAC-SHA256(密钥, 挑战) 的十六进制"（可以用 HMACAuthResponse 构造），
+// Key 返回身份对应的密钥。密钥不会在网络上传输，截获的应答也不能用于别的连接
+type HMACAuthenticator struct {
+	Key func(identity string) ([]byte, error)
+}
+
+// 用固定的密钥表创建 HMAC 认证器，key 是身份，value 是对应的密钥
+func NewHMACAuthenticator(keys map[string][]byte) *HMACAuthenticator {
+	table := make(map[string][]byte, len(keys))
+	for identity, key := range keys {
+		table[identity] = key
+	}
+	return &HMACAuthenticator{
+		Key: func(identity string) ([]byte, error) {
+			if key, has := table[identity]; has {
+				return key, nil
+			}
+			return nil, errors.New("unknown identity")
+		},
+	}
+}
+
+func (a *HMACAuthenticator) Challenge(conn ziface.IConnection) ([]byte, error) {
+	challenge := make([]byte, hmacChallengeLen)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	conn.SetProperty(propAuthChallenge, challenge)
+	return challenge, nil
+}
+
+func (a *HMACAuthenticator) Verify(conn ziface.IConnection, data []byte) (string, []byte, bool, error) {
+	value, err := conn.GetProperty(propAuthChallenge)
+	if err != nil {
+		return "", nil, false, errors.New("no challenge")
+	}
+	conn.RemoveProperty(propAuthChallenge) // 每个挑战只能用一次
+	identity, _, found := strings.Cut(string(data), ":")
+	if !found {
+		return "", nil, false, errors.New("invalid response")
+	}
+	key, err := a.Key(identity)
+	if err != nil {
+		return "", nil, false, err
+	}
+	if !hmac.Equal(HMACAuthResponse(identity, key, value.([]byte)), data) {
+		return "", nil, false, errors.New("invalid response")
+	}
+	return identity, nil, true, nil
+}
+
+// 构造对 HMAC 挑战的应答，客户端收到 MSGID_AUTH 的挑战后用它回复
+func HMACAuthResponse(identity string, key []byte, challenge []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(challenge)
+	return []byte(identity + ":" + hex.EncodeToString(h.Sum(nil)))
+}
@@ -0,0 +1,161 @@
+package znet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/myZinx/utils"
+	"github.com/myZinx/ziface"
+)
+
+// 修改认证的全局配置，测试结束后恢复
+func setAuthLimits(t *testing.T, timeout, maxFrames int) {
+	oldTimeout, oldMaxFrames := utils.GlobalObj.AuthTimeout, utils.GlobalObj.AuthMaxFrames
+	utils.GlobalObj.AuthTimeout, utils.GlobalObj.AuthMaxFrames = timeout, maxFrames
+	t.Cleanup(func() {
+		utils.GlobalObj.AuthTimeout, utils.GlobalObj.AuthMaxFrames = oldTimeout, oldMaxFrames
+	})
+}
+
+// 创建一个使用 authenticator 的连接，MSGID_GENERAL_MSG 的请求原样回复
+func startAuthConn(t *testing.T, authenticator ziface.IAuthenticator) (*Connection, net.Conn) {
+	t.Helper()
+	return startPipeConn(t, map[uint32]ziface.IRouter{utils.MSGID_GENERAL_MSG: echoRouter()}, func(c *Connection) {
+		c.setAuthenticator(authenticator)
+	})
+}
+
+// 读一个帧，检查它的消息ID 和数据
+func expectFrame(t *testing.T, peer net.Conn, msgID uint32, data string) {
+	t.Helper()
+	msg := readFrame(t, peer, MsgVersion1)
+	if msg.GetMsgId() != msgID || string(msg.GetData()) != data {
+		t.Fatalf("got msgId = %d, data = %q; want msgId = %d, data = %q", msg.GetMsgId(), msg.GetData(), msgID, data)
+	}
+}
+
+func sendAuth(t *testing.T, peer net.Conn, data []byte) {
+	t.Helper()
+	writeFrame(t, peer, MsgVersion1, &Message{MsgId: utils.MSGID_AUTH, Data: data})
+}
+
+// 令牌正确：回复认证成功，保存身份，之后的消息交给 router；认证之前的消息回复错误，不交给 router
+func TestAuthToken(t *testing.T) {
+	setAuthLimits(t, 10, 3)
+	c, peer := startAuthConn(t, NewTokenAuthenticator(map[string]string{"secret": "alice"}))
+	writeFrame(t, peer, MsgVersion1, &Message{MsgId: utils.MSGID_GENERAL_MSG, Data: []byte("early")})
+	expectFrame(t, peer, utils.MSGID_ERROR, "unauthenticated")
+	sendAuth(t, peer, []byte("secret"))
+	expectFrame(t, peer, utils.MSGID_AUTH, "")
+	if !c.IsAuthenticated() {
+		t.Fatal("connection not authenticated")
+	}
+	if identity, err := c.GetProperty(PropAuthIdentity); err != nil || identity != "alice" {
+		t.Fatalf("identity = %v, %v", identity, err)
+	}
+	writeFrame(t, peer, MsgVersion1, &Message{MsgId: utils.MSGID_GENERAL_MSG, Data: []byte("hello")})
+	expectFrame(t, peer, utils.MSGID_GENERAL_MSG, "hello")
+}
+
+// 令牌错误：对端收到说明原因的错误帧，然后连接关闭
+func TestAuthBadToken(t *testing.T) {
+	setAuthLimits(t, 10, 3)
+	c, peer := startAuthConn(t, NewTokenAuthenticator(map[string]string{"secret": "alice"}))
+	sendAuth(t, peer, []byte("guess"))
+	expectFrame(t, peer, utils.MSGID_ERROR, "authentication failed: invalid token")
+	expectClosed(t, peer)
+	if c.IsAuthenticated() {
+		t.Fatal("connection authenticated with a bad token")
+	}
+}
+
+// 用 Call 发送凭证：失败的原因带着请求的序列号和回复标志
+func TestAuthRejectCarriesSeq(t *testing.T) {
+	setAuthLimits(t, 10, 3)
+	_, peer := startPipeConn(t, nil, func(c *Connection) {
+		c.setAuthenticator(NewTokenAuthenticator(nil))
+	})
+	writeFrame(t, peer, MsgVersion1, newFrameVersionMsg(MsgVersion2))
+	readFrame(t, peer, MsgVersion1)
+	writeFrame(t, peer, MsgVersion2, &Message{SeqId: 7, MsgId: utils.MSGID_AUTH, Data: []byte("guess")})
+	reply := readFrame(t, peer, MsgVersion2)
+	if reply.GetMsgId() != utils.MSGID_ERROR || reply.GetSeqId() != 7 || !reply.HasFlag(MsgFlagResponse) {
+		t.Fatalf("reply msgId = %d, seq = %d, flags = %d", reply.GetMsgId(), reply.GetSeqId(), reply.GetFlags())
+	}
+	if string(reply.GetData()) != "authentication failed: invalid token" {
+		t.Fatalf("reply data = %q", reply.GetData())
+	}
+	expectClosed(t, peer)
+}
+
+func TestAuthHMAC(t *testing.T) {
+	setAuthLimits(t, 10, 3)
+	keys := map[string][]byte{"alice": []byte("alice-key")}
+	// 连接后读出挑战
+	start := func(t *testing.T) (*Connection, net.Conn, []byte) {
+		c, peer := startAuthConn(t, NewHMACAuthenticator(keys))
+		challenge := readFrame(t, peer, MsgVersion1)
+		if challenge.GetMsgId() != utils.MSGID_AUTH || len(challenge.GetData()) != hmacChallengeLen {
+			t.Fatalf("challenge msgId = %d, len = %d", challenge.GetMsgId(), len(challenge.GetData()))
+		}
+		return c, peer, challenge.GetData()
+	}
+	var captured []byte
+	t.Run("ok", func(t *testing.T) {
+		c, peer, challenge := start(t)
+		captured = HMACAuthResponse("alice", keys["alice"], challenge)
+		sendAuth(t, peer, captured)
+		expectFrame(t, peer, utils.MSGID_AUTH, "")
+		if identity, _ := c.GetProperty(PropAuthIdentity); identity != "alice" {
+			t.Fatalf("identity = %v", identity)
+		}
+		writeFrame(t, peer, MsgVersion1, &Message{MsgId: utils.MSGID_GENERAL_MSG, Data: []byte("hello")})
+		expectFrame(t, peer, utils.MSGID_GENERAL_MSG, "hello")
+	})
+	// 截获的应答只对那一次的挑战有效，不能用于别的连接
+	t.Run("replay", func(t *testing.T) {
+		_, peer, _ := start(t)
+		sendAuth(t, peer, captured)
+		expectFrame(t, peer, utils.MSGID_ERROR, "authentication failed: invalid response")
+		expectClosed(t, peer)
+	})
+	t.Run("wrong key", func(t *testing.T) {
+		_, peer, challenge := start(t)
+		sendAuth(t, peer, HMACAuthResponse("alice", []byte("bad-key"), challenge))
+		expectFrame(t, peer, utils.MSGID_ERROR, "authentication failed: invalid response")
+		expectClosed(t, peer)
+	})
+	t.Run("unknown identity", func(t *testing.T) {
+		_, peer, challenge := start(t)
+		sendAuth(t, peer, HMACAuthResponse("bob", keys["alice"], challenge))
+		expectFrame(t, peer, utils.MSGID_ERROR, "authentication failed: unknown identity")
+		expectClosed(t, peer)
+	})
+}
+
+// 超时没有认证：对端收到超时的原因，然后连接关闭
+func TestAuthTimeout(t *testing.T) {
+	setAuthLimits(t, 1, 0)
+	_, peer := startAuthConn(t, NewTokenAuthenticator(nil))
+	begin := time.Now()
+	expectFrame(t, peer, utils.MSGID_ERROR, "authentication timeout")
+	expectClosed(t, peer)
+	if elapsed := time.Since(begin); elapsed < 900*time.Millisecond {
+		t.Fatalf("connection closed after %v, want about 1s", elapsed)
+	}
+}
+
+// 前 AuthMaxFrames 个帧内没有认证成功：最后一个帧不再回复 unauthenticated，直接说明原因后关闭连接
+func TestAuthMaxFrames(t *testing.T) {
+	setAuthLimits(t, 10, 2)
+	_, peer := startAuthConn(t, NewTokenAuthenticator(nil))
+	// 心跳包不算在内
+	writeFrame(t, peer, MsgVersion1, &Message{MsgId: utils.MSGID_HEARTBEAT})
+	for i := 0; i < 2; i++ {
+		writeFrame(t, peer, MsgVersion1, &Message{MsgId: utils.MSGID_GENERAL_MSG, Data: []byte("early")})
+	}
+	expectFrame(t, peer, utils.MSGID_ERROR, "unauthenticated")
+	expectFrame(t, peer, utils.MSGID_ERROR, "not authenticated within 2 frames")
+	expectClosed(t, peer)
+}
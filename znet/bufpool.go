@@ -0,0 +1,77 @@
+package znet
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/*
+按大小分级的字节切片池。封包时从这里取缓冲，writer 把数据写入 socket 之后再还回来，
+避免每发一条消息都分配一次内存（文件传输时每条消息有 32KB）
+*/
+
+// 各级缓冲的大小，超过最大一级的直接分配，不放回池中
+var bufSizeClasses = [...]int{512, 4 << 10, 64 << 10}
+
+var bufPools [len(bufSizeClasses)]sync.Pool
+
+func init() {
+	for i := range bufPools {
+		size := bufSizeClasses[i]
+		bufPools[i].New = func() any {
+			buf := make([]byte, size)
+			return &buf
+		}
+	}
+}
+
+// 得到一个长度为 size 的缓冲，内容是旧的数据，需要调用方全部覆盖
+func getBuffer(size int) []byte {
+	for i, classSize := range bufSizeClasses {
+		if size <= classSize {
+			buf := bufPools[i].Get().(*[]byte)
+			return (*buf)[:size]
+		}
+	}
+	return make([]byte, size)
+}
+
+// 把 getBuffer 得到的缓冲还回池中，之后不能再使用它。容量不是某一级大小的缓冲（不是从池中取的）会被忽略
+func putBuffer(buf []byte) {
+	for i, classSize := range bufSizeClasses {
+		if cap(buf) == classSize {
+			buf = buf[:classSize]
+			bufPools[i].Put(&buf)
+			return
+		}
+	}
+}
+
+// 多个连接共用的封包缓冲（广播时同样的帧只封包一次），每个连接的 writer 写完后减少引用，最后一个用完的还回缓冲池。
+// 没有写出去就被丢弃的连接也许不会减少引用，这时缓冲只是不再回到池中，由 GC 回收
+type sharedBuffer struct {
+	data []byte
+	refs int32
+}
+
+func (s *sharedBuffer) release() {
+	if atomic.AddInt32(&s.refs, -1) == 0 {
+		putBuffer(s.data)
+	}
+}
+
+// 发送队列中的一个帧。shared 不为 nil 时 data 是多个连接共用的缓冲；closeAfter 为 true 时 writer 写完它就关闭连接
+type queuedFrame struct {
+	data       []byte
+	shared     *sharedBuffer
+	closeAfter bool
+}
+
+// 帧写出去或者被丢弃后调用，pool 为 false 时缓冲不是来自缓冲池（自定义的封包模块），什么都不做
+func (f queuedFrame) release(pool bool) {
+	if f.shared != nil {
+		f.shared.release()
+	} else if pool {
+		putBuffer(f.data)
+	}
+}
@@ -0,0 +1,129 @@
+package znet
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/myZinx/utils"
+	"github.com/myZinx/ziface"
+)
+
+// 等待回复的调用表。每次 Call 分配一个序列号并登记一个等待通道，
+// 收到带 MsgFlagResponse 标志的回复后按序列号把它交给对应的 Call。server 端的连接和客户端都可以使用
+type CallTable struct {
+	seq     uint32                          // 上一次分配的序列号
+	pending map[uint32]chan ziface.IMessage // 正在等待回复的调用，key 是序列号
+	closed  error                           // 不为 nil 表示调用表已关闭（连接已断开），之后的 Call 都直接返回这个错误
+	lock    sync.Mutex                      // 保护上面的成员
+}
+
+var ErrCallTableClosed = errors.New("call table is closed, connection may be stopped")
+
+func NewCallTable() *CallTable {
+	return &CallTable{
+		pending: make(map[uint32]chan ziface.IMessage),
+	}
+}
+
+// 发起一次调用：分配序列号，调用 send 把带该序列号的请求发出去，然后等待回复并返回回复的数据。
+// ctx 没有设置超时时间时使用 GlobalObj.CallTimeout，ctx 被取消或超时时返回 ctx 的错误；对端回复 MSGID_ERROR 时返回其中的错误信息
+func (t *CallTable) Call(ctx context.Context, send func(seqId uint32) error) ([]byte, error) {
+	if _, has := ctx.Deadline(); !has && utils.GlobalObj.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(utils.GlobalObj.CallTimeout)*time.Second)
+		defer cancel()
+	}
+	msg, err := t.wait(ctx, send)
+	if err != nil {
+		return nil, err
+	}
+	if msg.GetMsgId() == utils.MSGID_ERROR {
+		return nil, errors.New(string(msg.GetData()))
+	}
+	return msg.GetData(), nil
+}
+
+// 登记一个等待通道并发出请求，等待回复的消息
+func (t *CallTable) wait(ctx context.Context, send func(seqId uint32) error) (ziface.IMessage, error) {
+	t.lock.Lock()
+	if t.closed != nil {
+		t.lock.Unlock()
+		return nil, t.closed
+	}
+	t.seq++
+	if t.seq == 0 { // 序列号 0 表示没有序列号，跳过
+		t.seq++
+	}
+	seqId := t.seq
+	respChan := make(chan ziface.IMessage, 1) // 带一个缓冲，Deliver 不会阻塞
+	t.pending[seqId] = respChan
+	t.lock.Unlock()
+	defer t.remove(seqId)
+
+	if err := send(seqId); err != nil {
+		return nil, err
+	}
+	select {
+	case msg, ok := <-respChan:
+		if !ok { // 调用表被关闭
+			return nil, t.closedErr()
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 把收到的回复交给等待它的调用，没有调用在等待这个序列号（比如已经超时）时返回 false，由调用方按普通消息处理
+func (t *CallTable) Deliver(msg ziface.IMessage) bool {
+	if !msg.HasFlag(MsgFlagResponse) || msg.GetSeqId() == 0 {
+		return false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	respChan, has := t.pending[msg.GetSeqId()]
+	if !has {
+		return false
+	}
+	delete(t.pending, msg.GetSeqId())
+	respChan <- msg
+	return true
+}
+
+// 关闭调用表，所有正在等待的调用都会立即返回错误
+func (t *CallTable) Close(err error) {
+	if err == nil {
+		err = ErrCallTableClosed
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed != nil {
+		return
+	}
+	t.closed = err
+	for seqId, respChan := range t.pending {
+		close(respChan)
+		delete(t.pending, seqId)
+	}
+}
+
+// 正在等待回复的调用数
+func (t *CallTable) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.pending)
+}
+
+func (t *CallTable) remove(seqId uint32) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.pending, seqId)
+}
+
+func (t *CallTable) closedErr() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closed
+}
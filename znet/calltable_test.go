@@ -0,0 +1,165 @@
+package znet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/myZinx/utils"
+	"github.com/myZinx/ziface"
+)
+
+// 发出请求时把序列号交给测试的 send
+func recordSeq(seqs chan<- uint32) func(uint32) error {
+	return func(seqId uint32) error {
+		seqs <- seqId
+		return nil
+	}
+}
+
+func TestCallTableDeliver(t *testing.T) {
+	table := NewCallTable()
+	seqs := make(chan uint32, 2)
+	go func() {
+		seq := <-seqs
+		table.Deliver(&Message{Flags: MsgFlagResponse, SeqId: seq, MsgId: utils.MSGID_PING, Data: []byte("pong")})
+		seq = <-seqs
+		table.Deliver(&Message{Flags: MsgFlagResponse, SeqId: seq, MsgId: utils.MSGID_ERROR, Data: []byte("bad request")})
+	}()
+	data, err := table.Call(context.Background(), recordSeq(seqs))
+	if err != nil || string(data) != "pong" {
+		t.Fatalf("Call = %q, %v", data, err)
+	}
+	if _, err := table.Call(context.Background(), recordSeq(seqs)); err == nil || err.Error() != "bad request" {
+		t.Fatalf("Call answered by MSGID_ERROR: err = %v", err)
+	}
+	// 没有回复标志或者没有序列号的帧是普通的消息，不交给 Call
+	if table.Deliver(&Message{SeqId: 1}) || table.Deliver(&Message{Flags: MsgFlagResponse}) {
+		t.Fatal("Deliver took a frame that is not a response")
+	}
+}
+
+// 超时的 Call 返回 ctx 的错误并从调用表中删除，之后才到的回复不再交给任何 Call
+func TestCallTableTimeout(t *testing.T) {
+	table := NewCallTable()
+	seqs := make(chan uint32, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := table.Call(ctx, recordSeq(seqs)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Call err = %v, want DeadlineExceeded", err)
+	}
+	if n := table.Len(); n != 0 {
+		t.Fatalf("%d calls still pending after timeout", n)
+	}
+	if table.Deliver(&Message{Flags: MsgFlagResponse, SeqId: <-seqs}) {
+		t.Fatal("late response was delivered")
+	}
+}
+
+// 发送失败时直接返回发送的错误，不会一直等下去
+func TestCallTableSendError(t *testing.T) {
+	table := NewCallTable()
+	sendErr := errors.New("send failed")
+	if _, err := table.Call(context.Background(), func(uint32) error { return sendErr }); err != sendErr {
+		t.Fatalf("Call err = %v, want the send error", err)
+	}
+	if n := table.Len(); n != 0 {
+		t.Fatalf("%d calls still pending after send error", n)
+	}
+}
+
+// 关闭调用表时正在等待的 Call 立即返回关闭的原因，之后的 Call 不再发送
+func TestCallTableClose(t *testing.T) {
+	table := NewCallTable()
+	seqs := make(chan uint32, 1)
+	closeErr := errors.New("connection closed")
+	done := make(chan error, 1)
+	go func() {
+		_, err := table.Call(context.Background(), recordSeq(seqs))
+		done <- err
+	}()
+	<-seqs
+	table.Close(closeErr)
+	select {
+	case err := <-done:
+		if err != closeErr {
+			t.Fatalf("pending Call err = %v, want %v", err, closeErr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pending Call did not return after Close")
+	}
+	sent := false
+	if _, err := table.Call(context.Background(), func(uint32) error { sent = true; return nil }); err != closeErr || sent {
+		t.Fatalf("Call after Close: err = %v, sent = %v", err, sent)
+	}
+}
+
+// 在连接上：Call 超时后对端才回复，回复被当成孤儿丢弃，不交给 router（否则 PING 的 router 会再回复它，两端来回不停）
+func TestConnCallLateResponse(t *testing.T) {
+	routed := make(chan string, 2)
+	recorder := &testRouter{f: func(req ziface.IRequest) { routed <- string(req.GetData()) }}
+	c, peer := startV2PipeConn(t, map[uint32]ziface.IRouter{utils.MSGID_PING: recorder})
+	errChan := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := c.Call(ctx, utils.MSGID_PING, []byte("ping"))
+		errChan <- err
+	}()
+	req := readFrame(t, peer, MsgVersion2)
+	if err := <-errChan; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Call err = %v, want DeadlineExceeded", err)
+	}
+	if n := c.calls.Len(); n != 0 {
+		t.Fatalf("%d calls still pending after timeout", n)
+	}
+	writeFrame(t, peer, MsgVersion2, &Message{Flags: MsgFlagResponse, SeqId: req.GetSeqId(), MsgId: utils.MSGID_PING, Data: []byte("late")})
+	// 再发一个普通的请求：同一个连接的消息按顺序处理，router 收到的第一个就应该是它
+	writeFrame(t, peer, MsgVersion2, &Message{MsgId: utils.MSGID_PING, Data: []byte("normal")})
+	select {
+	case data := <-routed:
+		if data != "normal" {
+			t.Fatalf("router got %q, want only the normal request", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("normal request was not handled")
+	}
+}
+
+// 在连接上：连接关闭时正在等待的 Call 立即返回错误
+func TestConnCallFailsOnClose(t *testing.T) {
+	c, peer := startV2PipeConn(t, nil)
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := c.Call(context.Background(), utils.MSGID_PING, nil)
+		errChan <- err
+	}()
+	readFrame(t, peer, MsgVersion2)
+	c.Stop()
+	select {
+	case err := <-errChan:
+		if err == nil {
+			t.Fatal("Call succeeded on a closed connection")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Call did not return after the connection was closed")
+	}
+	if _, err := c.Call(context.Background(), utils.MSGID_PING, nil); err == nil {
+		t.Fatal("Call after Stop succeeded")
+	}
+}
+
+// 创建一个已经协商好 v2 的连接，对端同意了本端的协商帧
+func startV2PipeConn(t *testing.T, routers map[uint32]ziface.IRouter) (*Connection, net.Conn) {
+	t.Helper()
+	c, peer := startPipeConn(t, routers, func(c *Connection) {
+		c.SetFrameVersion(MsgVersion2)
+	})
+	if offer := readFrame(t, peer, MsgVersion1); offer.GetMsgId() != utils.MSGID_FRAME_VERSION {
+		t.Fatalf("first frame msgId = %d, want the frame version offer", offer.GetMsgId())
+	}
+	writeFrame(t, peer, MsgVersion1, newFrameVersionMsg(MsgVersion2))
+	return c, peer
+}
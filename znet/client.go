@@ -0,0 +1,288 @@
+package znet
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/myZinx/utils"
+	"github.com/myZinx/ziface"
+	"github.com/sirupsen/logrus"
+)
+
+// IClient的接口实现。客户端的连接就是 Connection，所以 router、中间件、工作池、心跳检测器、连接属性和 Call 都与server 端一样
+type Client struct {
+	Name       string
+	IPVersion  string                 // 连接使用的网络，"tcp4"、"tcp"、"tcp6" 或 "unix"
+	IP         string                 // 要连接的server 的IP
+	Port       int                    // 要连接的server 的端口
+	UnixPath   string                 // IPVersion 为 "unix" 时要连接的 socket 路径
+	MsgHandler ziface.IMessageHandler // 客户端注册的处理server 消息的router
+	DataPack   ziface.IDataPack       // 客户端使用的封包拆包模块，需要与server 一致
+	TLSConfig  *tls.Config            // 不为 nil 时使用 TLS 连接server
+	// 连接建立之后自动调用 hook 函数（每次重连成功都会调用）
+	OnConnStart func(ziface.IConnection)
+	// 连接断开之后自动调用 hook 函数
+	OnConnStop func(ziface.IConnection)
+	// 是否开启连接的心跳检测器
+	UseHeartBeat bool
+	// 连接断开后是否自动重连
+	AutoReconnect bool
+	// 客户端连接使用的帧格式版本，默认 v2，这样一连上就可以使用 Call
+	FrameVersion uint8
+	// 不压缩的消息ID，默认是 GlobalObj.CompressSkipMsgIDs，需要在 Start 之前设置
+	CompressSkipMsgIDs []uint32
+
+	conn     *Connection  // 当前的连接，断线重连中时为 nil
+	connLock sync.RWMutex // 保护 conn
+	cId      uint32       // 每次连接成功分配一个新的连接ID
+	// Start 时由 CompressSkipMsgIDs 生成的集合，之后只读
+	compressSkip map[uint32]struct{}
+
+	exitChan chan bool // Stop 完成后关闭此通道，Serve 随之返回
+	stopOnce sync.Once // 保证 Stop 只执行一次
+
+	ctx    context.Context    // 客户端的上下文，连接的上下文都从这里派生
+	cancel context.CancelFunc // Stop 时调用
+}
+
+// 初始化 Client 模块，ip 和 port 是要连接的server 的地址
+func NewClient(name string, ip string, port int) *Client {
+	c := &Client{
+		Name:               name,
+		IPVersion:          "tcp4",
+		IP:                 ip,
+		Port:               port,
+		UnixPath:           utils.GlobalObj.UnixSocketPath,
+		MsgHandler:         NewMessageHandler(),
+		DataPack:           NewDataPack(),
+		OnConnStart:        func(ziface.IConnection) {},
+		OnConnStop:         func(ziface.IConnection) {},
+		UseHeartBeat:       true,
+		AutoReconnect:      true,
+		FrameVersion:       MsgVersion2,
+		exitChan:           make(chan bool),
+		CompressSkipMsgIDs: append([]uint32(nil), utils.GlobalObj.CompressSkipMsgIDs...),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	// 客户端默认的router，其他的由开发者自己添加
+	if c.UseHeartBeat {
+		c.AddRouter(utils.MSGID_HEARTBEAT, &HeartbeatDefaultRouter{})
+	}
+	c.AddRouter(utils.MSGID_GENERAL_MSG, &GeneralMsgRouter{})
+	c.AddRouter(utils.MSGID_ERROR, &ErrorMsgRouter{})
+	return c
+}
+
+// 连接server，第一次连接失败时返回错误。连接成功后在另外的goroutine 中等待连接断开，断开后按退避时间自动重连
+func (c *Client) Start() error {
+	if err := utils.GlobalObj.Check(); err != nil {
+		return err
+	}
+	c.compressSkip = newMsgIDSet(c.CompressSkipMsgIDs)
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	c.MsgHandler.StartWorkerPool() // 开启消息处理的工作池
+	c.startConn(conn)
+	go c.keepAlive()
+	return nil
+}
+
+// 关闭客户端，关闭当前连接并不再重连
+func (c *Client) Stop() {
+	c.stopOnce.Do(func() {
+		logrus.Infof("[client] %s stopping ...", c.Name)
+		c.cancel()
+		if conn := c.getConn(); conn != nil {
+			conn.Stop()
+		}
+		c.MsgHandler.StopWorkerPool()
+		close(c.exitChan)
+	})
+}
+
+// 运行客户端，阻塞直到客户端被 Stop，第一次连接失败时返回错误
+func (c *Client) Serve() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	<-c.exitChan
+	return nil
+}
+
+// 路由功能：给客户端注册一个路由，处理server 发来的消息
+func (c *Client) AddRouter(msgID uint32, router ziface.IRouter) {
+	c.MsgHandler.AddRouter(msgID, router)
+}
+
+// 添加全局的中间件
+func (c *Client) Use(middlewares ...ziface.MiddlewareFunc) {
+	c.MsgHandler.Use(middlewares...)
+}
+
+// 添加只对某个消息ID 生效的中间件
+func (c *Client) UseFor(msgID uint32, middlewares ...ziface.MiddlewareFunc) {
+	c.MsgHandler.UseFor(msgID, middlewares...)
+}
+
+// 设置客户端使用的封包拆包模块，需要在 Start 之前设置
+func (c *Client) SetDataPack(dp ziface.IDataPack) {
+	c.DataPack = dp
+}
+
+// 设置客户端使用的 TLS 配置，需要在 Start 之前设置。server 开启了双向认证时需要在 Certificates 中带上客户端证书
+func (c *Client) SetTLSConfig(config *tls.Config) {
+	c.TLSConfig = config
+}
+
+// 得到当前的连接，尚未连接或者断线重连中时返回 nil
+func (c *Client) GetConnection() ziface.IConnection {
+	if conn := c.getConn(); conn != nil {
+		return conn
+	}
+	return nil // 不能直接返回值为 nil 的 *Connection，否则接口不等于 nil
+}
+
+// 设置连接建立之后自动调用 hook 函数
+func (c *Client) SetOnConnStart(hookFunc func(ziface.IConnection)) {
+	c.OnConnStart = hookFunc
+}
+
+// 设置连接断开之后自动调用 hook 函数
+func (c *Client) SetOnConnStop(hookFunc func(ziface.IConnection)) {
+	c.OnConnStop = hookFunc
+}
+
+// 得到客户端的上下文
+func (c *Client) Context() context.Context {
+	return c.ctx
+}
+
+// 通过当前连接发送数据，断线重连中时返回错误
+func (c *Client) SendMsg(msgID uint32, length uint32, data []byte) error {
+	conn := c.getConn()
+	if conn == nil {
+		return errors.New("client is not connected")
+	}
+	return conn.SendMsg(msgID, length, data)
+}
+
+// 通过当前连接向server 发起一次请求并等待它的回复，断线重连中时返回错误
+func (c *Client) Call(ctx context.Context, msgID uint32, data []byte) ([]byte, error) {
+	conn := c.getConn()
+	if conn == nil {
+		return nil, errors.New("client is not connected")
+	}
+	return conn.Call(ctx, msgID, data)
+}
+
+// 连接server
+func (c *Client) dial() (net.Conn, error) {
+	address := net.JoinHostPort(c.IP, strconv.Itoa(c.Port))
+	if c.IPVersion == "unix" {
+		address = c.UnixPath
+	}
+	if c.TLSConfig != nil {
+		dialer := &net.Dialer{Timeout: time.Duration(utils.GlobalObj.TLSHandshakeTimeout) * time.Second}
+		return tls.DialWithDialer(dialer, c.IPVersion, address, c.TLSConfig)
+	}
+	return net.Dial(c.IPVersion, address)
+}
+
+// 把新建立的 socket 包装成 Connection 并启动
+func (c *Client) startConn(netConn net.Conn) {
+	c.cId++
+	// 客户端只有一个连接，不需要连接管理器
+	conn := NewConnection(netConn, c.cId, c.MsgHandler, nil)
+	conn.SetDataPack(c.DataPack)
+	conn.SetFrameVersion(c.FrameVersion)
+	conn.setParentContext(c.ctx)
+	conn.compressSkip = c.compressSkip
+	if c.UseHeartBeat {
+		bindRandomHeartBeatChecker(conn)
+	}
+	c.connLock.Lock()
+	c.conn = conn
+	c.connLock.Unlock()
+	conn.Start()
+	// 只有 v2 的帧能标记压缩过的数据，用 v1 的客户端不压缩
+	if c.FrameVersion == MsgVersion2 && len(utils.GlobalObj.Compression) > 0 {
+		conn.offerCompression()
+	}
+	logrus.Infof("[client] %s connected to %s %s, connection id = %d", c.Name, c.IPVersion, netConn.RemoteAddr(), conn.GetConnID())
+	if c.OnConnStart != nil {
+		c.OnConnStart(conn)
+	}
+}
+
+// 等待当前连接断开，调用 OnConnStop；如果开启了自动重连，就按退避时间不断重连直到成功或者客户端被 Stop
+func (c *Client) keepAlive() {
+	for {
+		conn := c.getConn()
+		<-conn.Context().Done() // 连接关闭或者客户端 Stop 都会取消连接的上下文
+		conn.Stop()             // 客户端 Stop 时连接可能还没关闭
+		c.connLock.Lock()
+		c.conn = nil
+		c.connLock.Unlock()
+		if c.OnConnStop != nil {
+			c.OnConnStop(conn)
+		}
+		if !c.AutoReconnect {
+			c.Stop()
+			return
+		}
+		netConn, ok := c.redial()
+		if !ok { // 客户端已经 Stop
+			return
+		}
+		c.startConn(netConn)
+	}
+}
+
+// 重连的最短退避时间，ClientReconnectMinInterval 为 0 时也至少等这么久，退避时间才能翻倍，不会不停地重连
+const minReconnectBackoff = 100 * time.Millisecond
+
+// 按指数退避不断重连，直到成功；客户端被 Stop 时返回 false
+func (c *Client) redial() (net.Conn, bool) {
+	backoff := time.Duration(utils.GlobalObj.ClientReconnectMinInterval) * time.Second
+	if backoff < minReconnectBackoff {
+		backoff = minReconnectBackoff
+	}
+	maxBackoff := time.Duration(utils.GlobalObj.ClientReconnectMaxInterval) * time.Second
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	for {
+		// 加上一点随机时间，避免大量客户端在server 重启后同时重连
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		logrus.Infof("[client] %s reconnect after %v", c.Name, wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-c.ctx.Done():
+			timer.Stop()
+			return nil, false
+		}
+		netConn, err := c.dial()
+		if err == nil {
+			return netConn, true
+		}
+		logrus.Warnf("[client] %s reconnect err: %v", c.Name, err)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (c *Client) getConn() *Connection {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.conn
+}
@@ -0,0 +1,313 @@
+package znet
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/myZinx/utils"
+	"github.com/myZinx/ziface"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+消息的压缩：GlobalObj.Compression 不为空时，客户端连接后发一个 MSGID_COMPRESSION 的帧，数据是它支持的压缩算法；
+server 从 GlobalObj.Compression 中按顺序选出第一个对方也支持的，回复给客户端，之后双方都用它压缩发送的消息。
+只有 v2 的帧能带标志位，所以只压缩 v2 的帧：数据达到 GlobalObj.CompressThreshold 字节、消息ID 不在 server（或客户端）的 CompressSkipMsgIDs 中时，
+压缩后的数据是 "压缩算法（1 字节）+ 压缩的数据"，并设置 MsgFlagCompressed；压缩后没有变小就照原样发送。
+收到的帧带 MsgFlagCompressed 时，不管协商的是什么，只要是认识的压缩算法都会先解压，再交给 router
+*/
+
+var (
+	errIncompressible   = errors.New("data is incompressible")
+	errUnknownCodec     = errors.New("unknown compression codec")
+	errDecompressedSize = errors.New("decompressed data is too large")
+)
+
+// 压缩的统计数据，用原子操作
+type compressCounters struct {
+	compressedFrames   uint64
+	skippedFrames      uint64
+	rawBytes           uint64
+	compressedBytes    uint64
+	decompressedFrames uint64
+}
+
+func (cc *compressCounters) stats() ziface.CompressionStats {
+	return ziface.CompressionStats{
+		CompressedFrames:   atomic.LoadUint64(&cc.compressedFrames),
+		SkippedFrames:      atomic.LoadUint64(&cc.skippedFrames),
+		RawBytes:           atomic.LoadUint64(&cc.rawBytes),
+		CompressedBytes:    atomic.LoadUint64(&cc.compressedBytes),
+		DecompressedFrames: atomic.LoadUint64(&cc.decompressedFrames),
+	}
+}
+
+// flate 和 gzip 的压缩器创建时要分配几百 KB 的内存，用池复用。压缩级别在创建时确定，GlobalObj.CompressLevel 需要在开始前设置
+var (
+	flateWriterPool = sync.Pool{New: func() any {
+		w, err := flate.NewWriter(nil, utils.GlobalObj.CompressLevel)
+		if err != nil { // 压缩级别不对，使用默认的
+			w, _ = flate.NewWriter(nil, flate.DefaultCompression)
+		}
+		return w
+	}}
+	gzipWriterPool = sync.Pool{New: func() any {
+		w, err := gzip.NewWriterLevel(nil, utils.GlobalObj.CompressLevel)
+		if err != nil {
+			w = gzip.NewWriter(nil)
+		}
+		return w
+	}}
+	flateReaderPool sync.Pool
+	gzipReaderPool  sync.Pool
+)
+
+// 写到 buf 后面，超过 limit 时返回 errIncompressible，压缩的结果已经不比原数据小了，不用再压下去
+type limitedAppender struct {
+	buf   []byte
+	limit int
+}
+
+func (w *limitedAppender) Write(p []byte) (int, error) {
+	if len(w.buf)+len(p) >= w.limit {
+		return 0, errIncompressible
+	}
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+// 压缩 data，返回 "压缩算法 + 压缩的数据"，缓冲来自缓冲池；压缩后没有变小时返回 nil
+func compressData(codec ziface.CompressionCodec, data []byte) []byte {
+	buf := append(getBuffer(len(data))[:0], byte(codec))
+	switch codec {
+	case ziface.CompressSnappy:
+		buf = snappyEncode(buf, data)
+	case ziface.CompressFlate:
+		w := &limitedAppender{buf: buf, limit: len(data)}
+		fw := flateWriterPool.Get().(*flate.Writer)
+		fw.Reset(w)
+		_, err := fw.Write(data)
+		if err == nil {
+			err = fw.Close()
+		}
+		flateWriterPool.Put(fw)
+		if err != nil {
+			putBuffer(buf)
+			return nil
+		}
+		buf = w.buf
+	case ziface.CompressGzip:
+		w := &limitedAppender{buf: buf, limit: len(data)}
+		gw := gzipWriterPool.Get().(*gzip.Writer)
+		gw.Reset(w)
+		_, err := gw.Write(data)
+		if err == nil {
+			err = gw.Close()
+		}
+		gzipWriterPool.Put(gw)
+		if err != nil {
+			putBuffer(buf)
+			return nil
+		}
+		buf = w.buf
+	default:
+		putBuffer(buf)
+		return nil
+	}
+	if len(buf) >= len(data) {
+		putBuffer(buf)
+		return nil
+	}
+	return buf
+}
+
+// 解压 compressData 的结果，解压后超过 maxSize 字节时返回错误（防止很小的帧解压出巨大的数据）
+func decompressData(data []byte, maxSize int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errUnknownCodec
+	}
+	codec, payload := ziface.CompressionCodec(data[0]), data[1:]
+	var r io.Reader
+	switch codec {
+	case ziface.CompressSnappy:
+		n, headLen, err := snappyDecodedLen(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n > maxSize {
+			return nil, errDecompressedSize
+		}
+		buf := getBuffer(n)
+		if err := snappyDecode(buf, payload[headLen:]); err != nil {
+			putBuffer(buf)
+			return nil, err
+		}
+		return buf, nil
+	case ziface.CompressFlate:
+		fr, _ := flateReaderPool.Get().(io.ReadCloser)
+		if fr == nil {
+			fr = flate.NewReader(bytes.NewReader(payload))
+		} else {
+			fr.(flate.Resetter).Reset(bytes.NewReader(payload), nil)
+		}
+		defer flateReaderPool.Put(fr)
+		r = fr
+	case ziface.CompressGzip:
+		gr, _ := gzipReaderPool.Get().(*gzip.Reader)
+		if gr == nil {
+			gr = new(gzip.Reader)
+		}
+		if err := gr.Reset(bytes.NewReader(payload)); err != nil {
+			return nil, err
+		}
+		defer gzipReaderPool.Put(gr)
+		r = gr
+	default:
+		return nil, errUnknownCodec
+	}
+	buf, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > maxSize {
+		return nil, errDecompressedSize
+	}
+	return buf, nil
+}
+
+// 是否支持这个压缩算法
+func validCodec(codec ziface.CompressionCodec) bool {
+	return codec == ziface.CompressFlate || codec == ziface.CompressGzip || codec == ziface.CompressSnappy
+}
+
+// 把不压缩的消息ID 复制成集合，发送时不用再读 GlobalObj，运行中修改配置也不会与发送的 goroutine 冲突
+func newMsgIDSet(msgIDs []uint32) map[uint32]struct{} {
+	set := make(map[uint32]struct{}, len(msgIDs))
+	for _, id := range msgIDs {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+// 按连接协商出的压缩算法压缩要发送的消息，不需要压缩时原样返回；压缩了的话返回新的消息，第二个返回值是它的数据，封包后要还回缓冲池
+func (c *Connection) compressMessage(msg ziface.IMessage) (ziface.IMessage, []byte) {
+	return c.compressMessageWith(msg, ziface.CompressionCodec(atomic.LoadUint32(&c.sendCodec)))
+}
+
+// 用指定的压缩算法压缩要发送的消息，广播时调用方已经按连接的压缩算法分好了组
+func (c *Connection) compressMessageWith(msg ziface.IMessage, codec ziface.CompressionCodec) (ziface.IMessage, []byte) {
+	data := msg.GetData()
+	// 认证帧不压缩，对端在认证成功之前不会解压
+	if codec == ziface.CompressNone || msg.GetVersion() != MsgVersion2 || msg.HasFlag(MsgFlagCompressed) ||
+		msg.GetMsgId() == utils.MSGID_AUTH || len(data) == 0 || len(data) < utils.GlobalObj.CompressThreshold {
+		return msg, nil
+	}
+	var compressed []byte
+	if _, skip := c.compressSkip[msg.GetMsgId()]; !skip {
+		compressed = compressData(codec, data)
+	}
+	if compressed == nil {
+		c.addCompressStats(func(cc *compressCounters) { atomic.AddUint64(&cc.skippedFrames, 1) })
+		return msg, nil
+	}
+	c.addCompressStats(func(cc *compressCounters) {
+		atomic.AddUint64(&cc.compressedFrames, 1)
+		atomic.AddUint64(&cc.rawBytes, uint64(len(data)))
+		atomic.AddUint64(&cc.compressedBytes, uint64(len(compressed)))
+	})
+	return &Message{
+		Version: msg.GetVersion(),
+		Flags:   msg.GetFlags() | MsgFlagCompressed,
+		SeqId:   msg.GetSeqId(),
+		MsgId:   msg.GetMsgId(),
+		Length:  uint32(len(compressed)),
+		Data:    compressed,
+	}, compressed
+}
+
+// 解压收到的消息，出错时返回 false
+func (c *Connection) decompressMessage(msg ziface.IMessage) bool {
+	data, err := decompressData(msg.GetData(), int(utils.GlobalObj.MaxFilePackageSize))
+	if err != nil {
+		logrus.Warnf("连接 %d 解压消息 %d 出错，err = %v", c.ConnID, msg.GetMsgId(), err)
+		return false
+	}
+	if m, ok := msg.(*Message); ok {
+		if m.pooled {
+			putBuffer(m.Data)
+		}
+		m.Length = uint32(len(data))
+	}
+	msg.SetBodyContent(data)
+	msg.SetFlags(msg.GetFlags() &^ MsgFlagCompressed)
+	c.addCompressStats(func(cc *compressCounters) { atomic.AddUint64(&cc.decompressedFrames, 1) })
+	return true
+}
+
+// 同时更新连接自己的和 server 所有连接一起的统计数据
+func (c *Connection) addCompressStats(f func(*compressCounters)) {
+	f(&c.compressStats)
+	if c.compressTotal != nil {
+		f(c.compressTotal)
+	}
+}
+
+// 得到该连接压缩的统计数据
+func (c *Connection) GetCompressionStats() ziface.CompressionStats {
+	stats := c.compressStats.stats()
+	stats.Codec = ziface.CompressionCodec(atomic.LoadUint32(&c.sendCodec))
+	return stats
+}
+
+// 向对端提出压缩：把本端支持的压缩算法发过去，对端回复选中的算法后才开始压缩。客户端的连接开始后调用
+func (c *Connection) offerCompression() error {
+	codecs := make([]byte, 0, len(utils.GlobalObj.Compression))
+	for _, codec := range utils.GlobalObj.Compression {
+		if validCodec(codec) {
+			codecs = append(codecs, byte(codec))
+		}
+	}
+	if len(codecs) == 0 {
+		return nil
+	}
+	return c.SendMsg(utils.MSGID_COMPRESSION, uint32(len(codecs)), codecs)
+}
+
+// 处理 MSGID_COMPRESSION 的帧：对端的提议按本端的优先顺序选出一个双方都支持的并回复；对端的回复就是它选中的压缩算法
+func (c *Connection) negotiateCompression(msg ziface.IMessage) {
+	data := msg.GetData()
+	if msg.HasFlag(MsgFlagResponse) {
+		if len(data) > 0 && validCodec(ziface.CompressionCodec(data[0])) {
+			atomic.StoreUint32(&c.sendCodec, uint32(data[0]))
+			logrus.Debugf("连接 %d 协商压缩算法为 %v", c.ConnID, ziface.CompressionCodec(data[0]))
+		}
+		return
+	}
+	chosen := ziface.CompressNone
+	for _, codec := range utils.GlobalObj.Compression {
+		if validCodec(codec) && bytes.IndexByte(data, byte(codec)) >= 0 {
+			chosen = codec
+			break
+		}
+	}
+	atomic.StoreUint32(&c.sendCodec, uint32(chosen))
+	logrus.Debugf("连接 %d 协商压缩算法为 %v", c.ConnID, chosen)
+	reply := []byte{byte(chosen)}
+	c.sendMessage(&Message{
+		Flags:  MsgFlagResponse,
+		SeqId:  msg.GetSeqId(),
+		MsgId:  utils.MSGID_COMPRESSION,
+		Length: uint32(len(reply)),
+		Data:   reply,
+	}, ziface.OverflowDropNewest)
+}
+
+// 得到所有连接一起的压缩统计
+func (s *Server) GetCompressionStats() ziface.CompressionStats {
+	return s.compressTotal.stats()
+}
@@ -1,35 +1,121 @@
 package znet
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/myZinx/utils"
 	"github.com/myZinx/ziface"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// 优先发送队列的长度，只有心跳包使用，不需要很长
+	priorityChanLen = 16
+	// writer 一次最多合并写入的消息条数
+	maxWriteBatchFrames = 64
+)
+
+var (
+	ErrConnClosed    = errors.New("Connection is closed when send msg. ")
+	ErrSendQueueFull = errors.New("send queue is full")
+	ErrSendTimeout   = errors.New("send queue is full, wait timeout")
+)
+
 type Connection struct {
-	//  socket TCP套接字 c
-	Conn *net.TCPConn
+	//  socket 套接字 c，可能是 TCP 连接，也可能是 TLS 连接
+	Conn net.Conn
 	//  链接ID
 	ConnID uint32
 	//  链接的状态（是否关闭）
 	isClosed bool
-	//  等待连接被动退出的channel（管理连接状态，连接断开要通知此channel
+	// 保护连接状态的锁，reader、writer、心跳检测器和关闭服务器时都可能去关闭连接
+	closeLock sync.Mutex
+	//  等待连接被动退出的channel（管理连接状态，连接断开时关闭此channel 通知所有goroutine
 	ExitChan chan bool
-	// 无缓冲通道，用于读、写 goroutine 之间的消息通信
-	msgChan chan []byte
+	// 有缓冲的发送队列，SendMsg 把封好包的数据放进来，writer 从这里取出写入 socket，队列满时按 sendPolicy 处理
+	msgChan chan queuedFrame
+	// 优先发送的队列，心跳包走这里，writer 总是先把它取空，大量文件数据在排队时心跳也能及时发出
+	priorityChan chan queuedFrame
+	// 发送队列满时的处理策略，以及 OverflowBlock 时的最长等待时间，连接运行中也可以修改，用原子操作
+	sendPolicy  int32
+	sendTimeout int64
 	// 当前 连接对应的 处理业务的router
 	MsgHandler ziface.IMessageHandler
+	// 当前连接使用的封包拆包模块，默认是 DataPack，可以用 SetDataPack 替换
+	dp ziface.IDataPack
+	// 封包的缓冲是否来自缓冲池（使用 DataPack 时），是的话 writer 写完后把缓冲还回去
+	poolBuffers bool
+	// 当前连接发送时使用的帧格式版本，开始时是 v1，保证老的客户端也能用；用 MSGID_FRAME_VERSION 协商后升级，用原子操作
+	frameVersion uint32
+	// 对端发来的帧的格式版本，收到 MSGID_FRAME_VERSION 后升级，之后的帧都按它拆包。只在 reader（或事件循环）中使用
+	readVersion uint8
+	// 本端是否在 Start 时发出了 MSGID_FRAME_VERSION，是的话对端发来的 MSGID_FRAME_VERSION 就是回复。只在 Start 之前设置
+	versionOffered bool
+	// 封包和放进发送队列时加读锁，切换发送的帧格式版本时加写锁，保证旧版本的帧都排在协商的回复之前
+	sendLock sync.RWMutex
+	// 协商的回复还在发送队列中时为 1，这期间心跳包也走普通队列、不丢弃最早的消息，免得新版本的帧跑到回复前面或者把回复丢掉，用原子操作
+	versionAckPending int32
+	// 连接是从 server 的哪个监听器进来的，客户端的连接为空
+	listenerName string
+	// 最后一次收到对端数据的时间（UnixNano），reader 写，连接管理器清理空闲连接时读，用原子操作
+	lastActiveTime int64
+	// 本端发起的 Call 正在等待回复的调用表
+	calls *CallTable
+	// 反应堆模式下管理该连接的事件循环，为 nil 时连接使用自己的 reader、writer goroutine。只在 Start 之前设置
+	reactor poller
+	// 反应堆模式下的 socket 和它的文件描述符，加入反应堆时设置
+	rawConn syscall.RawConn
+	fd      int
+	// 反应堆模式下还没收全的帧，只在事件循环中使用；拆包时复用的 reader
+	pending      []byte
+	unpackReader bytes.Reader
+	// 反应堆模式下事件循环是否已经不再读取这个连接（连接正在关闭），只在事件循环中使用
+	readStopped bool
+	// 反应堆模式下是否因为限流暂停了读取
+	readPaused bool
+	// 保护上面的拆包状态：一般只有事件循环使用，限流暂停读取后由恢复读取的 goroutine 接着使用
+	feedLock sync.Mutex
+	// 反应堆模式下按需启动的 writer 是否正在运行，用原子操作
+	writing int32
+	// 收到的消息的限流器，来自 server 的连接管理器，客户端的连接为 nil。只在 Start 之前设置
+	limiter *rateLimiter
+	// 接收连接时的访问控制，连接关闭时减去它的 IP 的连接数，客户端的连接为 nil。只在 Start 之前设置
+	access *accessControl
+	// 连接使用的认证器，为 nil 时不需要认证；认证状态用原子操作；认证帧数只在 reader 中使用；认证超时的计时器，Start 时设置
+	authenticator ziface.IAuthenticator
+	authState     int32
+	authFrames    int
+	authTimer     *time.Timer
+	// 连接管理器调用完 OnConnStart 后关闭，OnConnAuth 要等它。不需要认证时为 nil
+	connStarted chan struct{}
+	// 协商出的发送消息时使用的压缩算法（ziface.CompressionCodec），协商前为 CompressNone，用原子操作
+	sendCodec uint32
+	// 该连接的压缩统计；server 所有连接一起的压缩统计，客户端的连接为 nil，只在 Start 之前设置
+	compressStats compressCounters
+	compressTotal *compressCounters
+	// 不压缩的消息ID，来自 server 或客户端，为 nil 时都压缩。只在 Start 之前设置，之后只读
+	compressSkip map[uint32]struct{}
 	// 与连接管理器通信的通道
 	ConnMgrChan chan ziface.IConnection // 每次客户端连接成功或断开连接会将会连接信息放进这个通道，connManage方法才去添加或删除这个连接
+	connMgrExit <-chan bool             // 连接管理器退出时关闭，之后不再向 ConnMgrChan 写入，只在 Start 之前设置
 	// 该连接的心跳检测器
 	hbc ziface.IHeartBeatChecker
 	// 链接所在的server，必须使用SetServer 添加
 	server ziface.IServer
+	// 连接的上下文，连接关闭时取消。SetServer 时会改为从server 的上下文派生，服务器关闭时也会被取消
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	// 连接属性的集合，里面都是用户自定义的属性
 	property map[string]any // 需要在new函数里初始化
@@ -37,60 +123,152 @@ type Connection struct {
 	propertyLock sync.RWMutex
 }
 
-func NewConnection(c *net.TCPConn, connID uint32, msgHandler ziface.IMessageHandler, connMgrChan chan ziface.IConnection) *Connection {
-	conn := &Connection{ // 声明的msgChan 是不带缓冲区的，ExitChan 也是。
-		Conn:        c,
-		ConnID:      connID,
-		isClosed:    false,
-		ExitChan:    make(chan bool),
-		msgChan:     make(chan []byte),
-		MsgHandler:  msgHandler,
-		ConnMgrChan: connMgrChan, // 此通道由连接管理器管理并维护
-		hbc:         nil,         // 默认不开心跳检测器，把开启权限交给server
-		property:    make(map[string]any),
+func NewConnection(c net.Conn, connID uint32, msgHandler ziface.IMessageHandler, connMgrChan chan ziface.IConnection) *Connection {
+	conn := &Connection{
+		Conn:           c,
+		ConnID:         connID,
+		isClosed:       false,
+		ExitChan:       make(chan bool),
+		msgChan:        make(chan queuedFrame, utils.GlobalObj.MaxMsgChanLen),
+		priorityChan:   make(chan queuedFrame, priorityChanLen),
+		sendPolicy:     int32(utils.GlobalObj.SendQueuePolicy),
+		sendTimeout:    int64(time.Duration(utils.GlobalObj.SendTimeout) * time.Second),
+		MsgHandler:     msgHandler,
+		dp:             NewDataPack(),
+		poolBuffers:    true,
+		frameVersion:   uint32(MsgVersion1),
+		readVersion:    MsgVersion1,
+		lastActiveTime: time.Now().UnixNano(),
+		calls:          NewCallTable(),
+		ConnMgrChan:    connMgrChan, // 此通道由连接管理器管理并维护
+		hbc:            nil,         // 默认不开心跳检测器，把开启权限交给server
+		property:       make(map[string]any),
 	}
-	// 将当前连接加入到 与连接管理器通信的通道 中，把本连接注册到连接管理器
-	conn.ConnMgrChan <- conn
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
 	return conn
 }
 
 // 启动连接，让当前连接准备开始工作
 func (c *Connection) Start() {
 	logrus.Debug("connection start. Connection id = ", c.ConnID)
-	// 启动 当前连接的 读写数据的业务goroutine
-	go c.StartReader()
-	go c.StartWriter()
+	// 要用 v2 的连接在发出任何其他帧之前先发协商帧格式的帧，这时还没有 writer，直接写入 socket
+	if c.GetFrameVersion() == MsgVersion2 {
+		c.offerFrameVersion()
+	}
+	// 启动 当前连接的 读写数据的业务goroutine；交给反应堆的连接由事件循环读取，writer 有数据要发时才启动
+	if c.reactor != nil {
+		if err := c.reactor.add(c); err != nil {
+			logrus.Warnf("连接 %d 加入反应堆失败，改用 goroutine 模式，err = %v", c.ConnID, err)
+			c.reactor = nil
+		}
+	}
+	if c.authenticator != nil {
+		c.startAuthTimer()
+	}
+	if c.reactor == nil {
+		go c.StartReader()
+		go c.StartWriter()
+	}
+	// 将当前连接加入到 与连接管理器通信的通道 中，把本连接注册到连接管理器
+	// 放在 Start 中而不是 NewConnection 中，保证 SetServer 等设置都完成之后才调用 OnConnStart；
+	// 放在确定读写模式之后，OnConnStart 中发送消息时 reactor 已经不会再变
+	// 客户端的连接没有连接管理器，ConnMgrChan 为 nil。连接管理器已经退出的话（server 正在关闭）直接关闭连接
+	if !c.notifyConnMgr() {
+		c.Stop()
+		return
+	}
 	if c.hbc != nil {
 		c.hbc.Start()
 	}
+	if c.authenticator != nil {
+		c.sendAuthChallenge()
+	}
 }
 
 // 关闭连接。结束连接的工作
 func (c *Connection) Stop() {
-	logrus.Debug("connection stop. Connection id = ", c.ConnID)
+	c.closeLock.Lock()
 	// 如果已经关闭就不管了
-	if !c.isClosed {
-		c.isClosed = true
-		// 关闭连接的心跳检测器
-		if c.hbc != nil {
-			c.hbc.Stop()
-		}
-		// 关闭socket 连接
-		c.Conn.Close()
-		// 在连接管理器中删除自己
-		// 将当前连接加入到 与连接管理器通信的通道 中，把本连接从连接管理器中删除
-		c.ConnMgrChan <- c
-		// 回收资源
-		close(c.ExitChan)
-		close(c.msgChan)
+	if c.isClosed {
+		c.closeLock.Unlock()
+		return
+	}
+	c.isClosed = true
+	c.closeLock.Unlock()
+	logrus.Debug("connection stop. Connection id = ", c.ConnID)
+	// 取消连接的上下文，正在处理该连接请求的 router 可以借此尽快结束
+	c.cancel()
+	// 正在等待回复的 Call 都直接返回
+	c.calls.Close(errors.New("Connection is closed when waiting for call response. "))
+	if c.authTimer != nil {
+		c.authTimer.Stop()
+	}
+	// 关闭socket 连接，阻塞在读数据的 reader 会因此返回；反应堆模式下先从事件循环中移除，避免文件描述符被新连接复用后收到它的事件
+	if c.reactor != nil {
+		c.reactor.remove(c)
+	}
+	c.Conn.Close()
+	if c.access != nil {
+		c.access.release(c.RemoteAddr())
+	}
+	// 通知 writer 以及阻塞在 SendMsg 中的 goroutine 退出，发送队列中剩下的数据不再发送。
+	// msgChan 不关闭，否则其他 goroutine 还在 SendMsg 时就会向已关闭的通道写数据而 panic
+	close(c.ExitChan)
+	// 关闭连接的心跳检测器
+	if c.hbc != nil {
+		c.hbc.Stop()
 	}
+	// 在连接管理器中删除自己
+	// 将当前连接加入到 与连接管理器通信的通道 中，把本连接从连接管理器中删除
+	c.notifyConnMgr()
 }
 
-// 获取当前连接绑定的 c
-func (c *Connection) GetTCPConnection() *net.TCPConn {
+// 把本连接放进 与连接管理器通信的通道，连接管理器已经退出的话不再写入（没有人读，写入会一直阻塞），返回 false
+func (c *Connection) notifyConnMgr() bool {
+	if c.ConnMgrChan == nil {
+		return true
+	}
+	select {
+	case <-c.connMgrExit:
+		return false
+	default:
+	}
+	select {
+	case c.ConnMgrChan <- c:
+		return true
+	case <-c.connMgrExit:
+		return false
+	}
+}
+
+// 获取当前连接绑定的 socket，TCP 和 TLS 连接都可以用它读写
+func (c *Connection) GetConnection() net.Conn {
 	return c.Conn
 }
 
+// 获取当前连接底层的 TCP 连接（TLS 连接返回它下层的 TCP 连接），不是基于 TCP 的连接返回 nil
+func (c *Connection) GetTCPConnection() *net.TCPConn {
+	conn := c.Conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, _ := conn.(*net.TCPConn)
+	return tcpConn
+}
+
+// 获取对端的证书，只有开启了双向认证的 TLS 连接才有，否则返回 nil
+func (c *Connection) GetPeerCertificate() *x509.Certificate {
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
 // 获取连接ID
 func (c *Connection) GetConnID() uint32 {
 	return c.ConnID
@@ -103,84 +281,529 @@ func (c *Connection) RemoteAddr() net.Addr {
 
 // 连接的read 业务方法
 func (c *Connection) StartReader() {
-	defer func() { // reader 线程任何一个return 都会给退出通道传入值，
-		c.ExitChan <- true //  StartWriter() 方法接收此通道的值，用来退出 writer 线程
-	}()
+	defer c.Stop() // reader 线程任何一个return 都会关闭连接，Stop 中关闭退出通道，用来退出 writer 线程
+	// 带缓冲的 reader 只在这个 goroutine 中使用，退出时把读缓冲还回去
+	reader := newConnReader(c.Conn)
+	defer reader.release()
 	for {
-		// 按 TLV 的格式进行拆包读取
-		dp := NewDataPack() // 创建一个解包的对象
-		headData := make([]byte, dp.GetFixedHeadLen())
-		_, err := io.ReadFull(c.Conn, headData) // 读出头部数据 []byte类型；客户端关闭的话，这里会收到EOF 的错误
+		// 按 TLV 的格式进行拆包读取，从带缓冲的 reader 中读取头部和 data；客户端关闭的话，这里会收到EOF 的错误
+		msg, err := c.unpack(reader, c.readVersion)
 		if err != nil {
-			if err != io.EOF {
-				logrus.Error("server GetFixedHeadLen err :", err)
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) { // 连接被本端 Stop 关闭时也会返回错误，不用打印
+				logrus.Error("server read Unpack err :", err)
 			}
 			return
 		}
-		if c.hbc != nil {
-			c.hbc.UpdateActiveTime() // 更新心跳检测器时间
+		c.handleMsg(msg)
+	}
+}
+
+// 处理收到的一个完整的消息，reader 和反应堆模式的事件循环都调用它
+func (c *Connection) handleMsg(msg ziface.IMessage) {
+	atomic.StoreInt64(&c.lastActiveTime, time.Now().UnixNano())
+	if c.hbc != nil {
+		c.hbc.UpdateActiveTime() // 更新心跳检测器时间
+	}
+	// 协商帧格式版本的帧由连接自己处理，处理完之后的帧就按新的版本拆包了
+	if msg.GetMsgId() == utils.MSGID_FRAME_VERSION {
+		c.negotiateFrameVersion(msg)
+		freeMessage(msg)
+		return
+	}
+	// 协商压缩的帧由连接自己处理，在认证之前，客户端连接后就可以发送。它本身不会被压缩
+	if msg.GetMsgId() == utils.MSGID_COMPRESSION {
+		if msg.HasFlag(MsgFlagCompressed) {
+			logrus.Warnf("连接 %d 收到压缩过的 MSGID_COMPRESSION，丢弃", c.ConnID)
+		} else {
+			c.negotiateCompression(msg)
 		}
-		msg, err := dp.Unpack(headData, c.GetTCPConnection()) // 直接从 conn 中读取data
-		if err != nil {
-			logrus.Error("server read Fixed Head err :", err)
+		freeMessage(msg)
+		return
+	}
+	// 压缩过的消息先解压，解压出错说明对端有问题，关闭连接。
+	// 认证成功之前不解压，交给 checkAuth 当成没有认证的消息处理，没有认证的对端不能让连接花时间和内存去解压数据
+	if msg.HasFlag(MsgFlagCompressed) {
+		if !c.checkAuth(msg) {
+			return
+		}
+		if !c.decompressMessage(msg) {
+			freeMessage(msg)
+			c.stopReading()
 			return
 		}
-		// 每个connection 得到的数据都封装成request，然后将request 交给router 进行处理
-		// 得到当前conn 数据的Request 请求数据
-		req := &Request{conn: c, msg: msg}
-		// server端收到的所有数据都在handle里面处理
-		go c.MsgHandler.DoMsgHandler(req)
 	}
+	// 心跳包的回复交给心跳检测器计算 RTT，之后照常交给心跳的 router；它的序列号是心跳检测器分配的，不能交给 Call
+	if msg.GetMsgId() == utils.MSGID_HEARTBEAT && msg.HasFlag(MsgFlagResponse) {
+		if c.hbc != nil {
+			c.hbc.HandleReply(msg)
+		}
+	} else if c.calls.Deliver(msg) { // 如果是本端 Call 发出的请求的回复，直接交给等待的 Call，不再交给router
+		return
+	} else if msg.HasFlag(MsgFlagResponse) {
+		// 没有 Call 在等的回复（比如 Call 已经超时）只记录日志，不能交给 router，否则 PING 之类回复消息的 router 会再回复它，两端来回不停
+		if msg.GetMsgId() == utils.MSGID_ERROR {
+			logrus.Warnf("连接 %d 收到错误回复（seq = %d）：%s", c.ConnID, msg.GetSeqId(), string(msg.GetData()))
+		} else {
+			logrus.Debugf("连接 %d 收到没有对应请求的回复 msgId = %d, seq = %d，丢弃", c.ConnID, msg.GetMsgId(), msg.GetSeqId())
+		}
+		freeMessage(msg)
+		return
+	}
+	// 还没有认证成功时只处理认证帧
+	if !c.checkAuth(msg) {
+		return
+	}
+	// 超过限额的消息不再交给 router
+	if !c.allowMsg(msg) {
+		return
+	}
+	c.dispatchMsg(msg)
 }
 
-// 连接的 write 业务方法，给客户端发送消息的模块
+// 把收到的消息交给工作池
+func (c *Connection) dispatchMsg(msg ziface.IMessage) {
+	// 每个connection 得到的数据都封装成request，然后将request 交给router 进行处理
+	// 得到当前conn 数据的Request 请求数据
+	req := newRequest(c, msg, c.ctx)
+	// server端收到的所有数据都交给工作池处理，同一个连接的消息会按顺序处理
+	c.MsgHandler.SendMsgToTaskQueue(req)
+}
+
+// 连接的 write 业务方法，给客户端发送消息的模块。
+// 队列中已经有多条消息时，把它们攒成一批，用 net.Buffers 一次写入（TCP 和 Unix domain socket 会用 writev），减少系统调用
 func (c *Connection) StartWriter() {
-	// 不停阻塞，一直等待 reader给同步通道发送通知
+	batch := make([]queuedFrame, 0, maxWriteBatchFrames)
+	iov := make(net.Buffers, 0, maxWriteBatchFrames)
+	// 不停阻塞，一直等待发送队列中有数据
 	for {
+		var frame queuedFrame
+		// 先把优先队列中的数据发完
 		select {
-		case data := <-c.msgChan: // data 就是reader 收到客户消息后，执行完业务逻辑，封装好的要发回客户的信息
-			if _, err := c.GetTCPConnection().Write(data); err != nil {
-				// 向对端写入数据时，由于对端关闭，这里便报错了。
-				// 但是由于reader 一直阻塞在 io.ReadFull 方法，所以在这里也不好去控制reader 关闭
-				// 只能关闭程序时先关闭server，再关闭client
-				logrus.Error("[Writer] Send dada err: ", err)
+		case frame = <-c.priorityChan:
+		default:
+			select {
+			case frame = <-c.priorityChan:
+			case frame = <-c.msgChan: // frame 就是reader 收到客户消息后，执行完业务逻辑，封装好的要发回客户的信息
+			case <-c.ExitChan:
+				// 连接已经关闭（一般是 reader 读到客户端退出后调用了 Stop），writer 也退出
 				return
 			}
-		case <-c.ExitChan:
-			// reader 收到客户端退出的消息，就发送信息告诉writer关闭自己
-			// （从没值的通道中取值会阻塞）从退出通道中取值，取到了说明要退出程序了。（一般是reader goroutine向退出通道中传入值）
-			c.Stop()
+		}
+		batch = c.collectBatch(append(batch[:0], frame), len(frame.data))
+		if !c.write(&iov, batch) {
 			return
 		}
 	}
 }
 
+// 把队列中已经有的消息攒进这一批，直到达到 GlobalObj.WriteBatchSize 字节或者 maxWriteBatchFrames 条。
+// 队列空了就直接发送；配置了 WriteFlushInterval 的话，再最多等这么久看有没有新的消息
+func (c *Connection) collectBatch(batch []queuedFrame, size int) []queuedFrame {
+	var flushTimer *time.Timer
+	defer func() {
+		if flushTimer != nil {
+			flushTimer.Stop()
+		}
+	}()
+	for size < int(utils.GlobalObj.WriteBatchSize) && len(batch) < maxWriteBatchFrames {
+		var frame queuedFrame
+		select {
+		case frame = <-c.priorityChan:
+		default:
+			select {
+			case frame = <-c.priorityChan:
+			case frame = <-c.msgChan:
+			default:
+				if utils.GlobalObj.WriteFlushInterval <= 0 {
+					return batch
+				}
+				if flushTimer == nil {
+					flushTimer = time.NewTimer(time.Duration(utils.GlobalObj.WriteFlushInterval) * time.Millisecond)
+				}
+				select {
+				case frame = <-c.priorityChan:
+				case frame = <-c.msgChan:
+				case <-flushTimer.C:
+					return batch
+				case <-c.ExitChan:
+					return batch
+				}
+			}
+		}
+		batch = append(batch, frame)
+		size += len(frame.data)
+	}
+	return batch
+}
+
+// 把一批数据写入 socket，写完把缓冲还回缓冲池。出错时关闭连接并返回 false
+func (c *Connection) write(iov *net.Buffers, batch []queuedFrame) bool {
+	// 协商帧格式的回复在它之后入队的帧前面；发送队列空了说明回复已经取出来了，之后心跳包可以再走优先队列
+	if atomic.LoadInt32(&c.versionAckPending) == 1 && len(c.msgChan) == 0 {
+		atomic.StoreInt32(&c.versionAckPending, 0)
+	}
+	// WriteTo 会修改传入的 net.Buffers，所以每次重新填一份，batch 留着还缓冲用
+	*iov = (*iov)[:0]
+	for _, frame := range batch {
+		*iov = append(*iov, frame.data)
+	}
+	_, err := iov.WriteTo(c.Conn)
+	closeAfter := false
+	for i, frame := range batch {
+		closeAfter = closeAfter || frame.closeAfter
+		frame.release(c.poolBuffers)
+		batch[i] = queuedFrame{}
+	}
+	if err != nil {
+		// 向对端写入数据时，由于对端关闭，这里便报错了。
+		// 但是由于reader 一直阻塞在 io.ReadFull 方法，所以在这里也不好去控制reader 关闭
+		// 所以这里直接关闭连接，reader 也会随之返回
+		logrus.Error("[Writer] Send dada err: ", err)
+		c.Stop()
+		return false
+	}
+	if closeAfter {
+		c.Stop()
+		return false
+	}
+	return true
+}
+
+// 把 msg 放进发送队列，writer 把它（以及排在它前面的数据）写出去之后关闭连接；最多等待 timeout，到时还没写出去也关闭。
+// 关闭的标记跟着这个帧走，放进队列之前 writer 不会因为队列暂时空了就提前关闭
+func (c *Connection) sendAndClose(msg ziface.IMessage, policy ziface.OverflowPolicy, timeout time.Duration) error {
+	time.AfterFunc(timeout, c.Stop)
+	return c.send(msg, policy, true)
+}
+
 // 此方法将我们要发送给客户端的数据先进行封包，得二进制数据，再发送给写的goroutine
 func (c *Connection) SendMsg(msgID uint32, length uint32, data []byte) error {
-	if c.isClosed {
-		return errors.New("Connection is closed when send msg. ")
-	}
-	msg := &Message{
+	return c.SendMessage(&Message{
+		MsgId:  msgID,
+		Length: length,
+		Data:   data,
+	})
+}
+
+// 发送一个完整的消息，消息的版本为 0 时使用该连接协商出的帧格式。发送队列满时按该连接的策略处理
+func (c *Connection) SendMessage(msg ziface.IMessage) error {
+	return c.sendMessage(msg, ziface.OverflowPolicy(atomic.LoadInt32(&c.sendPolicy)))
+}
+
+// 发送数据，发送队列满时不阻塞，直接返回 ErrSendQueueFull，适合广播等不能被一个慢连接拖住的场景
+func (c *Connection) TrySendMsg(msgID uint32, length uint32, data []byte) error {
+	return c.sendMessage(&Message{
 		MsgId:  msgID,
 		Length: length,
 		Data:   data,
+	}, ziface.OverflowDropNewest)
+}
+
+// 广播时同样的帧在连接之间共用的 key：帧格式版本和压缩算法都相同的连接，封出来的帧是一样的
+type broadcastKey struct {
+	version uint8
+	codec   ziface.CompressionCodec
+}
+
+// 发送广播的消息，发送队列满时直接丢弃，和 TrySendMsg 一样。packed 中是这次广播已经封好包的缓冲，
+// 同样的 key 只封包一次，之后的连接直接共用；每放进一个发送队列增加一个引用，writer 写完后释放
+func (c *Connection) sendShared(msgID uint32, data []byte, packed map[broadcastKey]*sharedBuffer) error {
+	if !c.IsAlive() {
+		return ErrConnClosed
+	}
+	// 与 sendMessage 一样，从确定版本到放进发送队列都持有读锁
+	c.sendLock.RLock()
+	defer c.sendLock.RUnlock()
+	key := broadcastKey{version: c.GetFrameVersion()}
+	if key.version == MsgVersion2 { // v1 的帧不压缩
+		key.codec = ziface.CompressionCodec(atomic.LoadUint32(&c.sendCodec))
+	}
+	shared := packed[key]
+	if shared == nil {
+		msg, compressed := c.compressMessageWith(&Message{
+			Version: key.version,
+			MsgId:   msgID,
+			Length:  uint32(len(data)),
+			Data:    data,
+		}, key.codec)
+		sendData, err := c.dp.Pack(msg)
+		if compressed != nil {
+			putBuffer(compressed)
+		}
+		if err != nil {
+			logrus.Error("when broadcast Pack msg, err = ", err)
+			return err
+		}
+		// 这一个引用属于广播的调用方，给所有连接都放进发送队列之后释放
+		shared = &sharedBuffer{data: sendData, refs: 1}
+		packed[key] = shared
+	}
+	if err := c.checkDatagramSize(shared.data); err != nil {
+		return err
+	}
+	atomic.AddInt32(&shared.refs, 1)
+	if err := c.enqueue(queuedFrame{data: shared.data, shared: shared}, ziface.OverflowDropNewest); err != nil {
+		shared.release()
+		return err
+	}
+	c.wakeWriter()
+	return nil
+}
+
+func (c *Connection) sendMessage(msg ziface.IMessage, policy ziface.OverflowPolicy) error {
+	return c.send(msg, policy, false)
+}
+
+// 封包并放进发送队列，closeAfter 为 true 时 writer 写完这个帧就关闭连接
+func (c *Connection) send(msg ziface.IMessage, policy ziface.OverflowPolicy, closeAfter bool) error {
+	if !c.IsAlive() {
+		return ErrConnClosed
+	}
+	// 从确定版本到放进发送队列都持有读锁，切换版本时不会有旧版本的帧排到协商的回复后面
+	c.sendLock.RLock()
+	defer c.sendLock.RUnlock()
+	if msg.GetVersion() == 0 {
+		msg.SetVersion(c.GetFrameVersion())
+	}
+	msg, compressed := c.compressMessage(msg)
+	sendData, err := c.dp.Pack(msg)
+	if compressed != nil && c.poolBuffers {
+		putBuffer(compressed) // DataPack 的 Pack 已经把数据复制到封包的缓冲中了
 	}
-	dp := DataPack{}
-	sendData, err := dp.Pack(msg)
 	if err != nil {
 		logrus.Error("when SendMsg Pack msg, err = ", err)
 		return err
 	}
-	// 将要发送的数据发给writer 线程
-	c.msgChan <- sendData
+	if err := c.checkDatagramSize(sendData); err != nil {
+		if c.poolBuffers {
+			putBuffer(sendData)
+		}
+		return err
+	}
+	ackPending := atomic.LoadInt32(&c.versionAckPending) == 1
+	if ackPending && policy == ziface.OverflowDropOldest {
+		policy = ziface.OverflowDropNewest
+	}
+	// 心跳包放进优先队列，满了就丢弃：说明对端已经很久没有读取数据了，交给心跳检测去处理
+	if msg.GetMsgId() == utils.MSGID_HEARTBEAT && !ackPending && !closeAfter {
+		select {
+		case c.priorityChan <- queuedFrame{data: sendData}:
+			c.wakeWriter()
+			return nil
+		case <-c.ExitChan:
+			return ErrConnClosed
+		default:
+			return ErrSendQueueFull
+		}
+	}
+	if msg.GetMsgId() == utils.MSGID_HEARTBEAT {
+		policy = ziface.OverflowDropNewest
+	}
+	// 将要发送的数据放进发送队列，交给writer 线程
+	if err := c.enqueue(queuedFrame{data: sendData, closeAfter: closeAfter}, policy); err != nil {
+		return err
+	}
+	c.wakeWriter()
 	return nil
 }
 
+// 把封好包的数据放进发送队列，队列满时按 policy 处理
+func (c *Connection) enqueue(frame queuedFrame, policy ziface.OverflowPolicy) error {
+	select {
+	case c.msgChan <- frame:
+		return nil
+	case <-c.ExitChan:
+		return ErrConnClosed
+	default:
+	}
+	switch policy {
+	case ziface.OverflowDropNewest:
+		return ErrSendQueueFull
+	case ziface.OverflowDropOldest:
+		for {
+			select {
+			case oldest := <-c.msgChan: // 丢弃最早的一条，腾出位置
+				oldest.release(c.poolBuffers)
+				logrus.Debugf("连接 %d 的发送队列已满，丢弃最早的一条消息", c.ConnID)
+			default:
+			}
+			select {
+			case c.msgChan <- frame:
+				return nil
+			case <-c.ExitChan:
+				return ErrConnClosed
+			default: // 腾出的位置被其他 goroutine 抢走了，再丢一条
+			}
+		}
+	case ziface.OverflowCloseConn:
+		logrus.Warnf("连接 %d 的发送队列已满，关闭这个处理不过来的连接", c.ConnID)
+		c.Stop()
+		return ErrSendQueueFull
+	default: // OverflowBlock
+		var timeoutChan <-chan time.Time
+		if timeout := time.Duration(atomic.LoadInt64(&c.sendTimeout)); timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			timeoutChan = timer.C
+		}
+		select {
+		case c.msgChan <- frame:
+			return nil
+		case <-c.ExitChan:
+			return ErrConnClosed
+		case <-timeoutChan:
+			return ErrSendTimeout
+		}
+	}
+}
+
+// 发送队列（包括优先队列）中还没写入 socket 的消息数
+func (c *Connection) QueueDepth() int {
+	return len(c.msgChan) + len(c.priorityChan)
+}
+
+// 设置发送队列满时的处理策略，timeout 是 OverflowBlock 时的最长等待时间，为 0 时一直等待直到连接关闭
+func (c *Connection) SetSendPolicy(policy ziface.OverflowPolicy, timeout time.Duration) {
+	atomic.StoreInt32(&c.sendPolicy, int32(policy))
+	atomic.StoreInt64(&c.sendTimeout, int64(timeout))
+}
+
+// 向对端发起一次请求并等待它的回复，返回回复的数据；对端回复 MSGID_ERROR 时返回其中的错误信息
+func (c *Connection) Call(ctx context.Context, msgID uint32, data []byte) ([]byte, error) {
+	if c.GetFrameVersion() != MsgVersion2 {
+		return nil, fmt.Errorf("connection %d does not support v2 frame, can not call", c.ConnID)
+	}
+	return c.calls.Call(ctx, func(seqId uint32) error {
+		return c.SendMessage(&Message{
+			Version: MsgVersion2,
+			SeqId:   seqId,
+			MsgId:   msgID,
+			Length:  uint32(len(data)),
+			Data:    data,
+		})
+	})
+}
+
+// 指定该连接想使用的帧格式版本，需要在 Start 之前设置。为 v2 时连接开始后先用 MSGID_FRAME_VERSION 告诉对端，
+// 之后发出的帧都是 v2，对端回复之后它发来的帧也按 v2 解析。客户端明确知道server 支持 v2 时使用
+func (c *Connection) SetFrameVersion(version uint8) {
+	atomic.StoreUint32(&c.frameVersion, uint32(version))
+}
+
+// 得到该连接协商出的帧格式版本
+func (c *Connection) GetFrameVersion() uint8 {
+	return uint8(atomic.LoadUint32(&c.frameVersion))
+}
+
+// 按对端发来的帧的格式版本拆包
+func (c *Connection) unpack(reader io.Reader, version uint8) (ziface.IMessage, error) {
+	return unpackVersion(c.dp, reader, version)
+}
+
+// 按指定的帧格式版本拆包。自定义的封包模块不参与版本协商，直接调用它的 Unpack
+func unpackVersion(dp ziface.IDataPack, reader io.Reader, version uint8) (ziface.IMessage, error) {
+	if dataPack, ok := dp.(*DataPack); ok {
+		return dataPack.UnpackVersion(reader, version)
+	}
+	return dp.Unpack(reader)
+}
+
+// 协商帧格式版本的帧，总是 v1 的格式，data 是版本号
+func newFrameVersionMsg(version uint8) *Message {
+	return &Message{
+		Version: MsgVersion1,
+		MsgId:   utils.MSGID_FRAME_VERSION,
+		Length:  1,
+		Data:    []byte{version},
+	}
+}
+
+// 在 Start 中告诉对端本端要用 v2，之后本端发出的帧都是 v2。这时 writer 还没有启动，直接写入 socket，保证它是第一个帧
+func (c *Connection) offerFrameVersion() {
+	if _, ok := c.dp.(*DataPack); !ok {
+		return
+	}
+	c.versionOffered = true
+	buf, err := c.dp.Pack(newFrameVersionMsg(MsgVersion2))
+	if err != nil {
+		logrus.Error("when offer frame version Pack msg, err = ", err)
+		return
+	}
+	if _, err := c.Conn.Write(buf); err != nil {
+		logrus.Warnf("连接 %d 发送协商帧格式的帧出错，err = %v", c.ConnID, err) // 连接已经断了，reader 会关闭它
+	}
+	putBuffer(buf)
+}
+
+// 处理 MSGID_FRAME_VERSION 的帧：本端在 Start 时发出过的话这是对端的回复，否则是对端的请求，同意后回复它。
+// 之后对端发来的帧都按 v2 拆包；回复之后本端发出的帧也都是 v2
+func (c *Connection) negotiateFrameVersion(msg ziface.IMessage) {
+	if c.readVersion != MsgVersion1 {
+		logrus.Debugf("连接 %d 已经协商过帧格式，忽略 MSGID_FRAME_VERSION", c.ConnID)
+		return
+	}
+	data := msg.GetData()
+	if len(data) != 1 || data[0] != MsgVersion2 {
+		if len(data) == 1 && data[0] == MsgVersion1 && !c.versionOffered {
+			return // 对端要用 v1，什么都不用改
+		}
+		logrus.Warnf("连接 %d 无法协商对端的帧格式 %v，关闭连接", c.ConnID, data)
+		c.stopReading()
+		return
+	}
+	if _, ok := c.dp.(*DataPack); !ok {
+		logrus.Warnf("连接 %d 使用自定义的封包模块，不支持 v2 的帧格式，关闭连接", c.ConnID)
+		c.stopReading()
+		return
+	}
+	c.readVersion = MsgVersion2
+	logrus.Debugf("连接 %d 协商帧格式为 v2", c.ConnID)
+	if !c.versionOffered {
+		c.ackFrameVersion()
+	}
+}
+
+// 回复对端的协商请求并把发送的帧格式切换为 v2。持有写锁时放进发送队列，之前封包的 v1 的帧都排在回复前面，之后的都是 v2
+func (c *Connection) ackFrameVersion() {
+	buf, err := c.dp.Pack(newFrameVersionMsg(MsgVersion2))
+	if err != nil {
+		logrus.Error("when ack frame version Pack msg, err = ", err)
+		return
+	}
+	c.sendLock.Lock()
+	// 回复不能丢，队列满时等 writer 腾出位置
+	err = c.enqueue(queuedFrame{data: buf}, ziface.OverflowBlock)
+	if err == nil {
+		atomic.StoreInt32(&c.versionAckPending, 1)
+		atomic.StoreUint32(&c.frameVersion, uint32(MsgVersion2))
+	}
+	c.sendLock.Unlock()
+	if err != nil {
+		putBuffer(buf)
+		logrus.Warnf("连接 %d 回复协商帧格式的帧出错，关闭连接，err = %v", c.ConnID, err)
+		c.stopReading()
+		return
+	}
+	c.wakeWriter()
+}
+
+// 设置当前连接使用的封包拆包模块，需要在 Start 之前设置
+func (c *Connection) SetDataPack(dp ziface.IDataPack) {
+	c.dp = dp
+	// 自定义的封包模块返回的缓冲可能还在别处使用，不能放进缓冲池
+	_, c.poolBuffers = dp.(*DataPack)
+}
+
 // 绑定心跳检测器
 func (c *Connection) BindHeartBeatChecker(hbc ziface.IHeartBeatChecker) {
 	c.hbc = hbc
 }
 
+// 得到绑定的心跳检测器，没有开启心跳检测时返回 nil
+func (c *Connection) GetHeartBeatChecker() ziface.IHeartBeatChecker {
+	return c.hbc
+}
+
 // 设置连接属性
 func (c *Connection) SetProperty(key string, value any) {
 	// 加写锁
@@ -212,13 +835,42 @@ func (c *Connection) RemoveProperty(key string) {
 
 // 该连接是否还存活
 func (c *Connection) IsAlive() bool {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
 	return !c.isClosed
 }
 
+// 设置连接是从哪个监听器进来的，需要在 Start 之前调用
+func (c *Connection) SetListenerName(name string) {
+	c.listenerName = name
+}
+
+// 得到连接是从 server 的哪个监听器进来的
+func (c *Connection) GetListenerName() string {
+	return c.listenerName
+}
+
+// 最后一次收到对端数据的时间，还没收到过数据时是连接创建的时间
+func (c *Connection) GetLastActiveTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActiveTime))
+}
+
 // 虽然这样耦合太严重了，但为了实现在服务器关闭正在传输的文件，必须把server 加到每个连接中
 func (c *Connection) SetServer(server ziface.IServer) {
 	c.server = server
+	c.setParentContext(server.Context())
+}
+
+// 让连接的上下文从 parent 派生，parent 被取消时连接的上下文也会被取消。需要在 Start 之前调用
+func (c *Connection) setParentContext(parent context.Context) {
+	c.cancel() // 原来的上下文不再使用
+	c.ctx, c.cancel = context.WithCancel(parent)
 }
 func (c *Connection) GetServer() ziface.IServer {
 	return c.server
 }
+
+// 得到连接的上下文
+func (c *Connection) Context() context.Context {
+	return c.ctx
+}
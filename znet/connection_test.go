@@ -0,0 +1,257 @@
+package znet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/myZinx/utils"
+	"github.com/myZinx/ziface"
+)
+
+// 测试用的 router，收到的请求交给 f 处理
+type testRouter struct {
+	BaseRouter
+	f func(ziface.IRequest)
+}
+
+func (r *testRouter) Handle(req ziface.IRequest) { r.f(req) }
+
+// 把请求的数据原样回复的 router
+func echoRouter() ziface.IRouter {
+	return &testRouter{f: func(req ziface.IRequest) { req.Reply(req.GetData()) }}
+}
+
+// 用 net.Pipe 创建一个连接并 Start，返回它和管道的另一端，测试在另一端直接读写帧。
+// setup 在 Start 之前调用；v2 的连接在 Start 中直接写协商帧，要等另一端读，所以 Start 在另外的 goroutine 中
+func startPipeConn(t *testing.T, routers map[uint32]ziface.IRouter, setup func(*Connection)) (*Connection, net.Conn) {
+	t.Helper()
+	handler := NewMessageHandler()
+	for msgID, router := range routers {
+		handler.AddRouter(msgID, router)
+	}
+	handler.StartWorkerPool()
+	local, peer := net.Pipe()
+	c := NewConnection(local, 1, handler, nil)
+	if setup != nil {
+		setup(c)
+	}
+	started := make(chan struct{})
+	go func() {
+		c.Start()
+		close(started)
+	}()
+	t.Cleanup(func() {
+		peer.Close()
+		<-started
+		c.Stop()
+		handler.StopWorkerPool()
+	})
+	return c, peer
+}
+
+// 在管道的另一端按 version 的格式写一个帧
+func writeFrame(t *testing.T, peer net.Conn, version uint8, msg *Message) {
+	t.Helper()
+	msg.Version, msg.Length = version, uint32(len(msg.Data))
+	buf, _ := NewDataPack().Pack(msg)
+	peer.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := peer.Write(buf); err != nil {
+		t.Fatalf("write frame msgId = %d: %v", msg.MsgId, err)
+	}
+}
+
+// 在管道的另一端按 version 的格式读一个帧
+func readFrame(t *testing.T, peer net.Conn, version uint8) ziface.IMessage {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := NewDataPack().UnpackVersion(peer, version)
+	if err != nil {
+		t.Fatalf("read v%d frame: %v", version, err)
+	}
+	return msg
+}
+
+// 等待连接被关闭：另一端读到 EOF
+func expectClosed(t *testing.T, peer net.Conn) {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	for {
+		_, err := peer.Read(buf)
+		if err == io.EOF || errors.Is(err, io.ErrClosedPipe) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("connection not closed: %v", err)
+		}
+	}
+}
+
+// 只会 v1 的老客户端：不发协商帧，server 一直用 v1 回复，也不能对它用 Call
+func TestFrameVersionV1Peer(t *testing.T) {
+	c, peer := startPipeConn(t, map[uint32]ziface.IRouter{utils.MSGID_PING: echoRouter()}, nil)
+	writeFrame(t, peer, MsgVersion1, &Message{MsgId: utils.MSGID_PING, Data: []byte("hello")})
+	reply := readFrame(t, peer, MsgVersion1)
+	if reply.GetMsgId() != utils.MSGID_PING || string(reply.GetData()) != "hello" {
+		t.Fatalf("reply msgId = %d, data = %q", reply.GetMsgId(), reply.GetData())
+	}
+	if v := c.GetFrameVersion(); v != MsgVersion1 {
+		t.Fatalf("frame version = %d, want v1", v)
+	}
+	if _, err := c.Call(c.Context(), utils.MSGID_PING, nil); err == nil {
+		t.Fatal("Call on a v1 connection succeeded")
+	}
+}
+
+// 对端要用 v2：server 用 v1 的帧回复同意，之后双方都用 v2，回复带着请求的序列号和回复标志
+func TestFrameVersionV2Offer(t *testing.T) {
+	c, peer := startPipeConn(t, map[uint32]ziface.IRouter{utils.MSGID_PING: echoRouter()}, nil)
+	writeFrame(t, peer, MsgVersion1, newFrameVersionMsg(MsgVersion2))
+	ack := readFrame(t, peer, MsgVersion1)
+	if ack.GetMsgId() != utils.MSGID_FRAME_VERSION || !bytes.Equal(ack.GetData(), []byte{MsgVersion2}) {
+		t.Fatalf("ack msgId = %d, data = %v", ack.GetMsgId(), ack.GetData())
+	}
+	writeFrame(t, peer, MsgVersion2, &Message{SeqId: 42, MsgId: utils.MSGID_PING, Data: []byte("v2")})
+	reply := readFrame(t, peer, MsgVersion2)
+	if reply.GetSeqId() != 42 || !reply.HasFlag(MsgFlagResponse) || string(reply.GetData()) != "v2" {
+		t.Fatalf("reply seq = %d, flags = %d, data = %q", reply.GetSeqId(), reply.GetFlags(), reply.GetData())
+	}
+	if v := c.GetFrameVersion(); v != MsgVersion2 {
+		t.Fatalf("frame version = %d, want v2", v)
+	}
+}
+
+// 本端要用 v2：Start 时第一个帧就是协商帧，之后发出的都是 v2，对端同意后它发来的帧也按 v2 拆包
+func TestFrameVersionLocalOffer(t *testing.T) {
+	got := make(chan string, 1)
+	sink := &testRouter{f: func(req ziface.IRequest) { got <- string(req.GetData()) }}
+	c, peer := startPipeConn(t, map[uint32]ziface.IRouter{utils.MSGID_GENERAL_MSG: sink}, func(c *Connection) {
+		c.SetFrameVersion(MsgVersion2)
+	})
+	offer := readFrame(t, peer, MsgVersion1)
+	if offer.GetMsgId() != utils.MSGID_FRAME_VERSION || !bytes.Equal(offer.GetData(), []byte{MsgVersion2}) {
+		t.Fatalf("first frame msgId = %d, data = %v, want the frame version offer", offer.GetMsgId(), offer.GetData())
+	}
+	go c.SendMsg(utils.MSGID_GENERAL_MSG, 3, []byte("out"))
+	if msg := readFrame(t, peer, MsgVersion2); string(msg.GetData()) != "out" {
+		t.Fatalf("frame after offer: %q", msg.GetData())
+	}
+	writeFrame(t, peer, MsgVersion1, newFrameVersionMsg(MsgVersion2))
+	writeFrame(t, peer, MsgVersion2, &Message{MsgId: utils.MSGID_GENERAL_MSG, Data: []byte("in")})
+	select {
+	case data := <-got:
+		if data != "in" {
+			t.Fatalf("router got %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("v2 frame after the ack was not handled")
+	}
+}
+
+// 不认识的版本号：关闭连接
+func TestFrameVersionUnknown(t *testing.T) {
+	_, peer := startPipeConn(t, nil, nil)
+	writeFrame(t, peer, MsgVersion1, newFrameVersionMsg(9))
+	expectClosed(t, peer)
+}
+
+// 自定义的封包模块：只有包头的 msgID 和长度，大端序
+type bigEndianPack struct{}
+
+func (bigEndianPack) GetHeadLen() uint32 { return 8 }
+
+func (bigEndianPack) Pack(msg ziface.IMessage) ([]byte, error) {
+	buf := make([]byte, 8+len(msg.GetData()))
+	binary.BigEndian.PutUint32(buf, msg.GetMsgId())
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(msg.GetData())))
+	copy(buf[8:], msg.GetData())
+	return buf, nil
+}
+
+func (bigEndianPack) Unpack(r io.Reader) (ziface.IMessage, error) {
+	var head [8]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	msg := &Message{MsgId: binary.BigEndian.Uint32(head[:]), Length: binary.BigEndian.Uint32(head[4:])}
+	msg.Data = make([]byte, msg.Length)
+	if _, err := io.ReadFull(r, msg.Data); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// 自定义的封包模块不参与版本协商：要用 v2 时也不发协商帧，收到对端的协商帧时关闭连接
+func TestFrameVersionCustomDataPack(t *testing.T) {
+	t.Run("no offer", func(t *testing.T) {
+		c, peer := startPipeConn(t, nil, func(c *Connection) {
+			c.SetDataPack(bigEndianPack{})
+			c.SetFrameVersion(MsgVersion2)
+		})
+		go c.SendMsg(utils.MSGID_GENERAL_MSG, 2, []byte("hi"))
+		peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+		msg, err := bigEndianPack{}.Unpack(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.GetMsgId() != utils.MSGID_GENERAL_MSG || string(msg.GetData()) != "hi" {
+			t.Fatalf("first frame msgId = %d, data = %q", msg.GetMsgId(), msg.GetData())
+		}
+	})
+	t.Run("reject peer offer", func(t *testing.T) {
+		_, peer := startPipeConn(t, nil, func(c *Connection) {
+			c.SetDataPack(bigEndianPack{})
+		})
+		buf, _ := bigEndianPack{}.Pack(newFrameVersionMsg(MsgVersion2))
+		peer.SetWriteDeadline(time.Now().Add(2 * time.Second))
+		if _, err := peer.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		expectClosed(t, peer)
+	})
+}
+
+// v2 的帧带着序列号和标志位，v1 的帧不带；frameLength 与 Pack 的长度一致
+func TestDataPackSeqFlagsRoundTrip(t *testing.T) {
+	dp := NewDataPack()
+	msg := &Message{
+		Version: MsgVersion2,
+		Flags:   MsgFlagResponse | MsgFlagCompressed,
+		SeqId:   0xdeadbeef,
+		MsgId:   utils.MSGID_GENERAL_MSG,
+		Length:  5,
+		Data:    []byte("hello"),
+	}
+	for _, version := range []uint8{MsgVersion1, MsgVersion2} {
+		msg.Version = version
+		buf, err := dp.Pack(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := frameLength(buf, version); err != nil || n != len(buf) {
+			t.Errorf("v%d: frameLength = %d, %v, want %d", version, n, err, len(buf))
+		}
+		got, err := dp.UnpackVersion(bytes.NewReader(buf), version)
+		if err != nil {
+			t.Fatalf("v%d: unpack err: %v", version, err)
+		}
+		wantSeq, wantFlags := uint32(0), uint8(0)
+		if version == MsgVersion2 {
+			wantSeq, wantFlags = msg.SeqId, msg.Flags
+		}
+		if got.GetSeqId() != wantSeq || got.GetFlags() != wantFlags || got.GetMsgId() != msg.MsgId || string(got.GetData()) != "hello" {
+			t.Errorf("v%d: got seq = %#x, flags = %d, msgId = %d, data = %q", version, got.GetSeqId(), got.GetFlags(), got.GetMsgId(), got.GetData())
+		}
+	}
+	// 按 v2 拆 v1 的帧：开头不是 magic，说明两端的版本不一致
+	msg.Version = MsgVersion1
+	buf, _ := dp.Pack(msg)
+	if _, err := dp.UnpackVersion(bytes.NewReader(append(buf, make([]byte, 8)...)), MsgVersion2); !errors.Is(err, errBadFrameHead) {
+		t.Errorf("v1 frame unpacked as v2: err = %v, want errBadFrameHead", err)
+	}
+}
@@ -3,7 +3,9 @@ package znet
 import (
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/myZinx/utils"
 	"github.com/myZinx/ziface"
 	"github.com/sirupsen/logrus"
 )
@@ -16,20 +18,41 @@ type ConnManager struct {
 	// 如果这些handler 方法有增删改查，那么就有并发问题，所以需要一个锁
 	connLock    sync.RWMutex            // 保护连接集合的读写锁
 	ConnMgrChan chan ziface.IConnection // 每次客户端连接成功或断开连接会将会连接信息放进这个通道，connManage方法才去添加或删除这个连接
+	exitChan    chan bool               // 关闭 ConnManage 方法的通道，关闭之后连接不会再向 ConnMgrChan 写入
+	emptyCond   *sync.Cond              // 集合中的连接被删光时广播，Stop 等待它，使用 connLock 的写锁
+	// 分组（房间），key 是组名，value 是组内的连接；connGroups 是反向索引，连接删除时用它把连接从所有组中删除
+	groups     map[string]map[uint32]ziface.IConnection
+	connGroups map[uint32]map[string]struct{}
+	groupLock  sync.RWMutex // 保护 groups 和 connGroups
+	// 收到的消息的限流规则和令牌桶
+	limiter *rateLimiter
 }
 
 func NewConnManager() *ConnManager {
-	return &ConnManager{
+	cm := &ConnManager{
 		conns:       make(map[uint32]ziface.IConnection),
 		ConnMgrChan: make(chan ziface.IConnection, 32), // 暂时随便定义一个长度。高并发时长度太小会导致连接缓慢，因为通道满了还写入就会阻塞。但通道太长又浪费空间
+		exitChan:    make(chan bool),
+		groups:      make(map[string]map[uint32]ziface.IConnection),
+		connGroups:  make(map[uint32]map[string]struct{}),
+		limiter:     newRateLimiter(),
 		// 锁不用初始化了
 	}
+	cm.emptyCond = sync.NewCond(&cm.connLock)
+	return cm
 }
 
 // 连接管理的方法，每次客户端连接成功或断开连接会将会连接信息放进通道，connManage方法从通道中读取后才去添加或删除这个连接
 func (cm *ConnManager) ConnManage() {
 	for {
-		conn := <-cm.ConnMgrChan
+		var conn ziface.IConnection
+		select {
+		case conn = <-cm.ConnMgrChan:
+		case <-cm.exitChan:
+			cm.drainConnMgrChan()
+			logrus.Debug("[ConnManager] ConnManage exit")
+			return
+		}
 		// 如果该conn 在管理器中有就删除，没有就加入
 		if _, has := cm.conns[conn.GetConnID()]; has {
 			cm.Remove(conn)
@@ -38,6 +61,9 @@ func (cm *ConnManager) ConnManage() {
 		} else {
 			cm.Add(conn)
 			cm.server.CallOnConnStart(conn)
+			if c, ok := conn.(*Connection); ok {
+				c.markStarted() // 正在认证的连接认证成功后才能调用 OnConnAuth
+			}
 			if cm.Len()%1000 == 0 {
 				logrus.Infof("[ConnManager] 当前连接人数=  %d, \n", cm.Len())
 			}
@@ -46,6 +72,23 @@ func (cm *ConnManager) ConnManage() {
 	}
 }
 
+// ConnManage 退出前处理通道中剩下的连接：关闭的连接照常删除并调用 OnConnStop，还没加入的新连接直接关闭
+func (cm *ConnManager) drainConnMgrChan() {
+	for {
+		select {
+		case conn := <-cm.ConnMgrChan:
+			if _, err := cm.Get(conn.GetConnID()); err == nil {
+				cm.Remove(conn)
+				cm.server.CallOnConnStop(conn)
+			} else {
+				conn.Stop()
+			}
+		default:
+			return
+		}
+	}
+}
+
 // 增加连接
 func (cm *ConnManager) Add(conn ziface.IConnection) {
 	// 保护共享资源 map，加 写锁
@@ -55,12 +98,17 @@ func (cm *ConnManager) Add(conn ziface.IConnection) {
 	logrus.Debug("connection (id= ", conn.GetConnID(), ") added to ConnManager successfuly")
 }
 
-// 删除连接
+// 删除连接，同时把它从所有组中删除
 func (cm *ConnManager) Remove(conn ziface.IConnection) {
 	// 保护共享资源 map，加 写锁
 	cm.connLock.Lock()
-	defer cm.connLock.Unlock()
 	delete(cm.conns, conn.GetConnID())
+	if len(cm.conns) == 0 {
+		cm.emptyCond.Broadcast()
+	}
+	cm.connLock.Unlock()
+	cm.leaveAllGroups(conn.GetConnID())
+	cm.limiter.removeConn(conn.GetConnID())
 }
 
 // 得到一个连接
@@ -77,27 +125,220 @@ func (cm *ConnManager) Get(connId uint32) (ziface.IConnection, error) {
 
 // 总连接数
 func (cm *ConnManager) Len() int {
+	cm.connLock.RLock()
+	defer cm.connLock.RUnlock()
 	return len(cm.conns)
 }
 
 // 终止并清楚所有连接，关闭服务器时
+// 这里只负责关闭连接，连接在Stop 时会把自己放进 ConnMgrChan，再由 ConnManage 从集合中删除并调用 OnConnStop
 func (cm *ConnManager) Clear() {
-	// 保护共享资源 map，加 写锁
-	cm.connLock.Lock()
-	defer cm.connLock.Unlock()
-	for connId, conn := range cm.conns {
+	// 先拷贝一份再关闭，不能在持有锁的时候调用 Stop，否则 ConnManage 删除连接时拿不到锁，ConnMgrChan 写满后就会死锁
+	cm.connLock.RLock()
+	conns := make([]ziface.IConnection, 0, len(cm.conns))
+	for _, conn := range cm.conns {
+		conns = append(conns, conn)
+	}
+	cm.connLock.RUnlock()
+	for _, conn := range conns {
 		conn.Stop()
-		delete(cm.conns, connId)
 	}
 	logrus.Infoln("Clear All connections successfully! ")
 }
 
+// 关闭超过 timeout 没有收到数据的连接，filter 不为 nil 时只检查它返回 true 的连接（比如只清理 UDP 会话），返回关闭的连接数
+func (cm *ConnManager) SweepIdle(timeout time.Duration, filter func(ziface.IConnection) bool) int {
+	// 与 Clear 一样，不能在持有锁的时候调用 Stop
+	cm.connLock.RLock()
+	idle := make([]ziface.IConnection, 0)
+	for _, conn := range cm.conns {
+		if filter != nil && !filter(conn) {
+			continue
+		}
+		if time.Since(conn.GetLastActiveTime()) > timeout {
+			idle = append(idle, conn)
+		}
+	}
+	cm.connLock.RUnlock()
+	for _, conn := range idle {
+		conn.Stop()
+	}
+	return len(idle)
+}
+
+// 等待所有连接都从连接管理器中删除，最多等待 timeout，然后结束 ConnManage 方法
+func (cm *ConnManager) Stop(timeout time.Duration) {
+	timedOut := false
+	timer := time.AfterFunc(timeout, func() {
+		cm.connLock.Lock()
+		timedOut = true
+		cm.emptyCond.Broadcast()
+		cm.connLock.Unlock()
+	})
+	cm.connLock.Lock()
+	for len(cm.conns) > 0 && !timedOut {
+		cm.emptyCond.Wait()
+	}
+	cm.connLock.Unlock()
+	timer.Stop()
+	close(cm.exitChan)
+}
+
+// 设置限流规则：scope 指定按连接还是按 IP 计算，msgID 为 RateLimitAllMsgs 时限制所有消息的总量，否则只限制这个消息ID
+func (cm *ConnManager) SetRateLimit(scope ziface.RateLimitScope, msgID uint32, limit ziface.RateLimit) {
+	cm.limiter.set(scope, msgID, limit)
+}
+
+// 删除限流规则
+func (cm *ConnManager) RemoveRateLimit(scope ziface.RateLimitScope, msgID uint32) {
+	cm.limiter.remove(scope, msgID)
+}
+
+// 得到限流的统计数据
+func (cm *ConnManager) GetRateLimitStats() ziface.RateLimitStats {
+	return cm.limiter.stats()
+}
+
 // 得到 与连接管理器通信的通道
 func (cm *ConnManager) GetConnMgrChan() chan ziface.IConnection {
 	return cm.ConnMgrChan
 }
 
+// 得到 连接管理器退出时关闭的通道，关闭后连接不能再向 ConnMgrChan 写入
+func (cm *ConnManager) GetExitChan() <-chan bool {
+	return cm.exitChan
+}
+
 // 设置连接管理模块对应的server
 func (cm *ConnManager) SetServer(s ziface.IServer) {
 	cm.server = s
 }
+
+// 给所有连接发送消息，返回消息成功放进发送队列的连接数
+func (cm *ConnManager) Broadcast(msgID uint32, data []byte) int {
+	cm.connLock.RLock()
+	conns := make([]ziface.IConnection, 0, len(cm.conns))
+	for _, conn := range cm.conns {
+		conns = append(conns, conn)
+	}
+	cm.connLock.RUnlock()
+	return sendAll(conns, msgID, data)
+}
+
+// 给指定的连接发送消息，找不到的连接ID 会被忽略，返回消息成功放进发送队列的连接数
+func (cm *ConnManager) SendTo(connIDs []uint32, msgID uint32, data []byte) int {
+	cm.connLock.RLock()
+	conns := make([]ziface.IConnection, 0, len(connIDs))
+	for _, connID := range connIDs {
+		if conn, has := cm.conns[connID]; has {
+			conns = append(conns, conn)
+		}
+	}
+	cm.connLock.RUnlock()
+	return sendAll(conns, msgID, data)
+}
+
+// 把连接加入一个组，组不存在时自动创建。连接断开时会自动离开所有的组
+func (cm *ConnManager) JoinGroup(group string, conn ziface.IConnection) error {
+	cm.groupLock.Lock()
+	defer cm.groupLock.Unlock()
+	// 在锁内判断，连接关闭后 Remove 一定会在这之后把它从组中删除，不会留在组里
+	if !conn.IsAlive() {
+		return fmt.Errorf("connection id : %d is closed", conn.GetConnID())
+	}
+	members, has := cm.groups[group]
+	if !has {
+		members = make(map[uint32]ziface.IConnection)
+		cm.groups[group] = members
+	}
+	members[conn.GetConnID()] = conn
+	if cm.connGroups[conn.GetConnID()] == nil {
+		cm.connGroups[conn.GetConnID()] = make(map[string]struct{})
+	}
+	cm.connGroups[conn.GetConnID()][group] = struct{}{}
+	return nil
+}
+
+// 让连接离开一个组，组内没有连接时删除这个组
+func (cm *ConnManager) LeaveGroup(group string, conn ziface.IConnection) {
+	cm.groupLock.Lock()
+	defer cm.groupLock.Unlock()
+	cm.leaveGroup(group, conn.GetConnID())
+}
+
+// 得到组内的所有连接
+func (cm *ConnManager) GetGroupMembers(group string) []ziface.IConnection {
+	cm.groupLock.RLock()
+	defer cm.groupLock.RUnlock()
+	members := make([]ziface.IConnection, 0, len(cm.groups[group]))
+	for _, conn := range cm.groups[group] {
+		members = append(members, conn)
+	}
+	return members
+}
+
+// 得到所有组的名称
+func (cm *ConnManager) GetGroups() []string {
+	cm.groupLock.RLock()
+	defer cm.groupLock.RUnlock()
+	groups := make([]string, 0, len(cm.groups))
+	for group := range cm.groups {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// 给组内的所有连接发送消息，返回消息成功放进发送队列的连接数
+func (cm *ConnManager) SendToGroup(group string, msgID uint32, data []byte) int {
+	return sendAll(cm.GetGroupMembers(group), msgID, data)
+}
+
+// 需要持有 groupLock
+func (cm *ConnManager) leaveGroup(group string, connID uint32) {
+	if members, has := cm.groups[group]; has {
+		delete(members, connID)
+		if len(members) == 0 {
+			delete(cm.groups, group)
+		}
+	}
+	if groups, has := cm.connGroups[connID]; has {
+		delete(groups, group)
+		if len(groups) == 0 {
+			delete(cm.connGroups, connID)
+		}
+	}
+}
+
+// 把连接从它加入的所有组中删除
+func (cm *ConnManager) leaveAllGroups(connID uint32) {
+	cm.groupLock.Lock()
+	defer cm.groupLock.Unlock()
+	for group := range cm.connGroups[connID] {
+		cm.leaveGroup(group, connID)
+	}
+}
+
+// 给每个连接发送，发送队列满的连接直接跳过，一个慢的连接不会拖住其他连接，返回成功放进发送队列的连接数。
+// 使用 DataPack 的连接按帧格式版本和压缩算法分组，每组只封包一次，组内的连接共用封好的缓冲；其他连接用 TrySendMsg 各自封包
+func sendAll(conns []ziface.IConnection, msgID uint32, data []byte) int {
+	sent := 0
+	packed := make(map[broadcastKey]*sharedBuffer)
+	for _, conn := range conns {
+		var err error
+		// 心跳包要走优先队列，不共用
+		if c, ok := conn.(*Connection); ok && c.poolBuffers && msgID != utils.MSGID_HEARTBEAT {
+			err = c.sendShared(msgID, data, packed)
+		} else {
+			err = conn.TrySendMsg(msgID, uint32(len(data)), data)
+		}
+		if err != nil {
+			logrus.Debugf("给连接 %d 发送消息 msgId = %d 出错: %v", conn.GetConnID(), msgID, err)
+			continue
+		}
+		sent++
+	}
+	for _, shared := range packed {
+		shared.release()
+	}
+	return sent
+}
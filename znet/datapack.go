@@ -1,11 +1,10 @@
 package znet
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"net"
 
 	"github.com/myZinx/utils"
 	"github.com/myZinx/ziface"
@@ -21,50 +20,101 @@ TLV 格式， [TYPE | HEADER LENGTH | BODY LENGTH | HEADER | BODY ]
 type DataPack struct {
 }
 
+// v2 的帧开头不是 magic 和版本号，说明数据流已经错位了
+var errBadFrameHead = errors.New("bad v2 frame head")
+
 func NewDataPack() *DataPack {
 	return &DataPack{}
 }
-func (dp *DataPack) GetFixedHeadLen() uint32 { // 得到应用层包头总长，固定头部的长度
+func (dp *DataPack) GetHeadLen() uint32 { // 得到应用层包头总长，固定头部的长度（v1 的长度，也是最短的包头）
 	return MsgHeaderLength
 }
 
-// 相当于结构体的序列化
+// 相当于结构体的序列化，按消息的版本选择 v1 或 v2 的帧格式。
+// 返回的缓冲来自缓冲池，Connection 的 writer 写完之后会还回去；其他调用方不用管，不还也只是交给 GC 回收
 func (dp *DataPack) Pack(msg ziface.IMessage) ([]byte, error) {
-	buf := bytes.NewBuffer([]byte{}) // 创建一个空的缓冲
-	// 把 msg 对象的所有成员 按顺序写入缓冲
-	if err := binary.Write(buf, binary.LittleEndian, msg.GetMsgId()); err != nil {
-		return nil, err
+	headLen := MsgHeaderLength
+	if msg.GetVersion() == MsgVersion2 {
+		headLen = MsgHeaderLengthV2
 	}
-	if err := binary.Write(buf, binary.LittleEndian, msg.GetLength()); err != nil {
-		return nil, err
+	data := msg.GetData()
+	buf := getBuffer(int(headLen) + len(data))
+	head := buf
+	// v2 的包头在 v1 的前面多了 magic、version、flags、reserved、seq id
+	if msg.GetVersion() == MsgVersion2 {
+		head[0], head[1], head[2], head[3] = MsgMagic, MsgVersion2, msg.GetFlags(), 0
+		binary.LittleEndian.PutUint32(head[4:], msg.GetSeqId())
+		head = head[8:]
 	}
-	if err := binary.Write(buf, binary.LittleEndian, msg.GetData()); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	// 把 msg 对象的所有成员 按顺序写入缓冲
+	binary.LittleEndian.PutUint32(head[0:], msg.GetMsgId())
+	binary.LittleEndian.PutUint32(head[4:], msg.GetLength())
+	copy(buf[headLen:], data)
+	return buf, nil
 }
 
-// 相当于将字节切片反序列化为结构体
-func (dp *DataPack) Unpack(headData []byte, conn net.Conn) (ziface.IMessage, error) {
-	// 先读 head（len和id）的信息
-	buf := bytes.NewReader(headData)
-	msg := &Message{}
-	if err := binary.Read(buf, binary.LittleEndian, &msg.MsgId); err != nil {
-		return nil, err
+// 相当于将字节切片反序列化为结构体，先从 reader 中读出头部，再按照头部中的长度读出数据。按 v1 的帧格式拆包，
+// 连接协商出 v2 之后用 UnpackVersion。返回的消息和它的数据来自池，请求处理完后会被还回去（见 Request.Release）
+func (dp *DataPack) Unpack(reader io.Reader) (ziface.IMessage, error) {
+	return dp.UnpackVersion(reader, MsgVersion1)
+}
+
+// 按指定的帧格式版本拆包，版本由连接用 MSGID_FRAME_VERSION 协商，不根据帧的内容判断
+func (dp *DataPack) UnpackVersion(reader io.Reader, version uint8) (ziface.IMessage, error) {
+	msg := newPooledMessage()
+	msg.Version = version
+	headData := msg.head[:MsgHeaderLength]
+	if version == MsgVersion2 {
+		headData = msg.head[:MsgHeaderLengthV2]
 	}
-	if err := binary.Read(buf, binary.LittleEndian, &msg.Length); err != nil {
+	if _, err := io.ReadFull(reader, headData); err != nil { // 对端关闭的话，这里会收到EOF 的错误
+		freeMessage(msg)
 		return nil, err
 	}
+	if version == MsgVersion2 {
+		if headData[0] != MsgMagic || headData[1] != MsgVersion2 {
+			freeMessage(msg)
+			return nil, errBadFrameHead
+		}
+		// magic、version、flags、reserved，然后是 seq id
+		msg.Flags = headData[2]
+		msg.SeqId = binary.LittleEndian.Uint32(headData[4:])
+		headData = headData[8:]
+	}
+	// 再读 head（len和id）的信息
+	msg.MsgId = binary.LittleEndian.Uint32(headData[0:])
+	msg.Length = binary.LittleEndian.Uint32(headData[4:])
 	if msg.GetLength() > utils.GlobalObj.MaxFilePackageSize {
+		freeMessage(msg)
 		return nil, fmt.Errorf("收到的数据包长度太长，请检查msgid = %d", msg.GetMsgId())
 	}
-	msg.Data = make([]byte, msg.GetLength())
-	_, err := io.ReadFull(conn, msg.Data) // 继续读取消息内容
+	msg.Data = getBuffer(int(msg.GetLength()))
+	_, err := io.ReadFull(reader, msg.Data) // 继续读取消息内容
 	if err != nil {
 		if err != io.EOF {
 			logrus.Error("unpack message body err :", err)
 		}
+		freeMessage(msg)
 		return nil, err
 	}
 	return msg, nil
 }
+
+// 根据已经收到的数据算出第一个帧（version 版本的格式）的总长度（包头加数据），包头还没收全时返回 0。反应堆模式增量拆包时用它判断一个帧是否收全了
+func frameLength(data []byte, version uint8) (int, error) {
+	headLen, lengthOffset := MsgHeaderLength, 4
+	if version == MsgVersion2 {
+		headLen, lengthOffset = MsgHeaderLengthV2, 12
+	}
+	if len(data) < int(headLen) {
+		return 0, nil
+	}
+	if version == MsgVersion2 && (data[0] != MsgMagic || data[1] != MsgVersion2) {
+		return 0, errBadFrameHead
+	}
+	length := binary.LittleEndian.Uint32(data[lengthOffset:])
+	if length > utils.GlobalObj.MaxFilePackageSize {
+		return 0, fmt.Errorf("收到的数据包长度太长，请检查msgid = %d", binary.LittleEndian.Uint32(data[lengthOffset-4:]))
+	}
+	return int(headLen) + int(length), nil
+}
@@ -1,6 +1,9 @@
 package znet
 
 import (
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/myZinx/utils"
@@ -13,14 +16,27 @@ type HeartbeatChecher struct {
 	conn ziface.IConnection
 	// 该连接的心跳包发送间隔 `SendInterval`（每个连接的发送间隔不一样，因为如果有太多连接 100W个，所有连接同时发会引起较大的流量，随机间隔可以给网络减负）
 	SendInterval time.Duration
-	// 连接的上一次活跃时间 `LastActiveTime`（不仅心跳包，连接发送其他任何消息进行通信都会更新此数据）
-	LastActiveTime time.Time
+	// 连接的上一次活跃时间 `lastActiveTime`（UnixNano，不仅心跳包，连接发送其他任何消息进行通信都会更新此数据）。reader 写，时间轮读，用原子操作
+	lastActiveTime int64
 	// 构造心跳包的方法  `HeartbeatMsgMakeFunc`。（框架提供一个默认的，就写入一些文字。提供此属性的set方法给开发者）
 	HeartbeatMsgMakeFunc func(ziface.IConnection) []byte
 	// 收到心跳包的回包时的处理路由  `HeartbeatRouter`，要集成自baseRouter的。（框架提供一个默认的，就打印到日志。但提供此属性的set方法给开发者）
 	HeartbeatRouter ziface.IRouter
-	// 连接已经断开的信号通道（无阻塞）`ExitChan`。（因为定时发心跳包的程序肯定是另开的goroutine执行的，所以当连接断开，需要通信此gorontine结束，不要空等）
-	ExitChan chan bool
+	// 心跳检测器在共用的时间轮上的定时器 `timer`。（不再给每个连接开一个 goroutine 和 Ticker，6 万个连接也只有一个 goroutine 在推进时间轮）
+	timer *wheelTimer
+	// 是否已经 Stop，用原子操作。定时器可能已经取出来正要执行，靠它让已经关闭的心跳检测器不再发送
+	stopped int32
+	// 空闲超时 `IdleTimeout`：超过这么久没有收到对端的任何数据，就认为对端已经不在了（比如半开的 TCP 连接），为 0 时不检查
+	IdleTimeout time.Duration
+	// 最多允许连续丢失的心跳数 `MaxMissed`：连续这么多次发出心跳包之后都没有收到对端的任何数据，就认为对端已经不在了，为 0 时不检查
+	MaxMissed int
+	// IdleTimeout、MaxMissed 和下面发送心跳包、收到回复时记录的状态，时间轮、reader 和工作池都会访问，用 lock 保护
+	lock     sync.Mutex
+	nextSend time.Time     // 下一次发送心跳包的时间
+	lastSent time.Time     // 上一次发送心跳包的时间，还没发送过时为零值
+	seq      uint32        // 上一个心跳包的序列号，v2 的连接上对端回复时带上它，据此计算 RTT
+	rtt      time.Duration // 最近一次心跳包的往返时间，还没收到过回复时为 0
+	missed   int           // 连续丢失的心跳数
 	// 远程连接不存话时的处理方法  `OnRemoteNotAlive`。（框架提供一个默认的，就打印一些日志。但提供此属性的set方法给开发者）
 	OnRemoteNotAlive func(ziface.IConnection)
 }
@@ -29,11 +45,12 @@ func NewHeartbeatChecher(conn ziface.IConnection, sendInterval time.Duration) *H
 	return &HeartbeatChecher{
 		conn:                 conn,
 		SendInterval:         sendInterval,
-		LastActiveTime:       time.Now(),
+		lastActiveTime:       time.Now().UnixNano(),
 		HeartbeatMsgMakeFunc: heartbeatMsgMakeFunc,
 		HeartbeatRouter:      &HeartbeatDefaultRouter{},
-		ExitChan:             make(chan bool),
 		OnRemoteNotAlive:     onRemoteNotAlive,
+		IdleTimeout:          time.Duration(utils.GlobalObj.HeartbeatIdleTimeout) * time.Second,
+		MaxMissed:            utils.GlobalObj.MaxMissedHeartbeats,
 	}
 }
 
@@ -55,7 +72,7 @@ func (hbc *HeartbeatChecher) SetHeartbeatMsgMakeFunc(f func(ziface.IConnection)
 // 构造心跳包的默认方法
 func heartbeatMsgMakeFunc(conn ziface.IConnection) []byte {
 	msg := "来自[服务器]的心跳包"
-	logrus.Debugf("发送心跳包给客户端 %s", conn.GetTCPConnection().RemoteAddr())
+	logrus.Debugf("发送心跳包给客户端 %s", conn.RemoteAddr())
 	return []byte(msg)
 }
 
@@ -64,51 +81,157 @@ func (hbc *HeartbeatChecher) SetOnRemoteNotAlive(f func(ziface.IConnection)) {
 	hbc.OnRemoteNotAlive = f
 }
 
-// 远程连接不存话时的 默认处理方法，默认方法就只执行 Stop().
-func onRemoteNotAlive(conn ziface.IConnection) {
-	conn.Stop()
+// 远程连接不存话时的 默认处理方法，默认什么都不做：心跳检测器调用它之后会自己关闭连接
+func onRemoteNotAlive(conn ziface.IConnection) {}
+
+// 设置判断对端已经不在了的策略，idleTimeout 和 maxMissed 为 0 时不做对应的检查。连接运行中也可以设置（比如在 OnConnStart 中），下一次检查时生效
+func (hbc *HeartbeatChecher) SetDeadPeerPolicy(idleTimeout time.Duration, maxMissed int) {
+	hbc.lock.Lock()
+	defer hbc.lock.Unlock()
+	hbc.IdleTimeout = idleTimeout
+	hbc.MaxMissed = maxMissed
+}
+
+// 得到最近一次心跳包的往返时间，对端还没有回复过心跳包时（包括 v1 的连接）为 0
+func (hbc *HeartbeatChecher) GetRTT() time.Duration {
+	hbc.lock.Lock()
+	defer hbc.lock.Unlock()
+	return hbc.rtt
 }
 
-// 更新心跳检测器活跃时间的方法
+// 得到连续丢失的心跳数，每次发送心跳包时更新：上一个心跳包发出之后收到过对端的数据就清零
+func (hbc *HeartbeatChecher) GetMissCount() int {
+	hbc.lock.Lock()
+	defer hbc.lock.Unlock()
+	return hbc.missed
+}
+
+// 收到对端对心跳包的回复：序列号是最近一个心跳包的，就用它计算 RTT
+func (hbc *HeartbeatChecher) HandleReply(msg ziface.IMessage) {
+	hbc.lock.Lock()
+	defer hbc.lock.Unlock()
+	if msg.GetSeqId() != 0 && msg.GetSeqId() == hbc.seq && !hbc.lastSent.IsZero() {
+		hbc.rtt = time.Since(hbc.lastSent)
+	}
+}
+
+// 更新心跳检测器活跃时间的方法。每收到一个消息都会调用，所以只记录时间，不去碰时间轮的锁，检查时再读取
 func (hbc *HeartbeatChecher) UpdateActiveTime() {
-	hbc.LastActiveTime = time.Now()
+	atomic.StoreInt64(&hbc.lastActiveTime, time.Now().UnixNano())
 }
 
-// 该心跳检测器的Start 方法
+// 该心跳检测器的Start 方法，在共用的时间轮上每 SendInterval 发送一次心跳包，并按策略检查对端是否还在
 func (hbc *HeartbeatChecher) Start() {
-	go func() { // 开启此心跳检测器
-		ticker := time.NewTicker(hbc.SendInterval)
-		for {
-			select {
-			case <-ticker.C:
-				if hbc.conn == nil {
-					logrus.Warn("该计时器没有绑定连接!")
-				} else {
-					if !hbc.conn.IsAlive() {
-						// 连接已经不存在了，关闭本心跳检测器即可
-						hbc.OnRemoteNotAlive(hbc.conn)
-					} else {
-						hbc.SendHeartbeat()
-					}
-				}
-			case <-hbc.ExitChan:
-				ticker.Stop()
-				return
-			}
+	hbc.lock.Lock()
+	if atomic.LoadInt32(&hbc.stopped) == 1 { // 连接刚建立就关闭了，Stop 比 Start 先执行
+		hbc.lock.Unlock()
+		return
+	}
+	hbc.nextSend = time.Now().Add(hbc.SendInterval)
+	timer := getHeartbeatWheel().newTimer(hbc.check)
+	hbc.timer = timer
+	hbc.lock.Unlock()
+	// 这时 Stop 了的话定时器还会到期一次，check 看到已经 Stop 就不再设置
+	timer.Reset(hbc.nextCheck(time.Now()))
+}
+
+// 定时器到期时在时间轮的 goroutine 中执行：先按空闲超时和丢失的心跳数检查对端是否还在，然后到了时间就发送心跳包，最后等待下一次检查。
+// 收到数据时 UpdateActiveTime 不去重新设置定时器，空闲超时的检查在这里按最新的活跃时间重新计算，相当于重新设置了定时器。
+// 心跳包走连接的优先队列，队列满时直接丢弃，不会阻塞时间轮
+func (hbc *HeartbeatChecher) check() {
+	if atomic.LoadInt32(&hbc.stopped) == 1 {
+		return
+	}
+	if hbc.conn == nil {
+		logrus.Warn("该计时器没有绑定连接!")
+		hbc.timer.Reset(hbc.SendInterval)
+		return
+	}
+	if !hbc.conn.IsAlive() {
+		return // 连接已经关闭了，不用再检查
+	}
+	now := time.Now()
+	lastActive := time.Unix(0, atomic.LoadInt64(&hbc.lastActiveTime))
+	hbc.lock.Lock()
+	idleTimeout, maxMissed := hbc.IdleTimeout, hbc.MaxMissed
+	if idleTimeout > 0 && now.Sub(lastActive) >= idleTimeout {
+		hbc.lock.Unlock()
+		hbc.remoteNotAlive(fmt.Sprintf("%v 没有收到数据", now.Sub(lastActive).Round(time.Millisecond)))
+		return
+	}
+	send := !now.Before(hbc.nextSend)
+	if send {
+		// 上一个心跳包发出之后一直没有收到对端的数据，算丢失一次
+		if !hbc.lastSent.IsZero() && lastActive.Before(hbc.lastSent) {
+			hbc.missed++
+		} else {
+			hbc.missed = 0
 		}
+		hbc.nextSend = now.Add(hbc.SendInterval)
+	}
+	missed := hbc.missed
+	hbc.lock.Unlock()
+	if maxMissed > 0 && missed >= maxMissed {
+		hbc.remoteNotAlive(fmt.Sprintf("连续丢失 %d 个心跳", missed))
+		return
+	}
+	if send {
+		hbc.SendHeartbeat()
+	}
+	hbc.timer.Reset(hbc.nextCheck(now))
+}
+
+// 距离下一次检查的时间：下一次发送心跳包和空闲超时两者中较早的那个
+func (hbc *HeartbeatChecher) nextCheck(now time.Time) time.Duration {
+	hbc.lock.Lock()
+	next, idleTimeout := hbc.nextSend, hbc.IdleTimeout
+	hbc.lock.Unlock()
+	if idleTimeout > 0 {
+		if deadline := time.Unix(0, atomic.LoadInt64(&hbc.lastActiveTime)).Add(idleTimeout); deadline.Before(next) {
+			next = deadline
+		}
+	}
+	return next.Sub(now)
+}
+
+// 认为对端已经不在了：先调用 OnRemoteNotAlive，再关闭连接。放到另外的 goroutine 中，开发者的处理方法不会拖慢时间轮
+func (hbc *HeartbeatChecher) remoteNotAlive(reason string) {
+	logrus.Warnf("连接 %d 的对端 %v 已经不在了（%s），关闭连接", hbc.conn.GetConnID(), hbc.conn.RemoteAddr(), reason)
+	go func() {
+		hbc.OnRemoteNotAlive(hbc.conn)
+		hbc.conn.Stop()
 	}()
 }
 
-// 该心跳检测器的Stop 方法
+// 该心跳检测器的Stop 方法，把定时器从时间轮上取下来。reader 出错时可能和 Start 同时调用，用 lock 保护定时器
 func (hbc *HeartbeatChecher) Stop() {
 	logrus.Debugf("关闭 连接 id = %d 的心跳检测器 \n", hbc.conn.GetConnID())
-	hbc.ExitChan <- true
+	hbc.lock.Lock()
+	atomic.StoreInt32(&hbc.stopped, 1)
+	timer := hbc.timer
+	hbc.lock.Unlock()
+	if timer != nil {
+		timer.Stop()
+	}
 }
 
-// 发送心跳包的方法 （这个方法就没有必要交给用户去自定义了）
+// 发送心跳包的方法 （这个方法就没有必要交给用户去自定义了）。
+// 心跳包带上序列号，v2 的连接上对端回复时带回来，用来计算 RTT；v1 的帧不带序列号，只能靠收到的数据判断对端还在
 func (hbc *HeartbeatChecher) SendHeartbeat() error {
 	msg := hbc.HeartbeatMsgMakeFunc(hbc.conn)
-	err := hbc.conn.SendMsg(utils.MSGID_HEARTBEAT, uint32(len(msg)), msg)
+	hbc.lock.Lock()
+	if hbc.seq++; hbc.seq == 0 { // 序列号 0 表示没有序列号，跳过
+		hbc.seq++
+	}
+	seq := hbc.seq
+	hbc.lastSent = time.Now()
+	hbc.lock.Unlock()
+	err := hbc.conn.SendMessage(&Message{
+		SeqId:  seq,
+		MsgId:  utils.MSGID_HEARTBEAT,
+		Length: uint32(len(msg)),
+		Data:   msg,
+	})
 	if err != nil {
 		logrus.Error("心跳发送出错：err = ", err)
 		return err
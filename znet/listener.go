@@ -0,0 +1,175 @@
+package znet
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+一个 Server 可以同时在多个地址上监听（比如内网和外网各一个，或者 IPv4 和 IPv6 各一个），所有监听器共用同一个
+MsgHandler 和 ConnMgr。每个连接都会记录它是从哪个监听器进来的（IConnection.GetListenerName），router 可以据此区别对待。
+Server 自己的 IPVersion、IP、Port（或 UnixPath）就是名为 DefaultListenerName 的监听器
+*/
+
+// 内置的监听器名称
+const (
+	DefaultListenerName   = "default"   // IPVersion、IP、Port 对应的监听器
+	WebSocketListenerName = "websocket" // WebSocket 的连接
+	UDPListenerName       = "udp"       // UDP 的会话
+)
+
+// server 的一个监听器
+type serverListener struct {
+	name      string
+	network   string      // "tcp4"、"tcp"、"tcp6" 或 "unix"
+	address   string      // IP:Port，unix 时是 socket 路径
+	tlsConfig *tls.Config // 不为 nil 时这个监听器上的连接使用 TLS
+	// Start 之前添加的监听器在 Start 时才开始监听，在此之前为 nil
+	listenner net.Listener
+}
+
+// 添加一个监听器，name 不能重复。Start 之前添加的在 Start 时开始监听，Start 之后添加的立即开始监听并接收连接
+func (s *Server) AddListener(name string, network string, address string, tlsConfig *tls.Config) error {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	if _, has := s.listeners[name]; has {
+		return fmt.Errorf("listener %s already exists", name)
+	}
+	if s.isStopping() {
+		return errors.New("server is stopped")
+	}
+	l := &serverListener{name: name, network: network, address: address, tlsConfig: tlsConfig}
+	if s.started {
+		if err := s.openListener(l); err != nil {
+			return err
+		}
+		go s.acceptLoop(l)
+	}
+	s.listeners[name] = l
+	return nil
+}
+
+// 删除一个监听器并停止监听，已经从它建立的连接不受影响
+func (s *Server) RemoveListener(name string) error {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	l, has := s.listeners[name]
+	if !has {
+		return fmt.Errorf("listener %s NOT FOUND", name)
+	}
+	delete(s.listeners, name)
+	closeListener(l)
+	return nil
+}
+
+// 得到所有监听器的名称
+func (s *Server) GetListenerNames() []string {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	names := make([]string, 0, len(s.listeners))
+	for name := range s.listeners {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Start 时打开所有的监听器，有一个失败就关闭已经打开的并返回错误。需要持有 listenerLock
+func (s *Server) openAllListeners() error {
+	// 默认的监听器
+	if _, has := s.listeners[DefaultListenerName]; !has {
+		address := net.JoinHostPort(s.IP, strconv.Itoa(s.Port))
+		if s.IPVersion == "unix" {
+			address = s.UnixPath
+		}
+		s.listeners[DefaultListenerName] = &serverListener{name: DefaultListenerName, network: s.IPVersion, address: address, tlsConfig: s.TLSConfig}
+	}
+	for _, l := range s.listeners {
+		if err := s.openListener(l); err != nil {
+			s.closeAllListeners()
+			return err
+		}
+	}
+	return nil
+}
+
+// 关闭所有的监听器。需要持有 listenerLock
+func (s *Server) closeAllListeners() {
+	for _, l := range s.listeners {
+		closeListener(l)
+	}
+}
+
+// 按监听器的网络开始监听，配置了 TLS 的话在外面包一层 TLS
+func (s *Server) openListener(l *serverListener) error {
+	var rawListenner net.Listener
+	switch l.network {
+	case "tcp", "tcp4", "tcp6":
+		// 获取一个 TCP 的addr
+		addr, err := net.ResolveTCPAddr(l.network, l.address)
+		if err != nil {
+			return err
+		}
+		tcpListenner, err := net.ListenTCP(l.network, addr)
+		if err != nil {
+			return err
+		}
+		rawListenner = tcpListenner
+	case "unix":
+		if l.address == "" {
+			return errors.New("unix socket path is empty")
+		}
+		unixListenner, err := listenUnix(l.address)
+		if err != nil {
+			return err
+		}
+		rawListenner = unixListenner
+	default:
+		return fmt.Errorf("unsupported network %q", l.network)
+	}
+	l.listenner = rawListenner
+	if l.tlsConfig != nil {
+		l.listenner = tls.NewListener(rawListenner, l.tlsConfig)
+		logrus.Infof("[start] Server %s listener %s uses TLS, client auth = %v", s.Name, l.name, l.tlsConfig.ClientAuth)
+	}
+	logrus.Infof("[start] Server %s Listenner %s at %s %s is started", s.Name, l.name, l.network, rawListenner.Addr())
+	return nil
+}
+
+// 关闭监听器，Unix domain socket 还要删除 socket 文件
+func closeListener(l *serverListener) {
+	if l.listenner == nil {
+		return
+	}
+	l.listenner.Close()
+	if l.network == "unix" {
+		removeUnixSocket(l.address)
+	}
+}
+
+// 阻塞，等待客户端连接，处理客户端连接业务，读写。监听器被关闭后返回
+func (s *Server) acceptLoop(l *serverListener) {
+	for {
+		// 如果有客户端连接，此函数便有返回了，然后将conn传给我们自定的连接对象
+		conn, err := l.listenner.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) { // Stop 或 RemoveListener 关闭了 listenner，不再接收新的连接
+				logrus.Infof("[stop] Server %s Listenner %s at %s %s is closed", s.Name, l.name, l.network, l.address)
+				return
+			}
+			logrus.Warnf("connection accept err: %v\n", err)
+			continue
+		}
+		// 检查黑白名单、接收速率、总连接数和该 IP 的连接数，被拒绝的连接交给 OnConnReject 后关闭，不阻塞接收
+		if reason, ok := s.admitConn(conn.RemoteAddr()); !ok {
+			go s.rejectConn(conn, reason)
+			continue
+		}
+		// 每个客户端应该异步开启连接，所以这里需要使用 goroutine（TLS 握手也不能阻塞等待其他连接）
+		go s.handleConn(conn, l.name)
+	}
+}
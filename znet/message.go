@@ -1,28 +1,97 @@
 package znet
 
+import (
+	"sync"
+
+	"github.com/myZinx/ziface"
+)
+
 /*
 定义应用层的消息结构体来解决粘包的问题
 将请求的消息封装在message中
-TLV 格式的应用层数据
+TLV 格式的应用层数据，有两种帧格式。连接开始时双方都用 v1，想用 v2 的一端（一般是客户端）先发一个 v1 的 MSGID_FRAME_VERSION 帧，
+之后它发出的帧都是 v2；对端收到后回复一个 v1 的 MSGID_FRAME_VERSION 帧，之后它发出的帧也都是 v2。
+每个方向上，握手帧之前的帧按 v1 解析，之后的帧按 v2 解析，不会根据帧的内容去猜是哪个版本：
+
+v1（旧格式，老的客户端仍然使用）：
 +--------+-------------+-------------+--------------+--------------+
 |  TYPE  |           LENGTH          |            VALUE            |
 +--------+-------------+-------------+--------------+--------------+
 | Msg ID |           length          |            content          |
 +--------+-------------+-------------+--------------+--------------+
-| 4 byte |           8 byte          |          xxxxxxxxxxxxx      |
+| 4 byte |           4 byte          |          xxxxxxxxxxxxx      |
 +--------+-------------+-------------+--------------+--------------+
+
+v2（新格式）：
++--------+---------+--------+----------+--------+--------+--------+---------------+
+| magic  | version | flags  | reserved | seq id | Msg ID | length |    content    |
++--------+---------+--------+----------+--------+--------+--------+---------------+
+| 1 byte | 1 byte  | 1 byte |  1 byte  | 4 byte | 4 byte | 4 byte | xxxxxxxxxxxxx |
++--------+---------+--------+----------+--------+--------+--------+---------------+
+v2 的第一个字节是 MsgMagic，第二个字节是 MsgVersion2，拆包时用来检查帧是否完整正确。
+flags 是下面定义的 MsgFlagXxx 的组合，seq id 用来把回复和请求对应起来。
+
 对于普通文本消息，head content 是没有的。
 对于传输文件消息，head content 可以放文件大小，文件名等信息。
 但其实发文件的过程不是只调用Pack就行，而是把MsgId，Length 准备好，content 不写。
 然后用 io.Copy把文件发过去
 */
 type Message struct {
-	MsgId  uint32
-	Length uint32
-	Data   []byte
+	Version uint8 // 帧格式的版本，为 0 时由连接按协商的版本填充
+	Flags   uint8 // 标志位，只有 v2 格式才会发出去
+	SeqId   uint32
+	MsgId   uint32
+	Length  uint32
+	Data    []byte
+
+	head   [16]byte // 拆包时读包头用的缓冲（v2 包头的长度），放在消息里不用每次单独分配
+	pooled bool     // 消息和 Data 是否来自池（由 DataPack.Unpack 创建），是的话请求处理完后还回去
 }
 
-var MsgHeaderLength uint32 = 8 // 数据包的总的包头长度，包括type和length（固定头部长度）
+// 拆包时使用的消息池
+var msgPool = sync.Pool{
+	New: func() any {
+		return &Message{}
+	},
+}
+
+// 从消息池中取一个消息，Data 需要调用方用 getBuffer 分配
+func newPooledMessage() *Message {
+	msg := msgPool.Get().(*Message)
+	msg.pooled = true
+	return msg
+}
+
+// 把消息和它的 Data 还回池中，之后不能再使用它们。不是从池中取的消息会被忽略
+func freeMessage(msg ziface.IMessage) {
+	m, ok := msg.(*Message)
+	if !ok || !m.pooled {
+		return
+	}
+	if m.Data != nil {
+		putBuffer(m.Data)
+	}
+	*m = Message{}
+	msgPool.Put(m)
+}
+
+const (
+	MsgVersion1 uint8 = 1
+	MsgVersion2 uint8 = 2
+
+	MsgMagic uint8 = 0xA5 // v2 帧的第一个字节
+)
+
+// v2 帧的标志位
+const (
+	MsgFlagCompressed  uint8 = 1 << iota // 数据经过压缩
+	MsgFlagEncrypted                     // 数据经过加密
+	MsgFlagResponse                      // 这是对某个请求的回复，seq id 与请求的相同
+	MsgFlagStreamChunk                   // 这是流式传输中的一块数据
+)
+
+var MsgHeaderLength uint32 = 8    // 数据包的总的包头长度，包括type和length（固定头部长度）
+var MsgHeaderLengthV2 uint32 = 16 // v2 数据包的包头长度
 
 func (m *Message) GetMsgId() uint32 {
 	return m.MsgId
@@ -39,3 +108,29 @@ func (m *Message) GetData() []byte {
 func (m *Message) SetBodyContent(buf []byte) {
 	m.Data = buf
 }
+
+func (m *Message) GetVersion() uint8 {
+	return m.Version
+}
+func (m *Message) SetVersion(version uint8) {
+	m.Version = version
+}
+
+func (m *Message) GetFlags() uint8 {
+	return m.Flags
+}
+func (m *Message) SetFlags(flags uint8) {
+	m.Flags = flags
+}
+
+// 是否设置了某个标志位
+func (m *Message) HasFlag(flag uint8) bool {
+	return m.Flags&flag != 0
+}
+
+func (m *Message) GetSeqId() uint32 {
+	return m.SeqId
+}
+func (m *Message) SetSeqId(seqId uint32) {
+	m.SeqId = seqId
+}
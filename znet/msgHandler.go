@@ -1,6 +1,13 @@
 package znet
 
 import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/myZinx/utils"
 	"github.com/myZinx/ziface"
 	"github.com/sirupsen/logrus"
 )
@@ -9,20 +16,112 @@ import (
 type MessageHandler struct {
 	// 每一个消息ID所对应的处理方法
 	Apis map[uint32]ziface.IRouter
+	// 每一个消息ID 的处理超时时间，没有设置的就不超时
+	Timeouts map[uint32]time.Duration
+	// 全局的中间件，所有消息都会按顺序经过
+	Middlewares []ziface.MiddlewareFunc
+	// 每一个消息ID 自己的中间件，在全局中间件之后执行
+	MsgMiddlewares map[uint32][]ziface.MiddlewareFunc
+	// 工作池中 worker 的数量，为 0 表示不使用工作池，每个消息单独开一个 goroutine 去处理（旧的模式）
+	WorkerPoolSize uint32
+	// 每个 worker 对应的任务队列，队列是有界的，队列满了之后写入方（连接的 reader）会阻塞，形成背压
+	TaskQueue []chan ziface.IRequest
+	// 不交给工作池的消息ID（比如传输整个文件的 FILE_REQUEST），它们处理得很慢，放在 worker 中会拖住分到同一个 worker 的所有连接
+	AsyncMsgIDs map[uint32]bool
+	// 保护 Apis、Timeouts、Middlewares、MsgMiddlewares 和 AsyncMsgIDs，server 运行中也可以添加 router、中间件和修改设置
+	apiLock sync.RWMutex
+	// 每个连接在工作池之外排队处理的请求，key 是 ConnID。连接有这样的请求时才启动一个 goroutine 按顺序处理，处理完就退出
+	asyncQueues map[uint32][]ziface.IRequest
+	asyncLock   sync.Mutex // 保护 asyncQueues
+	// 已经交给 MessageHandler 但还没处理完的请求数（包括在任务队列中排队的），关闭服务器时用来等待请求处理完成
+	inFlight int64
+	// 是否正在关闭，为 1 时不再接收新的请求
+	closing int32
+	// 正在关闭并且所有请求都处理完之后关闭，Drain 等待它
+	drained   chan struct{}
+	drainOnce sync.Once
+	// 关闭工作池的通道，关闭它所有 worker 都会退出
+	exitChan chan bool
 }
 
 func NewMessageHandler() *MessageHandler {
 	return &MessageHandler{
-		Apis: make(map[uint32]ziface.IRouter),
+		Apis:           make(map[uint32]ziface.IRouter),
+		Timeouts:       make(map[uint32]time.Duration),
+		MsgMiddlewares: make(map[uint32][]ziface.MiddlewareFunc),
+		AsyncMsgIDs:    make(map[uint32]bool),
+		asyncQueues:    make(map[uint32][]ziface.IRequest),
+		WorkerPoolSize: utils.GlobalObj.WorkerPoolSize,
+		TaskQueue:      make([]chan ziface.IRequest, utils.GlobalObj.WorkerPoolSize),
+		exitChan:       make(chan bool),
+		drained:        make(chan struct{}),
 	}
 }
 
 // 调度，执行对应的router消息处理方法
 func (m *MessageHandler) DoMsgHandler(req ziface.IRequest) {
 	msgId := req.GetMsgId()
-	handler, has := m.Apis[msgId]
-	if !has {
-		logrus.Warnf("[WARNING] api msg id [%d] is NOT FOUND! need register!", msgId)
+	// 任何一个 router 或中间件 panic 都不能让整个服务器崩溃，在这里恢复，worker 也能继续工作
+	defer func() {
+		if r := recover(); r != nil {
+			m.handlePanic(req, r)
+		}
+	}()
+	// 在读锁内取出这个消息要用的 router、超时时间和中间件，之后的修改只对下一个消息生效
+	m.apiLock.RLock()
+	router := m.Apis[msgId]
+	timeout := m.Timeouts[msgId]
+	var chain []ziface.MiddlewareFunc
+	if len(m.Middlewares) > 0 || len(m.MsgMiddlewares[msgId]) > 0 {
+		// 先经过全局中间件，再经过该消息ID 的中间件，最后才是 router
+		chain = make([]ziface.MiddlewareFunc, 0, len(m.Middlewares)+len(m.MsgMiddlewares[msgId]))
+		chain = append(chain, m.Middlewares...)
+		chain = append(chain, m.MsgMiddlewares[msgId]...)
+	}
+	m.apiLock.RUnlock()
+	// 设置了超时时间的消息，在连接上下文的基础上派生一个带超时的上下文
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req.SetContext(ctx)
+	}
+	// 没有中间件时直接交给 router，不用构造中间件链
+	if len(chain) == 0 {
+		callRouter(router, req)
+		return
+	}
+	index := 0
+	var next func() error
+	next = func() error {
+		if index < len(chain) {
+			middleware := chain[index]
+			index++
+			return middleware(req, next)
+		}
+		callRouter(router, req)
+		return nil
+	}
+	if err := next(); err != nil {
+		// 中间件返回了错误，把错误信息回复给对端
+		logrus.Debugf("[connId: %d | msgId: %d] 中间件返回错误: %v", req.GetConnection().GetConnID(), msgId, err)
+		// 带上请求的序列号和回复标志，对端如果在 Call 中等待这个请求，会直接得到这个错误
+		errMsg := []byte(err.Error())
+		if err := req.GetConnection().SendMessage(&Message{
+			Flags:  MsgFlagResponse,
+			SeqId:  req.GetMessage().GetSeqId(),
+			MsgId:  utils.MSGID_ERROR,
+			Length: uint32(len(errMsg)),
+			Data:   errMsg,
+		}); err != nil {
+			logrus.Error("回复中间件的错误信息出错， err= ", err)
+		}
+	}
+}
+
+// 调用消息ID 对应的 router
+func callRouter(handler ziface.IRouter, req ziface.IRequest) {
+	if handler == nil {
+		logrus.Warnf("[WARNING] api msg id [%d] is NOT FOUND! need register!", req.GetMsgId())
 		return
 	}
 	handler.PreHandle(req)
@@ -32,5 +131,188 @@ func (m *MessageHandler) DoMsgHandler(req ziface.IRequest) {
 
 // 给server添加具体的router 处理逻辑
 func (m *MessageHandler) AddRouter(msgID uint32, router ziface.IRouter) {
+	m.apiLock.Lock()
+	defer m.apiLock.Unlock()
 	m.Apis[msgID] = router
 }
+
+// 处理 router 发生的 panic：打印日志和调用栈，按配置关闭该连接，再调用server 的 OnHandlerPanic 钩子函数
+func (m *MessageHandler) handlePanic(req ziface.IRequest, r any) {
+	conn := req.GetConnection()
+	logrus.Errorf("[connId: %d | msgId: %d] router handle panic: %v\n%s", conn.GetConnID(), req.GetMsgId(), r, debug.Stack())
+	if utils.GlobalObj.ClosePanicConn {
+		conn.Stop()
+	}
+	if server := conn.GetServer(); server != nil {
+		// 用户的钩子函数再 panic 也不能影响到 worker
+		defer func() {
+			if r := recover(); r != nil {
+				logrus.Errorf("[connId: %d | msgId: %d] OnHandlerPanic panic: %v", conn.GetConnID(), req.GetMsgId(), r)
+			}
+		}()
+		server.CallOnHandlerPanic(req, r)
+	}
+}
+
+// 添加全局的中间件，对所有消息生效（包括内置的心跳、PING、文件请求等router），按添加的顺序执行
+func (m *MessageHandler) Use(middlewares ...ziface.MiddlewareFunc) {
+	m.apiLock.Lock()
+	defer m.apiLock.Unlock()
+	m.Middlewares = append(m.Middlewares, middlewares...)
+}
+
+// 添加只对某个消息ID 生效的中间件，在全局中间件之后执行
+func (m *MessageHandler) UseFor(msgID uint32, middlewares ...ziface.MiddlewareFunc) {
+	m.apiLock.Lock()
+	defer m.apiLock.Unlock()
+	m.MsgMiddlewares[msgID] = append(m.MsgMiddlewares[msgID], middlewares...)
+}
+
+// 设置某个消息ID 的处理超时时间，超时后该请求的上下文会被取消，router 需要自己去监听 req.Context().Done()
+func (m *MessageHandler) SetHandlerTimeout(msgID uint32, timeout time.Duration) {
+	m.apiLock.Lock()
+	defer m.apiLock.Unlock()
+	m.Timeouts[msgID] = timeout
+}
+
+// 设置某个消息ID 的消息是否在工作池之外处理。会长时间占用的 router（比如传输整个文件）应该设置，
+// 每个连接的这类消息仍然按顺序处理，但和这个连接交给工作池的其他消息之间不保证顺序
+func (m *MessageHandler) SetAsync(msgID uint32, async bool) {
+	m.apiLock.Lock()
+	defer m.apiLock.Unlock()
+	if async {
+		m.AsyncMsgIDs[msgID] = true
+	} else {
+		delete(m.AsyncMsgIDs, msgID)
+	}
+}
+
+// 启动工作池，开启 WorkerPoolSize 个 worker，每个 worker 拥有一个自己的任务队列。整个server 只需要启动一次
+func (m *MessageHandler) StartWorkerPool() {
+	for i := 0; i < int(m.WorkerPoolSize); i++ {
+		m.TaskQueue[i] = make(chan ziface.IRequest, utils.GlobalObj.MaxWorkerTaskLen)
+		go m.startOneWorker(i, m.TaskQueue[i])
+	}
+	logrus.Infof("[MessageHandler] 工作池启动，worker 数量 = %d，每个任务队列长度 = %d", m.WorkerPoolSize, utils.GlobalObj.MaxWorkerTaskLen)
+}
+
+// 启动一个 worker，不停地从自己的任务队列中取出请求并处理
+func (m *MessageHandler) startOneWorker(workerID int, taskQueue chan ziface.IRequest) {
+	logrus.Debugf("worker id = %d is started", workerID)
+	for {
+		select {
+		case req := <-taskQueue:
+			m.handleRequest(req)
+		case <-m.exitChan:
+			logrus.Debugf("worker id = %d is stopped", workerID)
+			return
+		}
+	}
+}
+
+// 把请求交给工作池处理。按 ConnID 把连接固定分配给某一个 worker，这样同一个连接的消息会按顺序被处理
+// 如果没有开启工作池，就退回到每个消息单独开一个 goroutine 的模式
+func (m *MessageHandler) SendMsgToTaskQueue(req ziface.IRequest) {
+	// 先计数再判断是否正在关闭：Drain 设置 closing 之后看到的请求数一定包括了所有被接收的请求
+	atomic.AddInt64(&m.inFlight, 1)
+	if atomic.LoadInt32(&m.closing) == 1 {
+		logrus.Debugf("MessageHandler 正在关闭，丢弃连接 %d 的消息 msgId = %d", req.GetConnection().GetConnID(), req.GetMsgId())
+		req.Release()
+		m.requestDone()
+		return
+	}
+	if m.WorkerPoolSize == 0 {
+		go m.handleRequest(req)
+		return
+	}
+	m.apiLock.RLock()
+	async := m.AsyncMsgIDs[req.GetMsgId()]
+	m.apiLock.RUnlock()
+	if async {
+		m.sendToAsyncQueue(req)
+		return
+	}
+	workerID := req.GetConnection().GetConnID() % m.WorkerPoolSize
+	// 任务队列满了就在这里阻塞，读goroutine 也就不会再继续读取新的数据（背压）
+	select {
+	case m.TaskQueue[workerID] <- req:
+	case <-m.exitChan: // 工作池已经关闭，防止 reader 永远阻塞在这里
+		req.Release()
+		m.requestDone()
+	}
+}
+
+// 处理一个请求，处理完后回收请求的数据，router 调用过 Retain 的话等它自己 Release
+func (m *MessageHandler) handleRequest(req ziface.IRequest) {
+	m.DoMsgHandler(req)
+	req.Release()
+	m.requestDone()
+}
+
+// 一个请求处理完（或被丢弃），正在关闭时最后一个请求完成后通知 Drain
+func (m *MessageHandler) requestDone() {
+	if atomic.AddInt64(&m.inFlight, -1) == 0 && atomic.LoadInt32(&m.closing) == 1 {
+		m.drainOnce.Do(func() { close(m.drained) })
+	}
+}
+
+// 把请求放进它的连接在工作池之外的队列，连接还没有处理这类请求的 goroutine 时启动一个。
+// 队列最长 MaxWorkerTaskLen，超过时丢弃请求：调用方可能是反应堆的事件循环，不能在这里阻塞
+func (m *MessageHandler) sendToAsyncQueue(req ziface.IRequest) {
+	connID := req.GetConnection().GetConnID()
+	m.asyncLock.Lock()
+	queue, running := m.asyncQueues[connID]
+	if uint32(len(queue)) >= utils.GlobalObj.MaxWorkerTaskLen {
+		m.asyncLock.Unlock()
+		logrus.Warnf("连接 %d 排队的 msgId = %d 的请求太多，丢弃", connID, req.GetMsgId())
+		req.Release()
+		m.requestDone()
+		return
+	}
+	m.asyncQueues[connID] = append(queue, req)
+	m.asyncLock.Unlock()
+	if !running {
+		go m.runAsyncQueue(connID)
+	}
+}
+
+// 按顺序处理一个连接在工作池之外的队列中的请求，队列空了就退出
+func (m *MessageHandler) runAsyncQueue(connID uint32) {
+	for {
+		m.asyncLock.Lock()
+		queue := m.asyncQueues[connID]
+		if len(queue) == 0 {
+			delete(m.asyncQueues, connID)
+			m.asyncLock.Unlock()
+			return
+		}
+		req := queue[0]
+		queue[0] = nil
+		m.asyncQueues[connID] = queue[1:]
+		m.asyncLock.Unlock()
+		m.handleRequest(req)
+	}
+}
+
+// 不再接收新的请求，并等待已经交给工作池的请求处理完毕，最多等待 timeout，全部处理完返回 true，超时返回 false
+func (m *MessageHandler) Drain(timeout time.Duration) bool {
+	atomic.StoreInt32(&m.closing, 1)
+	// 设置 closing 之后请求数为 0 的话不会再有新的请求；否则最后一个请求完成时会关闭 drained
+	if atomic.LoadInt64(&m.inFlight) == 0 {
+		return true
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	select {
+	case <-m.drained:
+		return true
+	case <-deadline.C:
+		logrus.Warnf("[MessageHandler] 等待请求处理超时，仍有 %d 个请求未处理完", atomic.LoadInt64(&m.inFlight))
+		return false
+	}
+}
+
+// 关闭工作池，所有 worker 退出
+func (m *MessageHandler) StopWorkerPool() {
+	close(m.exitChan)
+}
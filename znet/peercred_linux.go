@@ -0,0 +1,27 @@
+//go:build linux
+
+package znet
+
+import (
+	"net"
+	"syscall"
+)
+
+// 通过 SO_PEERCRED 得到 Unix domain socket 对端进程的 uid、gid 和 pid
+func getPeerCred(conn *net.UnixConn) (uid, gid, pid int, err error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, 0, credErr
+	}
+	return int(cred.Uid), int(cred.Gid), int(cred.Pid), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package znet
+
+import (
+	"errors"
+	"net"
+)
+
+// 只有 Linux 支持 SO_PEERCRED
+func getPeerCred(conn *net.UnixConn) (uid, gid, pid int, err error) {
+	return 0, 0, 0, errors.New("peer credentials are only supported on linux")
+}
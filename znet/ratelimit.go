@@ -0,0 +1,437 @@
+package znet
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/myZinx/utils"
+	"github.com/myZinx/ziface"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+收到的消息的限流：连接管理器保存限流规则和每个连接、每个 IP 的令牌桶，连接在把消息交给工作池之前检查。
+规则按 scope（连接或 IP）和消息ID（RateLimitAllMsgs 表示所有消息）索引，每条规则有消息数和字节数两个令牌桶。
+修改规则时只增加版本号，令牌桶在下一次检查时按新的规则更新速率，不需要遍历所有连接
+*/
+type rateLimiter struct {
+	enabled int32 // 有规则时为 1，没有规则时连接不用做任何检查，用原子操作
+	// 规则，下标是 scope
+	rules   [2]map[uint32]ziface.RateLimit
+	version uint64 // 规则的版本，每次修改加一
+	// 每个连接和每个 IP 的令牌桶，第一次检查时创建，连接删除时删除；IP 的令牌桶在该 IP 的最后一个连接删除时删除
+	conns map[uint32]*connLimits
+	ips   map[string]*ipLimits
+	lock  sync.RWMutex // 保护上面的规则和令牌桶集合
+	// 统计数据
+	counters   limitCounters
+	violations map[uint32]uint64
+	statsLock  sync.Mutex // 保护 violations
+	// 得到当前时间，测试时替换成可以控制的时钟
+	now func() time.Time
+}
+
+// 一个连接的令牌桶和计数，ip 是它的 IP 的令牌桶，不是 IP 地址的连接为 nil
+type connLimits struct {
+	buckets  limitBuckets
+	counters limitCounters
+	ip       *ipLimits
+}
+
+// 一个 IP 的令牌桶和计数，refs 是该 IP 已经检查过的连接数
+type ipLimits struct {
+	buckets  limitBuckets
+	counters limitCounters
+	addr     string
+	refs     int
+}
+
+// 通过检查的消息在 limitCounters 中的下标，排在各种处理方式的后面
+const limitAllowed = ziface.RateLimitDisconnect + 1
+
+// 各种处理的次数，下标是超过限额时的处理方式，最后一个是通过检查的消息数，用原子操作
+type limitCounters [limitAllowed + 1]uint64
+
+// 一组令牌桶，key 是规则的消息ID。同一个 IP 的多个连接会同时使用，用 lock 保护
+type limitBuckets struct {
+	lock    sync.Mutex
+	buckets map[uint32]*limitBucket
+}
+
+// 一条规则的令牌桶，令牌数可以是负的（RateLimitDelay 时先借用，之后的消息要等待还清）
+type limitBucket struct {
+	version    uint64
+	limit      ziface.RateLimit
+	msgTokens  float64
+	byteTokens float64
+	last       time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		rules:      [2]map[uint32]ziface.RateLimit{make(map[uint32]ziface.RateLimit), make(map[uint32]ziface.RateLimit)},
+		conns:      make(map[uint32]*connLimits),
+		ips:        make(map[string]*ipLimits),
+		violations: make(map[uint32]uint64),
+		now:        time.Now,
+	}
+}
+
+// 设置限流规则，运行中也可以修改
+func (l *rateLimiter) set(scope ziface.RateLimitScope, msgID uint32, limit ziface.RateLimit) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rules[scope][msgID] = limit
+	l.version++
+	atomic.StoreInt32(&l.enabled, 1)
+}
+
+// 删除限流规则
+func (l *rateLimiter) remove(scope ziface.RateLimitScope, msgID uint32) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.rules[scope], msgID)
+	l.version++
+	if len(l.rules[ziface.RateLimitPerConn]) == 0 && len(l.rules[ziface.RateLimitPerIP]) == 0 {
+		atomic.StoreInt32(&l.enabled, 0)
+	}
+}
+
+// 连接删除时删除它的令牌桶
+func (l *rateLimiter) removeConn(connID uint32) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	cl, has := l.conns[connID]
+	if !has {
+		return
+	}
+	delete(l.conns, connID)
+	if il := cl.ip; il != nil {
+		if il.refs--; il.refs <= 0 {
+			delete(l.ips, il.addr)
+		}
+	}
+}
+
+func (l *rateLimiter) stats() ziface.RateLimitStats {
+	stats := ziface.RateLimitStats{
+		RateLimitCounters: l.counters.load(),
+		Violations:        make(map[uint32]uint64),
+	}
+	l.lock.RLock()
+	stats.Conns = make(map[uint32]ziface.RateLimitCounters, len(l.conns))
+	for connID, cl := range l.conns {
+		stats.Conns[connID] = cl.counters.load()
+	}
+	stats.IPs = make(map[string]ziface.RateLimitCounters, len(l.ips))
+	for ip, il := range l.ips {
+		stats.IPs[ip] = il.counters.load()
+	}
+	l.lock.RUnlock()
+	l.statsLock.Lock()
+	defer l.statsLock.Unlock()
+	for msgID, n := range l.violations {
+		stats.Violations[msgID] = n
+	}
+	return stats
+}
+
+func (c *limitCounters) load() ziface.RateLimitCounters {
+	return ziface.RateLimitCounters{
+		Allowed:      atomic.LoadUint64(&c[limitAllowed]),
+		Dropped:      atomic.LoadUint64(&c[ziface.RateLimitDrop]),
+		Delayed:      atomic.LoadUint64(&c[ziface.RateLimitDelay]),
+		Replied:      atomic.LoadUint64(&c[ziface.RateLimitReply]),
+		Disconnected: atomic.LoadUint64(&c[ziface.RateLimitDisconnect]),
+	}
+}
+
+// 记录连接的一个消息的检查结果：result 是 limitAllowed 或者超过限额时的处理方式，同时计入总数、连接和它的 IP
+func (l *rateLimiter) record(cl *connLimits, msgID uint32, result ziface.RateLimitAction) {
+	atomic.AddUint64(&l.counters[result], 1)
+	atomic.AddUint64(&cl.counters[result], 1)
+	if cl.ip != nil {
+		atomic.AddUint64(&cl.ip.counters[result], 1)
+	}
+	if result == limitAllowed {
+		return
+	}
+	l.statsLock.Lock()
+	l.violations[msgID]++
+	l.statsLock.Unlock()
+}
+
+// 一条要检查的规则：它所在的令牌桶集合、规则的消息ID 和规则本身，以及检查时取出的令牌桶
+type limitCheck struct {
+	buckets *limitBuckets
+	key     uint32
+	limit   ziface.RateLimit
+	bucket  *limitBucket
+}
+
+// 检查连接收到的一个消息是否超过限额，返回连接的令牌桶（用来记录检查结果）。没有超过时返回 ok；
+// 超过时返回违反的规则的处理方式，RateLimitDelay 时还返回需要等待的时间。
+// 先检查所有匹配的规则，再从它们的令牌桶中取令牌：被某条规则丢弃（或回复、断开）的消息不占用任何一条规则的额度
+func (l *rateLimiter) check(conn ziface.IConnection, msgID uint32, size int) (cl *connLimits, action ziface.RateLimitAction, wait time.Duration, ok bool) {
+	now := l.now()
+	l.lock.RLock()
+	cl = l.conns[conn.GetConnID()]
+	l.lock.RUnlock()
+	if cl == nil {
+		cl = l.addConn(conn)
+	}
+	// 先连接的规则，再 IP 的规则；每个 scope 先所有消息共用的规则，再这个消息ID 的规则
+	var checks [4]limitCheck
+	n := 0
+	l.lock.RLock()
+	version := l.version
+	for _, scope := range [...]struct {
+		rules   map[uint32]ziface.RateLimit
+		buckets *limitBuckets
+	}{{l.rules[ziface.RateLimitPerConn], &cl.buckets}, {l.rules[ziface.RateLimitPerIP], ipBuckets(cl.ip)}} {
+		if scope.buckets == nil {
+			continue
+		}
+		for _, key := range [...]uint32{ziface.RateLimitAllMsgs, msgID} {
+			if key == msgID && msgID == ziface.RateLimitAllMsgs {
+				continue
+			}
+			if limit, has := scope.rules[key]; has {
+				checks[n] = limitCheck{buckets: scope.buckets, key: key, limit: limit}
+				n++
+			}
+		}
+	}
+	l.lock.RUnlock()
+	// 检查和取令牌期间锁住用到的令牌桶集合，总是先连接的再 IP 的，不会死锁
+	var locked *limitBuckets
+	for _, ch := range checks[:n] {
+		if ch.buckets != locked {
+			ch.buckets.lock.Lock()
+			defer ch.buckets.lock.Unlock()
+			locked = ch.buckets
+		}
+	}
+	ok = true
+	for i := range checks[:n] {
+		ch := &checks[i]
+		ch.bucket = ch.buckets.get(ch.key, ch.limit, version, now)
+		if ch.bucket.allows(size) {
+			continue
+		}
+		if ch.limit.Action != ziface.RateLimitDelay {
+			return cl, ch.limit.Action, 0, false // 其他的处理方式都不再处理这个消息，一个令牌都不取
+		}
+		ok, action = false, ziface.RateLimitDelay
+	}
+	// 没有被丢弃：所有规则都取出令牌，RateLimitDelay 的规则令牌不够时先借用，等待到还清为止
+	for _, ch := range checks[:n] {
+		if ruleWait := ch.bucket.take(size); ruleWait > wait {
+			wait = ruleWait
+		}
+	}
+	return cl, action, wait, ok
+}
+
+func ipBuckets(il *ipLimits) *limitBuckets {
+	if il == nil {
+		return nil
+	}
+	return &il.buckets
+}
+
+// 连接第一次检查时创建它的令牌桶，并增加它的 IP 的引用。
+// 连接已经关闭的话连接管理器可能已经删除过它的令牌桶了，这时返回一个不保存的令牌桶，否则它和 IP 的引用再也不会被删除
+func (l *rateLimiter) addConn(conn ziface.IConnection) *connLimits {
+	ip := remoteIP(conn.RemoteAddr())
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if cl, has := l.conns[conn.GetConnID()]; has {
+		return cl
+	}
+	// 连接在被连接管理器删除之前就已经标记为关闭，持有锁时检查，removeConn 不会在这之后才删除
+	if !conn.IsAlive() {
+		return &connLimits{}
+	}
+	cl := &connLimits{}
+	l.conns[conn.GetConnID()] = cl
+	if ip != "" {
+		il := l.ips[ip]
+		if il == nil {
+			il = &ipLimits{addr: ip}
+			l.ips[ip] = il
+		}
+		il.refs++
+		cl.ip = il
+	}
+	return cl
+}
+
+// 得到规则 key 的令牌桶，按规则的版本更新，并按经过的时间补充令牌。需要持有 lock
+func (b *limitBuckets) get(key uint32, limit ziface.RateLimit, version uint64, now time.Time) *limitBucket {
+	if b.buckets == nil {
+		b.buckets = make(map[uint32]*limitBucket)
+	}
+	bucket := b.buckets[key]
+	if bucket == nil {
+		bucket = &limitBucket{last: now}
+		b.buckets[key] = bucket
+		bucket.update(limit, version)
+		bucket.msgTokens, bucket.byteTokens = msgBurst(limit), byteBurst(limit) // 新的令牌桶是满的
+	} else if bucket.version < version {
+		bucket.update(limit, version)
+	}
+	bucket.refill(now)
+	return bucket
+}
+
+// 令牌是否够一个消息和 size 个字节。一个消息比突发的字节数还大时，令牌桶满了也让它通过，否则它永远过不去
+func (bucket *limitBucket) allows(size int) bool {
+	limit := bucket.limit
+	msgOk := limit.MsgRate <= 0 || bucket.msgTokens >= 1
+	byteOk := limit.ByteRate <= 0 || bucket.byteTokens >= float64(size) || bucket.byteTokens >= byteBurst(limit)
+	return msgOk && byteOk
+}
+
+// 取出一个消息和 size 个字节的令牌，令牌不够时令牌数变成负的，返回需要等待多久才能还清
+func (bucket *limitBucket) take(size int) time.Duration {
+	limit := bucket.limit
+	var wait time.Duration
+	if limit.MsgRate > 0 {
+		bucket.msgTokens--
+		if bucket.msgTokens < 0 {
+			wait = time.Duration(-bucket.msgTokens / limit.MsgRate * float64(time.Second))
+		}
+	}
+	if limit.ByteRate > 0 {
+		bucket.byteTokens -= float64(size)
+		if bucket.byteTokens < 0 {
+			if byteWait := time.Duration(-bucket.byteTokens / limit.ByteRate * float64(time.Second)); byteWait > wait {
+				wait = byteWait
+			}
+		}
+	}
+	return wait
+}
+
+// 规则修改后按新的规则更新令牌桶，令牌数不超过新的突发数
+func (bucket *limitBucket) update(limit ziface.RateLimit, version uint64) {
+	bucket.limit, bucket.version = limit, version
+	if burst := msgBurst(limit); bucket.msgTokens > burst {
+		bucket.msgTokens = burst
+	}
+	if burst := byteBurst(limit); bucket.byteTokens > burst {
+		bucket.byteTokens = burst
+	}
+}
+
+// 按经过的时间补充令牌
+func (bucket *limitBucket) refill(now time.Time) {
+	elapsed := now.Sub(bucket.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	bucket.last = now
+	if limit := bucket.limit; limit.MsgRate > 0 {
+		if bucket.msgTokens += elapsed * limit.MsgRate; bucket.msgTokens > msgBurst(limit) {
+			bucket.msgTokens = msgBurst(limit)
+		}
+	}
+	if limit := bucket.limit; limit.ByteRate > 0 {
+		if bucket.byteTokens += elapsed * limit.ByteRate; bucket.byteTokens > byteBurst(limit) {
+			bucket.byteTokens = byteBurst(limit)
+		}
+	}
+}
+
+func msgBurst(limit ziface.RateLimit) float64 {
+	if limit.MsgBurst > 0 {
+		return float64(limit.MsgBurst)
+	}
+	if limit.MsgRate < 1 {
+		return 1
+	}
+	return limit.MsgRate
+}
+
+func byteBurst(limit ziface.RateLimit) float64 {
+	if limit.ByteBurst > 0 {
+		return float64(limit.ByteBurst)
+	}
+	return limit.ByteRate
+}
+
+// 得到对端的 IP，不是 IP 地址的连接（比如 Unix domain socket）返回空字符串，不按 IP 限流
+func remoteIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	if addr == nil {
+		return ""
+	}
+	// WebSocket 等连接的地址是 "host:port" 的形式
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return ""
+}
+
+// 在把消息交给工作池之前检查限流，返回 false 时消息已经被丢弃（并按规则处理了连接），调用方不要再使用它
+func (c *Connection) allowMsg(msg ziface.IMessage) bool {
+	// 心跳包不限流，否则对端可能因为心跳被丢弃而被当成已经断开
+	if c.limiter == nil || atomic.LoadInt32(&c.limiter.enabled) == 0 || msg.GetMsgId() == utils.MSGID_HEARTBEAT {
+		return true
+	}
+	l := c.limiter
+	cl, action, wait, ok := l.check(c, msg.GetMsgId(), len(msg.GetData()))
+	if ok {
+		l.record(cl, msg.GetMsgId(), limitAllowed)
+		return true
+	}
+	if action != ziface.RateLimitDisconnect {
+		l.record(cl, msg.GetMsgId(), action)
+	}
+	switch action {
+	case ziface.RateLimitDelay:
+		// 期间不再读取这个连接的数据，对端的发送会被 TCP 的流量控制挡住。
+		// 反应堆模式下事件循环不能等待，暂时不再监听这个连接，到时间后在另外的 goroutine 中处理这个消息再继续读取
+		if c.reactor != nil {
+			c.delayReading(msg, wait)
+			return false
+		}
+		// goroutine 模式下在连接自己的 reader 中等待
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return true
+		case <-c.ExitChan:
+		}
+	case ziface.RateLimitReply:
+		// 带上请求的序列号和回复标志，对端如果在 Call 中等待这个请求，会直接得到这个错误；发送队列满了就不回复了
+		errMsg := []byte(fmt.Sprintf("rate limit exceeded, msgID = %d", msg.GetMsgId()))
+		c.sendMessage(&Message{
+			Flags:  MsgFlagResponse,
+			SeqId:  msg.GetSeqId(),
+			MsgId:  utils.MSGID_ERROR,
+			Length: uint32(len(errMsg)),
+			Data:   errMsg,
+		}, ziface.OverflowDropNewest)
+	case ziface.RateLimitDisconnect:
+		// 关闭连接之前已经读出来的消息也会走到这里，只统计、关闭一次
+		if c.IsAlive() {
+			l.record(cl, msg.GetMsgId(), action)
+			logrus.Warnf("连接 %d（%v）的消息 %d 超过限额，关闭连接", c.ConnID, c.RemoteAddr(), msg.GetMsgId())
+			c.stopReading()
+		}
+	}
+	logrus.Debugf("连接 %d 的消息 %d 超过限额，丢弃", c.ConnID, msg.GetMsgId())
+	freeMessage(msg)
+	return false
+}
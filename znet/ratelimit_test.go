@@ -0,0 +1,451 @@
+package znet
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/myZinx/utils"
+	"github.com/myZinx/ziface"
+)
+
+// 测试用的时钟，只在 Advance 时前进
+type manualClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{now: time.Unix(1700000000, 0)}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	c.lock.Unlock()
+}
+
+// 用手动的时钟创建限流器
+func newTestLimiter(clock *manualClock) *rateLimiter {
+	l := newRateLimiter()
+	l.now = clock.Now
+	return l
+}
+
+// 只用来检查限流的连接，只实现限流器用到的方法
+type limitTestConn struct {
+	ziface.IConnection
+	id     uint32
+	addr   net.Addr
+	closed bool
+}
+
+func (c *limitTestConn) GetConnID() uint32    { return c.id }
+func (c *limitTestConn) RemoteAddr() net.Addr { return c.addr }
+func (c *limitTestConn) IsAlive() bool        { return !c.closed }
+
+func tcpAddr(ip string, port int) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+// 一次检查：先把时钟拨快 advance，再检查一个 size 字节的消息
+type limitStep struct {
+	advance time.Duration
+	size    int
+	ok      bool
+	action  ziface.RateLimitAction
+	wait    time.Duration
+}
+
+func TestRateLimitBucket(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit ziface.RateLimit
+		steps []limitStep
+	}{
+		{
+			name:  "msg burst then refill",
+			limit: ziface.RateLimit{MsgRate: 10, MsgBurst: 3, Action: ziface.RateLimitDrop},
+			steps: []limitStep{
+				{ok: true}, {ok: true}, {ok: true},
+				{action: ziface.RateLimitDrop},
+				{advance: 100 * time.Millisecond, ok: true},
+				{action: ziface.RateLimitDrop},
+				// 空闲再久令牌也不超过突发数
+				{advance: 10 * time.Second, ok: true}, {ok: true}, {ok: true},
+				{action: ziface.RateLimitDrop},
+			},
+		},
+		{
+			name:  "burst defaults to rate",
+			limit: ziface.RateLimit{MsgRate: 2, Action: ziface.RateLimitDrop},
+			steps: []limitStep{
+				{ok: true}, {ok: true},
+				{action: ziface.RateLimitDrop},
+				{advance: 500 * time.Millisecond, ok: true},
+			},
+		},
+		{
+			name:  "byte rate",
+			limit: ziface.RateLimit{ByteRate: 100, ByteBurst: 100, Action: ziface.RateLimitDrop},
+			steps: []limitStep{
+				{size: 60, ok: true},
+				{size: 60, action: ziface.RateLimitDrop},
+				{size: 40, ok: true},
+				{advance: 200 * time.Millisecond, size: 30, action: ziface.RateLimitDrop},
+				{advance: 100 * time.Millisecond, size: 30, ok: true},
+				{size: 0, ok: true}, // 没有数据的消息不占字节数
+				{size: 1, action: ziface.RateLimitDrop},
+			},
+		},
+		{
+			name:  "message larger than the burst passes when the bucket is full",
+			limit: ziface.RateLimit{ByteRate: 100, ByteBurst: 100, Action: ziface.RateLimitDrop},
+			steps: []limitStep{
+				{size: 500, ok: true},
+				{advance: time.Second, size: 10, action: ziface.RateLimitDrop},
+				{advance: 4 * time.Second, size: 10, ok: true},
+			},
+		},
+		{
+			name:  "delay borrows tokens",
+			limit: ziface.RateLimit{MsgRate: 10, MsgBurst: 1, Action: ziface.RateLimitDelay},
+			steps: []limitStep{
+				{ok: true},
+				{action: ziface.RateLimitDelay, wait: 100 * time.Millisecond},
+				{action: ziface.RateLimitDelay, wait: 200 * time.Millisecond},
+				{advance: 200 * time.Millisecond, action: ziface.RateLimitDelay, wait: 100 * time.Millisecond},
+				{advance: 200 * time.Millisecond, ok: true},
+			},
+		},
+		{
+			name:  "delay waits for the slower bucket",
+			limit: ziface.RateLimit{MsgRate: 10, MsgBurst: 1, ByteRate: 100, ByteBurst: 100, Action: ziface.RateLimitDelay},
+			steps: []limitStep{
+				{size: 100, ok: true},
+				{size: 50, action: ziface.RateLimitDelay, wait: 500 * time.Millisecond},
+			},
+		},
+		{
+			name:  "reply",
+			limit: ziface.RateLimit{MsgRate: 1, MsgBurst: 1, Action: ziface.RateLimitReply},
+			steps: []limitStep{
+				{ok: true},
+				{action: ziface.RateLimitReply},
+				{advance: time.Second, ok: true},
+			},
+		},
+		{
+			name:  "disconnect",
+			limit: ziface.RateLimit{MsgRate: 1, MsgBurst: 1, Action: ziface.RateLimitDisconnect},
+			steps: []limitStep{
+				{ok: true},
+				{action: ziface.RateLimitDisconnect},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newManualClock()
+			l := newTestLimiter(clock)
+			l.set(ziface.RateLimitPerConn, ziface.RateLimitAllMsgs, tt.limit)
+			conn := &limitTestConn{id: 1, addr: tcpAddr("10.0.0.1", 1000)}
+			for i, step := range tt.steps {
+				clock.Advance(step.advance)
+				_, action, wait, ok := l.check(conn, utils.MSGID_GENERAL_MSG, step.size)
+				if ok != step.ok || (!ok && (action != step.action || wait != step.wait)) {
+					t.Fatalf("step %d: ok = %v, action = %d, wait = %v; want ok = %v, action = %d, wait = %v",
+						i, ok, action, wait, step.ok, step.action, step.wait)
+				}
+			}
+		})
+	}
+}
+
+// 修改规则后令牌桶按新的规则计算，令牌数不超过新的突发数
+func TestRateLimitRuleUpdate(t *testing.T) {
+	clock := newManualClock()
+	l := newTestLimiter(clock)
+	conn := &limitTestConn{id: 1, addr: tcpAddr("10.0.0.1", 1000)}
+	l.set(ziface.RateLimitPerConn, ziface.RateLimitAllMsgs, ziface.RateLimit{MsgRate: 10, MsgBurst: 5})
+	if _, _, _, ok := l.check(conn, 1, 0); !ok {
+		t.Fatal("first message dropped")
+	}
+	l.set(ziface.RateLimitPerConn, ziface.RateLimitAllMsgs, ziface.RateLimit{MsgRate: 1, MsgBurst: 1})
+	if _, _, _, ok := l.check(conn, 1, 0); !ok {
+		t.Fatal("message dropped after the rule changed")
+	}
+	if _, _, _, ok := l.check(conn, 1, 0); ok {
+		t.Fatal("tokens above the new burst were kept")
+	}
+	l.remove(ziface.RateLimitPerConn, ziface.RateLimitAllMsgs)
+	if _, _, _, ok := l.check(conn, 1, 0); !ok {
+		t.Fatal("message dropped after the rule was removed")
+	}
+}
+
+// 被一条规则丢弃的消息不占用其他规则的额度
+func TestRateLimitRejectDoesNotCharge(t *testing.T) {
+	clock := newManualClock()
+	l := newTestLimiter(clock)
+	l.set(ziface.RateLimitPerConn, ziface.RateLimitAllMsgs, ziface.RateLimit{MsgRate: 1, MsgBurst: 2})
+	l.set(ziface.RateLimitPerConn, 1, ziface.RateLimit{MsgRate: 1, MsgBurst: 1})
+	l.set(ziface.RateLimitPerIP, 2, ziface.RateLimit{MsgRate: 1, MsgBurst: 1, Action: ziface.RateLimitReply})
+	conn := &limitTestConn{id: 1, addr: tcpAddr("10.0.0.1", 1000)}
+	steps := []struct {
+		msgID  uint32
+		ok     bool
+		action ziface.RateLimitAction
+	}{
+		{msgID: 1, ok: true},
+		{msgID: 1, action: ziface.RateLimitDrop},
+		{msgID: 2, ok: true}, // 上一个消息被丢弃了，所有消息共用的规则还剩一个令牌
+		{msgID: 3, action: ziface.RateLimitDrop},
+	}
+	for i, step := range steps {
+		_, action, _, ok := l.check(conn, step.msgID, 0)
+		if ok != step.ok || (!ok && action != step.action) {
+			t.Fatalf("step %d msgID %d: ok = %v, action = %d", i, step.msgID, ok, action)
+		}
+	}
+	// IP 的规则拒绝时，连接的规则也不扣
+	clock.Advance(2 * time.Second)
+	if _, _, _, ok := l.check(conn, 2, 0); !ok {
+		t.Fatal("msgID 2 dropped after refill")
+	}
+	if _, action, _, ok := l.check(conn, 2, 0); ok || action != ziface.RateLimitReply {
+		t.Fatalf("msgID 2 over the per-IP rule: ok = %v, action = %d", ok, action)
+	}
+	if _, _, _, ok := l.check(conn, 3, 0); !ok {
+		t.Fatal("per-conn tokens were taken by a message the per-IP rule rejected")
+	}
+}
+
+// 同一个 IP 的连接共用 IP 的令牌桶，最后一个连接删除时删除 IP 的令牌桶
+func TestRateLimitPerIP(t *testing.T) {
+	clock := newManualClock()
+	l := newTestLimiter(clock)
+	l.set(ziface.RateLimitPerIP, ziface.RateLimitAllMsgs, ziface.RateLimit{MsgRate: 1, MsgBurst: 2})
+	a := &limitTestConn{id: 1, addr: tcpAddr("10.0.0.1", 1000)}
+	b := &limitTestConn{id: 2, addr: tcpAddr("10.0.0.1", 1001)}
+	other := &limitTestConn{id: 3, addr: tcpAddr("10.0.0.2", 1000)}
+	for i, conn := range []*limitTestConn{a, b, a, other} {
+		_, _, _, ok := l.check(conn, 1, 0)
+		if want := i != 2; ok != want {
+			t.Fatalf("check %d (conn %d): ok = %v, want %v", i, conn.id, ok, want)
+		}
+	}
+	if il := l.ips["10.0.0.1"]; il == nil || il.refs != 2 {
+		t.Fatalf("ip entry = %+v, want 2 refs", il)
+	}
+	l.removeConn(a.id)
+	if l.ips["10.0.0.1"] == nil {
+		t.Fatal("ip entry removed while another connection still uses it")
+	}
+	l.removeConn(b.id)
+	if _, has := l.ips["10.0.0.1"]; has {
+		t.Fatal("ip entry kept after its last connection was removed")
+	}
+	if _, has := l.conns[b.id]; has {
+		t.Fatal("conn entry kept after removeConn")
+	}
+	// 不是 IP 地址的连接不按 IP 限流
+	unix := &limitTestConn{id: 4, addr: &net.UnixAddr{Name: "/tmp/zinx.sock", Net: "unix"}}
+	for i := 0; i < 3; i++ {
+		if _, _, _, ok := l.check(unix, 1, 0); !ok {
+			t.Fatal("unix socket connection was limited per IP")
+		}
+	}
+}
+
+// 已经关闭的连接检查时不保存它的令牌桶，否则连接管理器删除过它之后再也没有人删除
+func TestRateLimitClosedConn(t *testing.T) {
+	l := newTestLimiter(newManualClock())
+	l.set(ziface.RateLimitPerIP, ziface.RateLimitAllMsgs, ziface.RateLimit{MsgRate: 1})
+	conn := &limitTestConn{id: 1, addr: tcpAddr("10.0.0.1", 1000), closed: true}
+	l.check(conn, 1, 0)
+	if len(l.conns) != 0 || len(l.ips) != 0 {
+		t.Fatalf("closed connection stored: %d conns, %d ips", len(l.conns), len(l.ips))
+	}
+}
+
+// 在连接上按规则处理超过限额的消息，并计入统计
+func TestRateLimitActions(t *testing.T) {
+	// 创建一个使用限流器的连接，router 收到的消息数据交给返回的 chan
+	start := func(t *testing.T, limit ziface.RateLimit) (*rateLimiter, *manualClock, net.Conn, chan string) {
+		clock := newManualClock()
+		l := newTestLimiter(clock)
+		l.set(ziface.RateLimitPerConn, ziface.RateLimitAllMsgs, limit)
+		routed := make(chan string, 4)
+		sink := &testRouter{f: func(req ziface.IRequest) { routed <- string(req.GetData()) }}
+		_, peer := startPipeConn(t, map[uint32]ziface.IRouter{utils.MSGID_GENERAL_MSG: sink}, func(c *Connection) {
+			c.limiter = l
+		})
+		return l, clock, peer, routed
+	}
+	send := func(t *testing.T, peer net.Conn, data string) {
+		writeFrame(t, peer, MsgVersion1, &Message{MsgId: utils.MSGID_GENERAL_MSG, Data: []byte(data)})
+	}
+	expectRouted := func(t *testing.T, routed chan string, want string) {
+		t.Helper()
+		select {
+		case data := <-routed:
+			if data != want {
+				t.Fatalf("router got %q, want %q", data, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%q was not handled", want)
+		}
+	}
+	expectStats := func(t *testing.T, l *rateLimiter, want ziface.RateLimitCounters) {
+		t.Helper()
+		stats := l.stats()
+		if stats.RateLimitCounters != want || stats.Conns[1] != want {
+			t.Fatalf("stats = %+v, conn = %+v, want %+v", stats.RateLimitCounters, stats.Conns[1], want)
+		}
+		if n := stats.Violations[utils.MSGID_GENERAL_MSG]; n != want.Dropped+want.Delayed+want.Replied+want.Disconnected {
+			t.Fatalf("violations = %d", n)
+		}
+	}
+
+	t.Run("drop", func(t *testing.T) {
+		l, clock, peer, routed := start(t, ziface.RateLimit{MsgRate: 1, MsgBurst: 1, Action: ziface.RateLimitDrop})
+		send(t, peer, "a")
+		send(t, peer, "b")
+		expectRouted(t, routed, "a")
+		// b 检查完之后才拨时钟，否则 b 可能按补充后的令牌通过
+		for deadline := time.Now().Add(2 * time.Second); l.stats().Dropped == 0 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(time.Second)
+		send(t, peer, "c")
+		// 同一个连接的消息按顺序处理，下一个收到的是 c 就说明 b 被丢弃了
+		expectRouted(t, routed, "c")
+		expectStats(t, l, ziface.RateLimitCounters{Allowed: 2, Dropped: 1})
+	})
+	t.Run("delay", func(t *testing.T) {
+		l, _, peer, routed := start(t, ziface.RateLimit{MsgRate: 20, MsgBurst: 1, Action: ziface.RateLimitDelay})
+		send(t, peer, "a")
+		expectRouted(t, routed, "a")
+		begin := time.Now()
+		send(t, peer, "b")
+		expectRouted(t, routed, "b")
+		if elapsed := time.Since(begin); elapsed < 50*time.Millisecond {
+			t.Fatalf("delayed message handled after %v, want at least 50ms", elapsed)
+		}
+		expectStats(t, l, ziface.RateLimitCounters{Allowed: 1, Delayed: 1})
+	})
+	t.Run("reply", func(t *testing.T) {
+		l, _, peer, routed := start(t, ziface.RateLimit{MsgRate: 1, MsgBurst: 1, Action: ziface.RateLimitReply})
+		send(t, peer, "a")
+		send(t, peer, "b")
+		reply := readFrame(t, peer, MsgVersion1)
+		want := fmt.Sprintf("rate limit exceeded, msgID = %d", utils.MSGID_GENERAL_MSG)
+		if reply.GetMsgId() != utils.MSGID_ERROR || string(reply.GetData()) != want {
+			t.Fatalf("reply msgId = %d, data = %q", reply.GetMsgId(), reply.GetData())
+		}
+		expectRouted(t, routed, "a")
+		expectStats(t, l, ziface.RateLimitCounters{Allowed: 1, Replied: 1})
+	})
+	t.Run("disconnect", func(t *testing.T) {
+		l, _, peer, routed := start(t, ziface.RateLimit{MsgRate: 1, MsgBurst: 1, Action: ziface.RateLimitDisconnect})
+		send(t, peer, "a")
+		send(t, peer, "b")
+		expectClosed(t, peer)
+		expectRouted(t, routed, "a")
+		expectStats(t, l, ziface.RateLimitCounters{Allowed: 1, Disconnected: 1})
+	})
+}
+
+// 记录调用的反应堆，不监听任何 socket
+type recordPoller struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (p *recordPoller) record(event string) {
+	p.lock.Lock()
+	p.events = append(p.events, event)
+	p.lock.Unlock()
+}
+
+func (p *recordPoller) get() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string(nil), p.events...)
+}
+
+func (p *recordPoller) add(c *Connection) error    { p.record("add"); return nil }
+func (p *recordPoller) remove(c *Connection)       { p.record("remove") }
+func (p *recordPoller) pause(c *Connection) error  { p.record("pause"); return nil }
+func (p *recordPoller) resume(c *Connection) error { p.record("resume"); return nil }
+func (p *recordPoller) close()                     {}
+
+// 反应堆模式下推迟处理的消息：事件循环不等待，暂停监听这个连接，到时间后按顺序处理剩下的帧再恢复监听
+func TestRateLimitDelayPausesReactor(t *testing.T) {
+	l := newTestLimiter(newManualClock())
+	l.set(ziface.RateLimitPerConn, ziface.RateLimitAllMsgs, ziface.RateLimit{MsgRate: 100, MsgBurst: 1, Action: ziface.RateLimitDelay})
+	routed := make(chan string, 3)
+	sink := &testRouter{f: func(req ziface.IRequest) { routed <- string(req.GetData()) }}
+	p := &recordPoller{}
+	c, _ := startPipeConn(t, map[uint32]ziface.IRouter{utils.MSGID_GENERAL_MSG: sink}, func(c *Connection) {
+		c.reactor = p
+		c.limiter = l
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for len(p.get()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// 三个帧一次读出来，像事件循环一样持有 feedLock 交给 feed
+	var buf bytes.Buffer
+	dp := NewDataPack()
+	for _, data := range []string{"1", "2", "3"} {
+		frame, _ := dp.Pack(&Message{MsgId: utils.MSGID_GENERAL_MSG, Length: 1, Data: []byte(data)})
+		buf.Write(frame)
+	}
+	begin := time.Now()
+	c.feedLock.Lock()
+	ok := c.feed(buf.Bytes())
+	c.feedLock.Unlock()
+	if !ok {
+		t.Fatal("feed failed")
+	}
+	if events := p.get(); fmt.Sprint(events) != "[add pause]" {
+		t.Fatalf("poller events after feed = %v, want [add pause]", events)
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		select {
+		case data := <-routed:
+			if data != want {
+				t.Fatalf("router got %q, want %q", data, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%q was not handled", want)
+		}
+	}
+	// 第二个消息等 10ms，第三个借了两个令牌等 20ms
+	if elapsed := time.Since(begin); elapsed < 30*time.Millisecond {
+		t.Fatalf("delayed messages handled after %v, want at least 30ms", elapsed)
+	}
+	for time.Now().Before(deadline) {
+		if fmt.Sprint(p.get()) == "[add pause pause resume]" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if events := p.get(); fmt.Sprint(events) != "[add pause pause resume]" {
+		t.Fatalf("poller events = %v, want [add pause pause resume]", events)
+	}
+	if stats := l.stats(); stats.Allowed != 1 || stats.Delayed != 2 {
+		t.Fatalf("stats = %+v", stats.RateLimitCounters)
+	}
+}
@@ -0,0 +1,185 @@
+package znet
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/myZinx/ziface"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+反应堆（reactor）模式：GlobalObj.UseReactor 为 true 时（只支持 Linux），server 用少量的事件循环（epoll）管理所有 TCP 和 Unix domain socket 的连接。
+连接不再有自己的 reader goroutine：事件循环在 socket 可读时读出数据、增量拆包，再把请求交给工作池；writer 也只在有数据要发送时才启动，发完就退出。
+这样空闲的连接既不占 goroutine 的栈，也不占读缓冲。TLS、WebSocket、UDP 的连接以及使用自定义封包模块的连接仍然使用 goroutine 模式。
+注意事件循环把请求交给工作池时，任务队列满了会阻塞，同一个事件循环上的其他连接也要等待
+*/
+
+// 事件循环的抽象，Linux 下由 epoll 实现
+type poller interface {
+	// 开始监听连接的可读事件
+	add(c *Connection) error
+	// 不再监听连接，需要在关闭 socket 之前调用
+	remove(c *Connection)
+	// 暂时不再监听连接，连接仍然属于原来的事件循环
+	pause(c *Connection) error
+	// 重新监听暂停了的连接，连接已经 remove 了（正在关闭）时什么都不做
+	resume(c *Connection) error
+	// 关闭所有的事件循环
+	close()
+}
+
+// 连接能否交给反应堆：事件循环直接读 socket 的文件描述符，增量拆包也只认识 DataPack 的帧格式
+func canUseReactor(conn net.Conn, dp ziface.IDataPack) bool {
+	if _, ok := dp.(*DataPack); !ok {
+		return false
+	}
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// 把从 socket 读到的数据交给连接增量拆包，收全的帧交给 handleMsg，剩下不完整的帧留到下次。
+// data 是事件循环的读缓冲，返回后就会被复用。数据出错时返回 false，由调用方关闭连接
+func (c *Connection) feed(data []byte) bool {
+	buf := data
+	if len(c.pending) > 0 {
+		c.pending = appendBuffer(c.pending, data)
+		buf = c.pending
+	}
+	for !c.readStopped && !c.readPaused { // 处理前面的帧时连接关闭了或者暂停读取了的话，剩下的帧先不处理
+		// 每个帧都重新取一次版本，协商帧格式的帧之后的帧要按新的版本拆包
+		version := c.readVersion
+		n, err := frameLength(buf, version)
+		if err != nil {
+			logrus.Error("server read Unpack err :", err)
+			return false
+		}
+		if n == 0 || len(buf) < n {
+			break
+		}
+		c.unpackReader.Reset(buf[:n])
+		msg, err := c.unpack(&c.unpackReader, version)
+		if err != nil {
+			logrus.Error("server read Unpack err :", err)
+			return false
+		}
+		c.handleMsg(msg)
+		buf = buf[n:]
+	}
+	switch {
+	case len(buf) == 0 || c.readStopped: // 没有剩下的数据或者连接正在关闭，不占缓冲
+		putBuffer(c.pending)
+		c.pending = nil
+	case len(c.pending) == 0: // 剩下的数据还在事件循环的读缓冲中，拷贝出来
+		c.pending = appendBuffer(nil, buf)
+	default: // 剩下的数据在 pending 的后面，挪到前面
+		c.pending = c.pending[:copy(c.pending, buf)]
+	}
+	return true
+}
+
+// 在 reader 或事件循环中关闭连接。反应堆模式下先让事件循环不再读取这个连接，
+// 关闭 socket、通知连接管理器这些可能阻塞的工作交给另外的 goroutine，不耽误同一个事件循环上的其他连接
+func (c *Connection) stopReading() {
+	if c.reactor == nil {
+		c.Stop()
+		return
+	}
+	if c.readStopped {
+		return
+	}
+	c.readStopped = true
+	c.reactor.remove(c)
+	go c.Stop()
+}
+
+// 反应堆模式下推迟处理超过限额的消息：暂时不再监听这个连接，对端的发送会被 TCP 的流量控制挡住，事件循环照常处理其他连接。
+// wait 之后在另外的 goroutine 中把消息交给工作池，再处理暂停之前已经读出来的帧，最后重新监听。调用方持有 feedLock
+func (c *Connection) delayReading(msg ziface.IMessage, wait time.Duration) {
+	c.readPaused = true
+	if err := c.reactor.pause(c); err != nil {
+		logrus.Error("[reactor] pause reading err: ", err)
+	}
+	time.AfterFunc(wait, func() { c.resumeReading(msg) })
+}
+
+// 推迟的时间到了：暂停期间事件循环不会再读取这个连接，持有 feedLock 接着使用它的拆包状态
+func (c *Connection) resumeReading(msg ziface.IMessage) {
+	c.feedLock.Lock()
+	defer c.feedLock.Unlock()
+	c.readPaused = false
+	if !c.IsAlive() {
+		freeMessage(msg)
+		return
+	}
+	c.dispatchMsg(msg)
+	// 剩下的帧中又有要推迟的消息的话会再次暂停，等下一次恢复时再重新监听
+	if !c.feed(nil) {
+		c.stopReading()
+		return
+	}
+	if c.readPaused || c.readStopped {
+		return
+	}
+	if err := c.reactor.resume(c); err != nil {
+		logrus.Error("[reactor] resume reading err: ", err)
+		c.stopReading()
+	}
+}
+
+// 把 data 追加到 buf 后面，容量不够时从缓冲池中换一个更大的缓冲
+func appendBuffer(buf []byte, data []byte) []byte {
+	if cap(buf)-len(buf) < len(data) {
+		grown := getBuffer(len(buf) + len(data))[:len(buf)]
+		copy(grown, buf)
+		putBuffer(buf)
+		buf = grown
+	}
+	return append(buf, data...)
+}
+
+// 反应堆模式下有数据要发送时启动 writer，已经在运行的话什么都不做。goroutine 模式下 writer 一直在运行，不需要唤醒
+func (c *Connection) wakeWriter() {
+	if c.reactor == nil {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&c.writing, 0, 1) {
+		go c.flushWriter()
+	}
+}
+
+// 按需启动的 writer：把发送队列中的数据都写完就退出，和 StartWriter 一样合并写入
+func (c *Connection) flushWriter() {
+	batch := make([]queuedFrame, 0, maxWriteBatchFrames)
+	iov := make(net.Buffers, 0, maxWriteBatchFrames)
+	for {
+		for {
+			var frame queuedFrame
+			select {
+			case frame = <-c.priorityChan:
+			default:
+				select {
+				case frame = <-c.priorityChan:
+				case frame = <-c.msgChan:
+				default:
+				}
+			}
+			if frame.data == nil {
+				break
+			}
+			batch = c.collectBatch(append(batch[:0], frame), len(frame.data))
+			if !c.write(&iov, batch) {
+				return // 连接已经关闭，不用再把 writing 清零
+			}
+		}
+		atomic.StoreInt32(&c.writing, 0)
+		// 清零之前可能刚好有数据入队而没有启动新的 writer，再检查一次
+		if c.QueueDepth() == 0 || !atomic.CompareAndSwapInt32(&c.writing, 0, 1) {
+			return
+		}
+	}
+}
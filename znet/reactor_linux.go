@@ -0,0 +1,218 @@
+//go:build linux
+
+package znet
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// 事件循环每次读 socket 的缓冲大小，一个事件循环共用一个
+	reactorReadBufferSize = 64 << 10
+	// 每次 epoll_wait 最多取出的事件数
+	reactorMaxEvents = 256
+)
+
+// epoll 实现的反应堆，连接按轮询分给各个事件循环
+type epollReactor struct {
+	loops []*eventLoop
+	next  uint32
+}
+
+// 一个事件循环，一个 goroutine 负责一个 epoll 实例上的所有连接
+type eventLoop struct {
+	epfd   int
+	wakeFd [2]int // 唤醒 epoll_wait 的管道，关闭事件循环时使用
+	closed int32
+	conns  map[int]*Connection // key 是 socket 的文件描述符
+	lock   sync.Mutex          // 保护 conns
+	buf    []byte              // 读缓冲，读出的数据马上拆包，不完整的帧拷贝到连接自己的 pending 中
+}
+
+// 创建 loops 个事件循环，为 0 时等于 CPU 核数
+func newPoller(loops int) (poller, error) {
+	if loops <= 0 {
+		loops = runtime.NumCPU()
+	}
+	r := &epollReactor{}
+	for i := 0; i < loops; i++ {
+		l, err := newEventLoop()
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+		r.loops = append(r.loops, l)
+		go l.run()
+	}
+	logrus.Infof("[reactor] %d 个事件循环已启动", loops)
+	return r, nil
+}
+
+func newEventLoop() (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("epoll_create err: %w", err)
+	}
+	l := &eventLoop{
+		epfd:  epfd,
+		conns: make(map[int]*Connection),
+		buf:   make([]byte, reactorReadBufferSize),
+	}
+	if err := syscall.Pipe2(l.wakeFd[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, fmt.Errorf("pipe err: %w", err)
+	}
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(l.wakeFd[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, l.wakeFd[0], &event); err != nil {
+		l.release()
+		return nil, fmt.Errorf("epoll_ctl err: %w", err)
+	}
+	return l, nil
+}
+
+// 开始监听连接的可读事件。使用水平触发，一次事件只读一次，数据多的连接不会饿着同一个事件循环上的其他连接
+func (r *epollReactor) add(c *Connection) error {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return errors.New("connection does not support SyscallConn")
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	fd := -1
+	if err := rawConn.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return err
+	}
+	c.rawConn, c.fd = rawConn, fd
+	l := r.loops[atomic.AddUint32(&r.next, 1)%uint32(len(r.loops))]
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(fd)}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+		return fmt.Errorf("epoll_ctl err: %w", err)
+	}
+	l.conns[fd] = c
+	return nil
+}
+
+// 不再监听连接。socket 还没有关闭，文件描述符不会被复用
+func (r *epollReactor) remove(c *Connection) {
+	for _, l := range r.loops {
+		l.lock.Lock()
+		if l.conns[c.fd] == c {
+			delete(l.conns, c.fd)
+			syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+			l.lock.Unlock()
+			return
+		}
+		l.lock.Unlock()
+	}
+}
+
+func (r *epollReactor) pause(c *Connection) error {
+	if err := r.ctl(c, syscall.EPOLL_CTL_DEL); err != syscall.ENOENT { // 恢复读取时又要暂停的话，连接还没有重新监听
+		return err
+	}
+	return nil
+}
+
+func (r *epollReactor) resume(c *Connection) error {
+	return r.ctl(c, syscall.EPOLL_CTL_ADD)
+}
+
+// 在连接所属的事件循环上修改对它的监听，连接已经 remove 了的话什么都不做。持有事件循环的锁，remove 之后 socket 才会关闭，不会碰到被复用的文件描述符
+func (r *epollReactor) ctl(c *Connection, op int) error {
+	for _, l := range r.loops {
+		l.lock.Lock()
+		if l.conns[c.fd] == c {
+			event := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(c.fd)}
+			err := syscall.EpollCtl(l.epfd, op, c.fd, &event)
+			l.lock.Unlock()
+			return err
+		}
+		l.lock.Unlock()
+	}
+	return nil
+}
+
+// 关闭所有的事件循环，需要在所有连接都关闭之后调用
+func (r *epollReactor) close() {
+	for _, l := range r.loops {
+		atomic.StoreInt32(&l.closed, 1)
+		syscall.Write(l.wakeFd[1], []byte{0})
+	}
+}
+
+func (l *eventLoop) run() {
+	defer l.release()
+	events := make([]syscall.EpollEvent, reactorMaxEvents)
+	for {
+		n, err := syscall.EpollWait(l.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			logrus.Error("[reactor] epoll_wait err: ", err)
+			return
+		}
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == l.wakeFd[0] {
+				if atomic.LoadInt32(&l.closed) == 1 {
+					return
+				}
+				continue
+			}
+			l.lock.Lock()
+			c := l.conns[fd]
+			l.lock.Unlock()
+			if c != nil {
+				l.onReadable(c)
+			}
+		}
+	}
+}
+
+// socket 可读：读一次数据交给连接拆包，对端关闭或者出错时关闭连接，关闭的工作不在事件循环中进行
+func (l *eventLoop) onReadable(c *Connection) {
+	var n int
+	var readErr error
+	// 通过 RawConn 读，读的过程中其他 goroutine 关闭连接也不会关掉这个文件描述符
+	err := c.rawConn.Read(func(fd uintptr) bool {
+		n, readErr = syscall.Read(int(fd), l.buf)
+		return true // 不管有没有读到数据都不让 runtime 等待，没有数据时等下一次事件
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return
+	}
+	c.feedLock.Lock()
+	defer c.feedLock.Unlock()
+	if err != nil || n == 0 { // n 为 0 说明对端关闭了连接
+		if err != nil && err != syscall.ECONNRESET && c.IsAlive() {
+			logrus.Error("server read err :", err)
+		}
+		c.stopReading()
+		return
+	}
+	if !c.feed(l.buf[:n]) {
+		c.stopReading()
+	}
+}
+
+// 关闭 epoll 实例和唤醒用的管道
+func (l *eventLoop) release() {
+	syscall.Close(l.epfd)
+	syscall.Close(l.wakeFd[0])
+	syscall.Close(l.wakeFd[1])
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package znet
+
+import "errors"
+
+// 其他系统不支持反应堆模式，server 会退回到 goroutine 模式
+func newPoller(loops int) (poller, error) {
+	return nil, errors.New("reactor mode is only supported on linux")
+}
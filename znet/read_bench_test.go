@@ -0,0 +1,184 @@
+package znet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/myZinx/utils"
+	"github.com/myZinx/ziface"
+)
+
+/*
+接收路径的性能对比：
+  - old：每条消息分配包头和数据，binary.Read 反射解析，直接从 socket 读，每次读包头都是一次系统调用
+  - new：现在的 Connection，带缓冲的 reader，消息和数据来自池，处理完后回收
+BenchmarkIdleConn 统计大量空闲连接时每个连接占用的内存
+*/
+
+// 旧的拆包方式
+func legacyUnpack(reader io.Reader) (*Message, error) {
+	headData := make([]byte, MsgHeaderLength)
+	if _, err := io.ReadFull(reader, headData); err != nil {
+		return nil, err
+	}
+	msg := &Message{Version: MsgVersion1}
+	buf := bytes.NewReader(headData)
+	if err := binary.Read(buf, binary.LittleEndian, &msg.MsgId); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &msg.Length); err != nil {
+		return nil, err
+	}
+	msg.Data = make([]byte, msg.Length)
+	if _, err := io.ReadFull(reader, msg.Data); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// 对端不停地发送 n 条 size 大小的消息，先把多条消息拼在一起再写，让接收端成为瓶颈
+func startSending(conn net.Conn, size int, n int) {
+	frame, _ := NewDataPack().Pack(&Message{Version: MsgVersion1, MsgId: utils.MSGID_FILE_RESPOND, Length: uint32(size), Data: make([]byte, size)})
+	perWrite := 64<<10/len(frame) + 1
+	chunk := bytes.Repeat(frame, perWrite)
+	go func() {
+		for sent := 0; sent < n; sent += perWrite {
+			if n-sent < perWrite {
+				chunk = chunk[:(n-sent)*len(frame)]
+			}
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func BenchmarkRead(b *testing.B) {
+	for _, size := range benchSizes() {
+		b.Run(fmt.Sprintf("%dB/old", size), func(b *testing.B) { benchReadOld(b, size) })
+		b.Run(fmt.Sprintf("%dB/new", size), func(b *testing.B) { benchReadNew(b, size) })
+	}
+}
+
+func benchReadOld(b *testing.B, size int) {
+	local, remote := tcpConnPair(b)
+	defer local.Close()
+	defer remote.Close()
+	b.SetBytes(int64(size) + int64(MsgHeaderLength))
+	b.ReportAllocs()
+	// 与旧的 Connection 一样，reader 拆包后交给 worker 处理
+	taskQueue := make(chan *Message, utils.GlobalObj.MaxWorkerTaskLen)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			<-taskQueue
+		}
+		close(done)
+	}()
+	b.ResetTimer()
+	startSending(remote, size, b.N)
+	for i := 0; i < b.N; i++ {
+		msg, err := legacyUnpack(local)
+		if err != nil {
+			b.Fatal(err)
+		}
+		taskQueue <- msg
+	}
+	<-done
+}
+
+// 只计数的 router，收到 want 条消息后关闭 done
+type countRouter struct {
+	BaseRouter
+	n    int64
+	want int64
+	done chan bool
+}
+
+func (r *countRouter) Handle(req ziface.IRequest) {
+	if atomic.AddInt64(&r.n, 1) == r.want {
+		close(r.done)
+	}
+}
+
+func benchReadNew(b *testing.B, size int) {
+	local, remote := tcpConnPair(b)
+	defer remote.Close()
+	router := &countRouter{want: int64(b.N), done: make(chan bool)}
+	msgHandler := NewMessageHandler()
+	msgHandler.WorkerPoolSize = 1
+	msgHandler.AddRouter(utils.MSGID_FILE_RESPOND, router)
+	msgHandler.StartWorkerPool()
+	defer msgHandler.StopWorkerPool()
+	conn := NewConnection(local, 1, msgHandler, nil)
+	b.SetBytes(int64(size) + int64(MsgHeaderLength))
+	b.ReportAllocs()
+	b.ResetTimer()
+	conn.Start()
+	defer conn.Stop()
+	startSending(remote, size, b.N)
+	<-router.done
+}
+
+// 当前栈和堆占用的内存。GC 两次，把 sync.Pool 中缓存的对象也清掉
+func memInUse() int64 {
+	runtime.GC()
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapInuse + stats.StackInuse)
+}
+
+// 统计空闲连接占用的内存时每次建立的连接数
+const benchIdleConns = 1000
+
+// 统计空闲连接每个连接占用的内存：现在的 Connection（不开心跳），以及它的 reader 换成每个连接一个 4KB 的 bufio.Reader 时多出的内存。
+// 结果在 conn-B 和 bufio-B 两列，ns/op 没有意义
+func BenchmarkIdleConn(b *testing.B) {
+	var perConn, perBufio int64
+	for i := 0; i < b.N; i++ {
+		c, r := measureIdle(b, benchIdleConns)
+		perConn += c
+		perBufio += r
+	}
+	b.ReportMetric(float64(perConn)/float64(b.N), "conn-B")
+	b.ReportMetric(float64(perBufio)/float64(b.N), "bufio-B")
+}
+
+func measureIdle(b *testing.B, n int) (perConn int64, perBufio int64) {
+	pairs := make([][2]net.Conn, n)
+	for i := range pairs {
+		pairs[i][0], pairs[i][1] = tcpConnPair(b)
+	}
+	msgHandler := NewMessageHandler()
+	msgHandler.StartWorkerPool()
+	defer msgHandler.StopWorkerPool()
+	before := memInUse()
+	conns := make([]*Connection, n)
+	for i := range conns {
+		conns[i] = NewConnection(pairs[i][0], uint32(i+1), msgHandler, nil)
+		conns[i].Start()
+	}
+	time.Sleep(100 * time.Millisecond) // 等所有 reader 阻塞在读包头上
+	perConn = (memInUse() - before) / int64(n)
+	before = memInUse()
+	readers := make([]*bufio.Reader, n)
+	for i := range readers {
+		readers[i] = bufio.NewReaderSize(pairs[i][1], 4<<10)
+	}
+	perBufio = (memInUse() - before) / int64(n)
+	runtime.KeepAlive(readers)
+	for i := range conns {
+		conns[i].Stop()
+		pairs[i][1].Close()
+	}
+	return perConn, perBufio
+}
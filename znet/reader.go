@@ -0,0 +1,60 @@
+package znet
+
+import "io"
+
+// 连接读缓冲的大小
+const readBufferSize = 4 << 10
+
+/*
+连接的带缓冲的 reader，与 bufio.Reader 类似，一次系统调用读出尽量多的数据，拆包时的小块读取都从缓冲中拿。
+不同的是缓冲从缓冲池中取，缓冲中的数据读完就还回去：没有数据时 reader 直接阻塞在读包头上，
+空闲的连接不占用读缓冲，6 万个连接大部分时间空闲时也不会每个都占着 4KB
+*/
+type connReader struct {
+	rd   io.Reader
+	buf  []byte // 读缓冲，没有缓存的数据时为 nil
+	r, w int    // buf 中未读数据的起止位置
+	// 上一次直接读取时把调用方的切片读满了，说明对端很可能还有数据，下一次就用缓冲去读
+	hot bool
+}
+
+func newConnReader(rd io.Reader) *connReader {
+	return &connReader{rd: rd}
+}
+
+func (b *connReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if b.r == b.w {
+		// 没有缓存的数据：要读的数据比缓冲还大，或者对端可能暂时没有数据了（比如在等下一个包头），直接读到调用方的切片中
+		if len(p) >= readBufferSize || !b.hot {
+			n, err := b.rd.Read(p)
+			b.hot = n == len(p)
+			return n, err
+		}
+		b.buf = getBuffer(readBufferSize)
+		n, err := b.rd.Read(b.buf)
+		if n == 0 {
+			b.release()
+			return 0, err
+		}
+		b.w = n
+	}
+	n := copy(p, b.buf[b.r:b.w])
+	b.r += n
+	if b.r == b.w { // 缓冲读完了，对端的数据可能也已经读完，下一次直接读
+		b.release()
+		b.hot = false
+	}
+	return n, nil
+}
+
+// 把读缓冲还回缓冲池
+func (b *connReader) release() {
+	if b.buf != nil {
+		putBuffer(b.buf)
+		b.buf = nil
+	}
+	b.r, b.w = 0, 0
+}
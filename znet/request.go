@@ -1,12 +1,26 @@
 package znet
 
-import "github.com/myZinx/ziface"
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/myZinx/ziface"
+	"github.com/sirupsen/logrus"
+)
 
 type Request struct {
 	//  当前连接
 	conn ziface.IConnection
 	//  当前请求的消息数据
 	msg ziface.IMessage
+	// 当前请求的上下文，默认就是连接的上下文
+	ctx context.Context
+	// 引用计数，创建时为 1，Retain 加一，Release 减一，减到 0 时把消息的缓冲还回池中
+	refs int32
+}
+
+func newRequest(conn ziface.IConnection, msg ziface.IMessage, ctx context.Context) *Request {
+	return &Request{conn: conn, msg: msg, ctx: ctx, refs: 1}
 }
 
 // 得到当前连接
@@ -25,3 +39,49 @@ func (r *Request) GetMsgLen() uint32 {
 	// 返回消息的内容长度
 	return uint32(len(r.msg.GetData()))
 }
+
+// 得到当前请求的完整消息
+func (r *Request) GetMessage() ziface.IMessage {
+	return r.msg
+}
+
+// 回复当前请求，对端如果是用 Call 发来的请求，就会收到这个回复
+func (r *Request) Reply(data []byte) error {
+	return r.conn.SendMessage(&Message{
+		Flags:  MsgFlagResponse,
+		SeqId:  r.msg.GetSeqId(),
+		MsgId:  r.msg.GetMsgId(),
+		Length: uint32(len(data)),
+		Data:   data,
+	})
+}
+
+// 得到当前请求的上下文
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return r.conn.Context()
+	}
+	return r.ctx
+}
+
+// 替换当前请求的上下文
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// 保留当前请求的数据，router 在 Handle 返回之后还要使用请求的数据或消息（比如交给别的 goroutine）时必须先调用，
+// 用完后再调用一次 Release
+func (r *Request) Retain() {
+	atomic.AddInt32(&r.refs, 1)
+}
+
+// 释放当前请求的数据，引用计数减到 0 时消息和数据的缓冲会还回池中，之后不能再使用 GetData 和 GetMessage 得到的数据。
+// 工作池处理完请求后会自动调用一次，router 一般不用调用
+func (r *Request) Release() {
+	refs := atomic.AddInt32(&r.refs, -1)
+	if refs == 0 {
+		freeMessage(r.msg)
+	} else if refs < 0 {
+		logrus.Warnf("[connId: %d | msgId: %d] request released too many times", r.conn.GetConnID(), r.msg.GetMsgId())
+	}
+}
@@ -35,7 +35,14 @@ func (br *HeartbeatDefaultRouter) Handle(req ziface.IRequest) {
 	conn := req.GetConnection()
 	data := req.GetData() // 得到的只是数据，不包含message 的头
 	logrus.Debugf("[connId: %d | remote: %v | msgId: %s]: %s", conn.GetConnID(),
-		conn.GetTCPConnection().RemoteAddr(), utils.GlobalObj.MsgIdDesc[req.GetMsgId()], string(data))
+		conn.RemoteAddr(), utils.GlobalObj.MsgIdDesc[req.GetMsgId()], string(data))
+	// 回复 v2 的心跳包（带上它的序列号），对端的心跳检测器据此计算 RTT。v1 的帧区分不了心跳包和回复，不回复，否则两端会一直互相回复
+	msg := req.GetMessage()
+	if msg.GetVersion() == MsgVersion2 && !msg.HasFlag(MsgFlagResponse) {
+		if err := req.Reply(nil); err != nil {
+			logrus.Debug("回复心跳包出错：err = ", err)
+		}
+	}
 }
 
 // 默认的 客户端发给server的普通消息 的路由处理
@@ -47,7 +54,18 @@ func (br *GeneralMsgRouter) Handle(req ziface.IRequest) {
 	conn := req.GetConnection()
 	data := req.GetData() // 得到的只是数据，不包含message 的头
 	logrus.Infof("[connId: %d | remote: %v | msgId: %s]: %s", conn.GetConnID(),
-		conn.GetTCPConnection().RemoteAddr(), utils.GlobalObj.MsgIdDesc[req.GetMsgId()], string(data))
+		conn.RemoteAddr(), utils.GlobalObj.MsgIdDesc[req.GetMsgId()], string(data))
+}
+
+// 默认的 收到对端回复的错误消息 的路由处理
+type ErrorMsgRouter struct {
+	BaseRouter
+}
+
+func (br *ErrorMsgRouter) Handle(req ziface.IRequest) {
+	conn := req.GetConnection()
+	logrus.Warnf("[connId: %d | remote: %v | msgId: %s]: %s", conn.GetConnID(),
+		conn.RemoteAddr(), utils.GlobalObj.MsgIdDesc[req.GetMsgId()], string(req.GetData()))
 }
 
 // 默认的 客户端希望得到server消息响应 的路由处理
@@ -59,10 +77,9 @@ func (br *PingRouter) Handle(req ziface.IRequest) {
 	conn := req.GetConnection()
 	data := req.GetData() // 得到的只是数据，不包含message 的头
 	logrus.Infof("[connId: %d | remote: %v | msgId: %s]: %s", conn.GetConnID(),
-		conn.GetTCPConnection().RemoteAddr(), utils.GlobalObj.MsgIdDesc[req.GetMsgId()], string(data))
-	// 数据回复
-	respondMsg := []byte("server respond!")
-	err := conn.SendMsg(utils.MSGID_PING, uint32(len(respondMsg)), respondMsg)
+		conn.RemoteAddr(), utils.GlobalObj.MsgIdDesc[req.GetMsgId()], string(data))
+	// 数据回复，带上请求的序列号和回复标志，对端的 Call 才能把回复和请求对应起来（v1 的帧不会带这些信息）
+	err := req.Reply([]byte("server respond!"))
 	if err != nil {
 		logrus.Errorln("router handle err :", err)
 		return
@@ -76,6 +93,20 @@ type FileRequestRouter struct {
 
 // FileRequest数据包中，data就是文件名
 func (br *FileRequestRouter) Handle(req ziface.IRequest) {
+	// UDP 会话的一个帧就是一个数据报，装不下 MaxFilePackageSize 的文件块，直接告诉对端不支持
+	if isUDPSession(req.GetConnection()) {
+		errMsg := []byte("file transfer is not supported over UDP")
+		if err := req.GetConnection().SendMessage(&Message{
+			Flags:  MsgFlagResponse,
+			SeqId:  req.GetMessage().GetSeqId(),
+			MsgId:  utils.MSGID_ERROR,
+			Length: uint32(len(errMsg)),
+			Data:   errMsg,
+		}); err != nil {
+			logrus.Error("回复不支持文件传输出错， err= ", err)
+		}
+		return
+	}
 	// 先用Pack把一个 FILE_RESPOND 数据包头准备好的包发过去，包头中length就是文件大小
 	filePath := fmt.Sprintf("files/%s", string(req.GetData()))
 	file, err := os.Open(filePath)
@@ -93,6 +124,13 @@ func (br *FileRequestRouter) Handle(req ziface.IRequest) {
 			logrus.Info("未开启或已关闭文件传输")
 			return
 		}
+		// 连接关闭、服务器关闭或者处理超时，请求的上下文都会被取消，也停止传输
+		select {
+		case <-req.Context().Done():
+			logrus.Infof("向 %d号连接发送文件 %s 被取消：%v", conn.GetConnID(), string(req.GetData()), req.Context().Err())
+			return
+		default:
+		}
 		n, err := file.Read(buffer) // 读到文件末尾（即最后一次读）会返回 0, io.EOF
 		if err == io.EOF {          // 文件读取完毕
 			// logrus.Infof("向 %d号连接发送文件 %s 成功。", req.GetConnection().GetConnID(), string(req.GetData()))
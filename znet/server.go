@@ -1,9 +1,12 @@
 package znet
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
 	"math/rand"
 	"net"
+	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,36 +18,79 @@ import (
 // IServer的接口实现
 type Server struct {
 	Name       string
-	IPVersion  string
+	IPVersion  string // 监听的网络，"tcp4"、"tcp"、"tcp6" 或 "unix"
 	IP         string
 	Port       int
+	UnixPath   string                 // IPVersion 为 "unix" 时监听的 socket 路径
 	MsgHandler ziface.IMessageHandler // 当前server注册的连接对应的处理处理业务的router
 	ConnMgr    ziface.IConnManager    // 该server的连接管理器
+	DataPack   ziface.IDataPack       // 该server的连接使用的封包拆包模块
+	TLSConfig  *tls.Config            // 不为 nil 时使用 TLS，可以用 SetTLSConfig 设置，也可以在 GlobalObj 中配置证书文件
 	// 添加该server 创建连接之后自动调用 hook 函数
 	OnConnStart func(ziface.IConnection)
 	// 添加该server 创建连接之后自动调用 hook 函数
 	OnConnStop func(ziface.IConnection)
+	// router 处理消息发生 panic 时调用的 hook 函数
+	OnHandlerPanic func(ziface.IRequest, any)
+	// 连接的认证器，为 nil 时不需要认证；连接认证成功之后自动调用的 hook 函数
+	Authenticator ziface.IAuthenticator
+	OnConnAuth    func(ziface.IConnection)
+	// 拒绝连接时调用的 hook 函数，返回后连接会被关闭
+	OnConnReject func(net.Conn, ziface.RejectReason)
 	// 是否开启连接的心跳检测器，为true的话，此服务器的每个连接都会默认开启
 	UseHeartBeat bool
-	AllowFileReq bool // 从gin 服务器中得到可否 运行 文件请求
+	// 不压缩的消息ID，默认是 GlobalObj.CompressSkipMsgIDs，需要在 Start 之前设置
+	CompressSkipMsgIDs []uint32
+	AllowFileReq       bool // 从gin 服务器中得到可否 运行 文件请求
 
 	cId uint32 // 每来一个连接给分配一个cId使用原子方法进行自增
+
+	// 当前server 的所有监听器，key 是监听器的名称，Stop 时关闭它们以停止接收新的连接
+	listeners    map[string]*serverListener
+	listenerLock sync.Mutex   // 保护 listeners 和 started
+	started      bool         // 是否已经 Start，之后添加的监听器立即开始监听
+	wsServer     *http.Server // 单独监听 WebSocket 的 http 服务，没有配置 WsPort 时为 nil
+	wsListenner  net.Listener // wsServer 的监听器
+	// UDP 的 socket 和按对端地址索引的会话，没有配置 UdpPort 时为 nil
+	udpListenner *net.UDPConn
+	udpSessions  map[string]*udpSession
+	udpLock      sync.Mutex // 保护 udpSessions
+	reactor      poller     // 反应堆模式的事件循环，没有开启 GlobalObj.UseReactor 时为 nil
+	exitChan     chan bool  // Stop 完成后关闭此通道，Serve 随之返回
+	stopOnce     sync.Once  // 保证 Stop 只执行一次
+	stopping     int32      // Stop 开始后为 1，不再添加监听器、不再建立新的 UDP 会话，用原子操作
+	// 接收连接时的访问控制：黑白名单、每个 IP 的连接数和接收新连接的速率
+	access *accessControl
+	// 所有连接一起的压缩统计；Start 时由 CompressSkipMsgIDs 生成的集合，所有连接共用，之后只读
+	compressTotal compressCounters
+	compressSkip  map[uint32]struct{}
+
+	ctx    context.Context    // server 的上下文，所有连接的上下文都从这里派生
+	cancel context.CancelFunc // Stop 等待正在处理的请求超时后调用，通知它们尽快结束
 }
 
 // 初始化 Server 模块
 func NewServer(name string) *Server {
 	s := &Server{
-		Name:         name,
-		IPVersion:    "tcp4",
-		IP:           utils.GlobalObj.Host,
-		Port:         utils.GlobalObj.Port,
-		MsgHandler:   NewMessageHandler(),
-		ConnMgr:      NewConnManager(),
-		OnConnStart:  func(ziface.IConnection) {},
-		OnConnStop:   func(ziface.IConnection) {}, // 给所有的连接注册两个空的钩子函数，如果开发者不自己提供的话
-		UseHeartBeat: true,
-		AllowFileReq: true, // 默认最开始是可以文件请求
+		Name:               name,
+		IPVersion:          utils.GlobalObj.Network,
+		IP:                 utils.GlobalObj.Host,
+		Port:               utils.GlobalObj.Port,
+		UnixPath:           utils.GlobalObj.UnixSocketPath,
+		MsgHandler:         NewMessageHandler(),
+		ConnMgr:            NewConnManager(),
+		DataPack:           NewDataPack(),
+		OnConnStart:        func(ziface.IConnection) {},
+		OnConnStop:         func(ziface.IConnection) {}, // 给所有的连接注册两个空的钩子函数，如果开发者不自己提供的话
+		UseHeartBeat:       true,
+		AllowFileReq:       true, // 默认最开始是可以文件请求
+		CompressSkipMsgIDs: append([]uint32(nil), utils.GlobalObj.CompressSkipMsgIDs...),
+		listeners:          make(map[string]*serverListener),
+		udpSessions:        make(map[string]*udpSession),
+		access:             newAccessControl(),
+		exitChan:           make(chan bool),
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 	// 设置消息的router
 	s.ConnMgr.SetServer(s) // 设置连接管理模块对应的server
 	if s.UseHeartBeat {
@@ -53,65 +99,176 @@ func NewServer(name string) *Server {
 	s.AddRouter(utils.MSGID_GENERAL_MSG, &GeneralMsgRouter{})
 	s.AddRouter(utils.MSGID_PING, &PingRouter{})
 	s.AddRouter(utils.MSGID_FILE_REQUEST, &FileRequestRouter{})
+	s.SetAsync(utils.MSGID_FILE_REQUEST, true) // 一次文件请求要把整个文件发完，不能占着 worker
 	s.AddRouter(utils.MSGID_FILE_RESPOND, nil) // server 不会收到 file respond
+	s.AddRouter(utils.MSGID_ERROR, &ErrorMsgRouter{})
+	s.AddRouter(utils.MSGID_AUTH, nil)          // 认证帧由连接自己交给认证器，不会交给 router
+	s.AddRouter(utils.MSGID_COMPRESSION, nil)   // 协商压缩的帧由连接自己处理，不会交给 router
+	s.AddRouter(utils.MSGID_FRAME_VERSION, nil) // 协商帧格式版本的帧由连接自己处理，不会交给 router
 	return s
 }
 
-// 开始服务器
-func (s *Server) Start() {
-	// 开启一个tcp 服务器
-	go s.GetConnMgr().ConnManage() // 开启连接管理器 管理连接增加和删除的方法
-	go func() {                    // 防止start 函数等待连接阻塞
-		// 1 获取一个 TCP 的addr
-		addr, err := net.ResolveTCPAddr(s.IPVersion, fmt.Sprintf("%s:%d", s.IP, s.Port)) // 得到一个tcp句柄
+// 开始服务器，监听失败时返回错误。等待客户端连接的循环在另外的goroutine 中，不会阻塞
+func (s *Server) Start() error {
+	// 配置可能是从 zinx.json 读的，也可能是代码中直接改的，不合法的话不启动
+	err := utils.GlobalObj.Check()
+	if err != nil {
+		return err
+	}
+	// 没有用 SetAccessPolicy 设置过访问控制策略的话，使用 GlobalObj 中的配置
+	if !s.access.isConfigured() {
+		err = s.SetAccessPolicy(ziface.AccessPolicy{
+			AllowCIDRs:    utils.GlobalObj.AllowCIDRs,
+			DenyCIDRs:     utils.GlobalObj.DenyCIDRs,
+			MaxConnsPerIP: utils.GlobalObj.MaxConnsPerIP,
+			AcceptRate:    utils.GlobalObj.AcceptRate,
+			AcceptBurst:   utils.GlobalObj.AcceptBurst,
+		})
 		if err != nil {
-			logrus.Panic(err)
+			return err
 		}
-		// 2 监听服务器的地址
-		listenner, err := net.ListenTCP(s.IPVersion, addr)
+	}
+	s.compressSkip = newMsgIDSet(s.CompressSkipMsgIDs)
+	// 配置了证书的话，默认的监听器使用 TLS
+	if s.TLSConfig == nil && utils.GlobalObj.TLSCertFile != "" && utils.GlobalObj.TLSKeyFile != "" {
+		s.TLSConfig, err = NewServerTLSConfig(utils.GlobalObj.TLSCertFile, utils.GlobalObj.TLSKeyFile, utils.GlobalObj.TLSClientCAFile)
 		if err != nil {
-			logrus.Panic(err)
+			return err
+		}
+	}
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	// 1 打开默认的监听器、Start 之前添加的监听器以及 WebSocket 和 UDP 的监听，这时还不接收连接，失败的话都关掉
+	if err := s.openAllListeners(); err != nil {
+		return err
+	}
+	if err := s.startWebSocket(); err != nil {
+		s.closeAllListeners()
+		return err
+	}
+	if err := s.startUDP(); err != nil {
+		s.closeAllListeners()
+		if s.wsListenner != nil {
+			s.wsListenner.Close()
+			s.wsServer, s.wsListenner = nil, nil
 		}
-		logrus.Infof("[start] Server %s Listenner at IP %s, Port %d is started\n", s.Name, s.IP, s.Port)
-		// 3 阻塞，等待客户端连接，处理客户端连接业务，读写
-		for {
-			// 如果有客户端连接，此函数便有返回了，然后将conn传给我们自定的连接对象
-			conn, err := listenner.AcceptTCP()
-			if err != nil {
-				logrus.Warnf("connection accept err: %v\n", err)
-				continue
-			}
-			// 判断当前连接个数是否超过最大值，
-			if s.ConnMgr.Len() >= utils.GlobalObj.MaxConn {
-				logrus.Warnln("连接数已到达上限!!!")
-				conn.Close()
-				continue
-			}
-			// 客户端连接server 成功
-			newcId := atomic.AddUint32(&s.cId, 1)
-			dealConn := NewConnection(conn, newcId, s.MsgHandler, s.ConnMgr.GetConnMgrChan())
-			if s.UseHeartBeat {
-				s.bindHeartBeatChecker(dealConn)
-			}
-			dealConn.SetServer(s) // 给每个连接设置server
-			go dealConn.Start()   // 每个客户端应该异步开启连接，所以这里需要使用 goroutine
+		return err
+	}
+	// 2 先开启工作池和连接管理器，之后任何一种连接进来时都可以直接交给它们
+	if utils.GlobalObj.UseReactor {
+		if s.reactor, err = newPoller(utils.GlobalObj.ReactorLoops); err != nil {
+			logrus.Warn("开启反应堆模式失败，所有连接使用 goroutine 模式，err = ", err)
+			s.reactor = nil // 不能让接口保存值为 nil 的指针
 		}
-	}()
+	}
+	go s.GetConnMgr().ConnManage() // 开启连接管理器 管理连接增加和删除的方法
+	s.MsgHandler.StartWorkerPool() // 开启消息处理的工作池
+	// 3 每个监听器开启一个等待连接的goroutine，防止start 函数等待连接阻塞
+	for _, l := range s.listeners {
+		go s.acceptLoop(l)
+	}
+	if s.wsServer != nil {
+		go s.serveWsListener()
+	}
+	if s.udpListenner != nil {
+		s.serveUDP()
+	}
+	s.started = true
+	return nil
 }
 
-// 结束服务器
+// 是否已经开始关闭
+func (s *Server) isStopping() bool {
+	return atomic.LoadInt32(&s.stopping) == 1
+}
+
+// 处理一个新接收的 socket：TLS 连接先完成握手，然后包装成 Connection 并启动
+func (s *Server) handleConn(conn net.Conn, listenerName string) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(time.Duration(utils.GlobalObj.TLSHandshakeTimeout) * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			logrus.Warnf("TLS handshake with %v err: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			s.access.release(conn.RemoteAddr())
+			return
+		}
+		tlsConn.SetDeadline(time.Time{}) // 握手完成后取消超时时间
+	}
+	s.startConn(conn, listenerName)
+}
+
+// 把 socket 包装成 Connection 并启动，TCP、TLS、WebSocket 的连接和 UDP 的会话都从这里开始，对 router 和连接管理器来说没有区别
+func (s *Server) startConn(conn net.Conn, listenerName string) *Connection {
+	// 客户端连接server 成功
+	newcId := atomic.AddUint32(&s.cId, 1)
+	dealConn := NewConnection(conn, newcId, s.MsgHandler, s.ConnMgr.GetConnMgrChan())
+	dealConn.connMgrExit = s.ConnMgr.GetExitChan()
+	dealConn.SetListenerName(listenerName)
+	dealConn.SetDataPack(s.DataPack)
+	setPeerCredProperties(dealConn) // Unix domain socket 的连接保存对端进程的凭证，OnConnStart 中就可以使用
+	// UDP 会话不发心跳，按空闲时间过期
+	if _, isUDP := conn.(*udpSession); s.UseHeartBeat && !isUDP {
+		s.bindHeartBeatChecker(dealConn)
+	}
+	dealConn.SetServer(s) // 给每个连接设置server
+	if s.reactor != nil && canUseReactor(conn, s.DataPack) {
+		dealConn.reactor = s.reactor
+	}
+	if cm, ok := s.ConnMgr.(*ConnManager); ok {
+		dealConn.limiter = cm.limiter
+	}
+	dealConn.access = s.access
+	dealConn.compressTotal = &s.compressTotal
+	dealConn.compressSkip = s.compressSkip
+	dealConn.setAuthenticator(s.Authenticator)
+	dealConn.Start()
+	return dealConn
+}
+
+// 结束服务器。先关闭监听不再接收新的连接，再等待正在处理的请求（包括正在传输的文件）完成，最多等待 GlobalObj.ShutdownTimeout 秒；
+// 超时后才取消server 的上下文通知还没处理完的请求尽快结束，并强制关闭剩下的所有连接。Stop 返回后 Serve 也会返回
 func (s *Server) Stop() {
-	logrus.Infoln("Zinx Stopepd !!!")
-	s.ConnMgr.Clear()
+	s.stopOnce.Do(func() {
+		logrus.Infoln("Zinx Stopping ...")
+		atomic.StoreInt32(&s.stopping, 1)
+		s.listenerLock.Lock()
+		s.closeAllListeners()
+		s.listenerLock.Unlock()
+		if s.wsServer != nil {
+			s.wsServer.Close() // 已经建立的 WebSocket 连接不受影响，后面和 TCP 连接一起处理
+		}
+		if s.udpListenner != nil {
+			// 关闭后 UDP 会话不会再收到数据，但仍然可以用这个 socket 回复，所以等连接都关闭了再关
+			defer s.udpListenner.Close()
+		}
+		// 等待已经交给工作池的请求处理完，这期间请求的上下文不会被取消；超时也不再等了
+		timeout := time.Duration(utils.GlobalObj.ShutdownTimeout) * time.Second
+		if s.MsgHandler.Drain(timeout) {
+			logrus.Infoln("所有正在处理的请求均已完成")
+		}
+		// 超时的话取消server 的上下文，让还没处理完的请求尽快结束；都处理完了的话只是释放上下文
+		s.cancel()
+		// 强制关闭剩余的连接，并等待连接管理器把它们都删除
+		s.ConnMgr.Clear()
+		s.ConnMgr.Stop(5 * time.Second)
+		s.MsgHandler.StopWorkerPool()
+		if s.reactor != nil {
+			s.reactor.close()
+		}
+		logrus.Infoln("Zinx Stopepd !!!")
+		close(s.exitChan)
+	})
 }
 
-// 运行服务器
-func (s *Server) Serve() {
+// 运行服务器，阻塞直到服务器被 Stop，正常关闭时返回 nil，启动失败时返回错误
+func (s *Server) Serve() error {
 	// 启动server 的服务功能
-	s.Start()
-	// TODO 完成额外业务
-	// 用户调用Serve后，即开启服务器了，此时应阻塞住，
-	select {}
+	if err := s.Start(); err != nil {
+		return err
+	}
+	// 用户调用Serve后，即开启服务器了，此时应阻塞住，直到 Stop 完成
+	<-s.exitChan
+	return nil
 }
 
 // 路由功能：给当前的服务注册一个路由功能，供客户端的连接使用
@@ -119,6 +276,31 @@ func (s *Server) AddRouter(msgID uint32, router ziface.IRouter) {
 	s.MsgHandler.AddRouter(msgID, router)
 }
 
+// 给当前的服务添加全局的中间件，所有消息（包括内置的router）都会经过
+func (s *Server) Use(middlewares ...ziface.MiddlewareFunc) {
+	s.MsgHandler.Use(middlewares...)
+}
+
+// 给当前的服务添加只对某个消息ID 生效的中间件
+func (s *Server) UseFor(msgID uint32, middlewares ...ziface.MiddlewareFunc) {
+	s.MsgHandler.UseFor(msgID, middlewares...)
+}
+
+// 设置当前服务默认监听器使用的 TLS 配置，需要在 Start 之前设置。需要双向认证时设置 ClientAuth 和 ClientCAs；其他监听器在 AddListener 时单独设置
+func (s *Server) SetTLSConfig(config *tls.Config) {
+	s.TLSConfig = config
+}
+
+// 设置当前服务使用的封包拆包模块，需要在 Start 之前设置
+func (s *Server) SetDataPack(dp ziface.IDataPack) {
+	s.DataPack = dp
+}
+
+// 得到当前服务使用的封包拆包模块
+func (s *Server) GetDataPack() ziface.IDataPack {
+	return s.DataPack
+}
+
 // 得到连接管理器
 func (s *Server) GetConnMgr() ziface.IConnManager {
 	return s.ConnMgr
@@ -152,8 +334,42 @@ func (s *Server) CallOnConnStop(conn ziface.IConnection) {
 	}
 }
 
+// 设置连接的认证器，需要在 Start 之前设置
+func (s *Server) SetAuthenticator(authenticator ziface.IAuthenticator) {
+	s.Authenticator = authenticator
+}
+
+// 设置该server 的连接认证成功之后自动调用的 hook 函数
+func (s *Server) SetOnConnAuth(hookFunc func(ziface.IConnection)) {
+	s.OnConnAuth = hookFunc
+}
+
+// 调用该server 的连接认证成功之后自动调用的 hook 函数，在读取该连接的 goroutine 中执行，返回之后才会处理该连接之后的消息
+func (s *Server) CallOnConnAuth(conn ziface.IConnection) {
+	if s.OnConnAuth != nil {
+		s.OnConnAuth(conn)
+	}
+}
+
+// 设置 router 处理消息发生 panic 时调用的 hook 函数
+func (s *Server) SetOnHandlerPanic(hookFunc func(ziface.IRequest, any)) {
+	s.OnHandlerPanic = hookFunc
+}
+
+// 调用 router 处理消息发生 panic 时的 hook 函数，具体的调用是在 MessageHandler 中执行的
+func (s *Server) CallOnHandlerPanic(req ziface.IRequest, r any) {
+	if s.OnHandlerPanic != nil {
+		s.OnHandlerPanic(req, r)
+	}
+}
+
 // 给连接绑定心跳检测器
 func (s *Server) bindHeartBeatChecker(conn ziface.IConnection) {
+	bindRandomHeartBeatChecker(conn)
+}
+
+// 给连接绑定一个发送间隔随机的心跳检测器，server 和客户端的连接都使用
+func bindRandomHeartBeatChecker(conn ziface.IConnection) {
 	// 设定最大值和最小值，具体连接的发送间隔去其中的随机数。因为设定唯一值会使所有连接同时发心跳包，当连接过多时会导致突发流量
 	source := rand.NewSource(int64(conn.GetConnID())) // 根据流ID 生成随机数种子。
 	randNumGenetor := rand.New(source)
@@ -164,3 +380,18 @@ func (s *Server) bindHeartBeatChecker(conn ziface.IConnection) {
 func (s *Server) IsAllowFileReq() bool {
 	return s.AllowFileReq
 }
+
+// 得到server 的上下文，服务器关闭时等待正在处理的请求超时后会被取消
+func (s *Server) Context() context.Context {
+	return s.ctx
+}
+
+// 设置某个消息ID 的处理超时时间，超时后该请求的上下文会被取消
+func (s *Server) SetHandlerTimeout(msgID uint32, timeout time.Duration) {
+	s.MsgHandler.SetHandlerTimeout(msgID, timeout)
+}
+
+// 设置某个消息ID 的消息是否在工作池之外处理
+func (s *Server) SetAsync(msgID uint32, async bool) {
+	s.MsgHandler.SetAsync(msgID, async)
+}
@@ -0,0 +1,244 @@
+package znet
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+snappy 块格式的纯 Go 实现（格式见 https://github.com/google/snappy/blob/main/format_description.txt），只有一个块的压缩和解压，
+没有 snappy 的 framing 格式，标准库中没有 snappy。压缩后的数据可以用其他语言的 snappy 库的 Decode 解压。
+块的开头是原数据长度的 varint，然后是一串元素，每个元素的第一个字节的低 2 位是类型：字面量，或者复制前面已经解出来的数据
+*/
+
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01 // 1 字节偏移（实际是 11 位），长度 4~11
+	snappyTagCopy2   = 0x02 // 2 字节偏移，长度 1~64
+	snappyTagCopy4   = 0x03 // 4 字节偏移，长度 1~64
+
+	// 复制的偏移最多 2 字节，超过 64KB 的数据分成多段压缩，复制不会跨段
+	snappyMaxBlockSize = 1 << 16
+	// 压缩时最后这么多字节不去找重复，直接作为字面量，找重复时一次读 8 个字节就不会越界
+	snappyInputMargin = 16 - 1
+	// 比这还短的数据不去找重复
+	snappyMinNonLiteralBlockSize = 1 + 1 + snappyInputMargin
+	// 找重复时的哈希表大小
+	snappyTableBits = 14
+	snappyTableSize = 1 << snappyTableBits
+)
+
+var errSnappyCorrupt = errors.New("snappy: corrupt input")
+
+// 把 src 压缩后追加到 dst 后面
+func snappyEncode(dst, src []byte) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	dst = append(dst, lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(src)))]...)
+	for len(src) > 0 {
+		block := src
+		if len(block) > snappyMaxBlockSize {
+			block = block[:snappyMaxBlockSize]
+		}
+		src = src[len(block):]
+		if len(block) < snappyMinNonLiteralBlockSize {
+			dst = snappyEmitLiteral(dst, block)
+		} else {
+			dst = snappyEncodeBlock(dst, block)
+		}
+	}
+	return dst
+}
+
+func snappyLoad32(b []byte, i int) uint32 {
+	return binary.LittleEndian.Uint32(b[i:])
+}
+
+func snappyLoad64(b []byte, i int) uint64 {
+	return binary.LittleEndian.Uint64(b[i:])
+}
+
+func snappyHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - snappyTableBits)
+}
+
+// 压缩一段不超过 snappyMaxBlockSize 的数据：用哈希表记录每个 4 字节序列最后出现的位置，找到相同的就输出复制，
+// 一直找不到时逐渐加大步长，不可压缩的数据也很快
+func snappyEncodeBlock(dst, src []byte) []byte {
+	var table [snappyTableSize]uint16
+	sLimit := len(src) - snappyInputMargin
+	nextEmit := 0 // 还没有输出的数据的开始位置
+	s := 1
+	nextHash := snappyHash(snappyLoad32(src, s))
+	for {
+		// 找下一个重复的开始
+		skip := 32
+		nextS := s
+		candidate := 0
+		for {
+			s = nextS
+			step := skip >> 5
+			nextS = s + step
+			skip += step
+			if nextS > sLimit {
+				return snappyEmitLiteral(dst, src[nextEmit:])
+			}
+			candidate = int(table[nextHash])
+			table[nextHash] = uint16(s)
+			nextHash = snappyHash(snappyLoad32(src, nextS))
+			if snappyLoad32(src, s) == snappyLoad32(src, candidate) {
+				break
+			}
+		}
+		dst = snappyEmitLiteral(dst, src[nextEmit:s])
+		// 输出复制，复制完紧接着的位置可能又是一个重复，继续找
+		for {
+			base := s
+			s += 4
+			for i := candidate + 4; s < len(src) && src[i] == src[s]; i, s = i+1, s+1 {
+			}
+			dst = snappyEmitCopy(dst, base-candidate, s-base)
+			nextEmit = s
+			if s >= sLimit {
+				return snappyEmitLiteral(dst, src[nextEmit:])
+			}
+			x := snappyLoad64(src, s-1)
+			table[snappyHash(uint32(x))] = uint16(s - 1)
+			currHash := snappyHash(uint32(x >> 8))
+			candidate = int(table[currHash])
+			table[currHash] = uint16(s)
+			if uint32(x>>8) != snappyLoad32(src, candidate) {
+				nextHash = snappyHash(uint32(x >> 16))
+				s++
+				break
+			}
+		}
+	}
+}
+
+// 输出字面量，长度减一小于 60 时放在类型字节的高 6 位，否则放在后面的 1~4 个字节中
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// 输出复制，offset 小于 snappyMaxBlockSize，length 至少为 4。一个元素最多复制 64 字节，更长的拆成多个
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		// 剩下的不足 4 字节的话无法单独复制，这里先复制 60 字节
+		dst = append(dst, 59<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappyTagCopy1, byte(offset))
+}
+
+// 读出块开头的原数据长度，返回长度和它占的字节数
+func snappyDecodedLen(src []byte) (int, int, error) {
+	v, n := binary.Uvarint(src)
+	if n <= 0 || v > 1<<31-1 {
+		return 0, 0, errSnappyCorrupt
+	}
+	return int(v), n, nil
+}
+
+// 解压一个块到 dst 中，dst 的长度必须正好是原数据的长度（见 snappyDecodedLen），src 是长度后面的部分
+func snappyDecode(dst, src []byte) error {
+	d, s := 0, 0
+	for s < len(src) {
+		tag := src[s]
+		var length, offset int
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			x := uint32(tag >> 2)
+			switch {
+			case x < 60:
+				s++
+			case x == 60:
+				s += 2
+				if s > len(src) {
+					return errSnappyCorrupt
+				}
+				x = uint32(src[s-1])
+			case x == 61:
+				s += 3
+				if s > len(src) {
+					return errSnappyCorrupt
+				}
+				x = uint32(src[s-2]) | uint32(src[s-1])<<8
+			case x == 62:
+				s += 4
+				if s > len(src) {
+					return errSnappyCorrupt
+				}
+				x = uint32(src[s-3]) | uint32(src[s-2])<<8 | uint32(src[s-1])<<16
+			default:
+				s += 5
+				if s > len(src) {
+					return errSnappyCorrupt
+				}
+				x = binary.LittleEndian.Uint32(src[s-4:])
+			}
+			length = int(x) + 1
+			if length <= 0 || length > len(dst)-d || length > len(src)-s {
+				return errSnappyCorrupt
+			}
+			copy(dst[d:], src[s:s+length])
+			d += length
+			s += length
+			continue
+		case snappyTagCopy1:
+			s += 2
+			if s > len(src) {
+				return errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2)&0x07
+			offset = int(tag&0xe0)<<3 | int(src[s-1])
+		case snappyTagCopy2:
+			s += 3
+			if s > len(src) {
+				return errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s-2:]))
+		case snappyTagCopy4:
+			s += 5
+			if s > len(src) {
+				return errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s-4:]))
+		}
+		if offset <= 0 || offset > d || length > len(dst)-d {
+			return errSnappyCorrupt
+		}
+		// 复制的范围可能和正在写的部分重叠（比如重复的字节），只能逐个字节复制
+		for end := d + length; d < end; d++ {
+			dst[d] = dst[d-offset]
+		}
+	}
+	if d != len(dst) {
+		return errSnappyCorrupt
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package znet
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/myZinx/ziface"
+)
+
+// 解压 snappyEncode 的结果
+func snappyDecodeAll(src []byte) ([]byte, error) {
+	n, headLen, err := snappyDecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, n)
+	if err := snappyDecode(dst, src[headLen:]); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// 各种需要测试的原数据：空的、很短的、重复的、不可压缩的、超过一个块的
+func snappyTestInputs() map[string][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 100<<10)
+	rnd.Read(random)
+	text := []byte(strings.Repeat("zinx snappy round trip, ", 5000))
+	mixed := make([]byte, 0, 200<<10)
+	for len(mixed) < 200<<10 {
+		if rnd.Intn(2) == 0 {
+			mixed = append(mixed, text[:rnd.Intn(300)]...)
+		} else {
+			mixed = append(mixed, random[:rnd.Intn(300)]...)
+		}
+	}
+	return map[string][]byte{
+		"empty":        {},
+		"one byte":     {'x'},
+		"short":        []byte("hello, zinx"),
+		"min block":    []byte(strings.Repeat("a", snappyMinNonLiteralBlockSize)),
+		"zeros":        make([]byte, 10000),
+		"text":         text,
+		"random":       random,
+		"mixed":        mixed,
+		"block border": text[:snappyMaxBlockSize+1],
+		"long offset":  append(append(append([]byte{}, random[:3000]...), random[:5000]...), random[:3000]...),
+	}
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	for name, src := range snappyTestInputs() {
+		encoded := snappyEncode(nil, src)
+		decoded, err := snappyDecodeAll(encoded)
+		if err != nil {
+			t.Errorf("%s: decode err: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(decoded, src) {
+			t.Errorf("%s: round trip mismatch", name)
+		}
+	}
+}
+
+// 重复的数据要真的被压缩，不可压缩的数据也不能膨胀太多
+func TestSnappyCompresses(t *testing.T) {
+	inputs := snappyTestInputs()
+	if n := len(snappyEncode(nil, inputs["text"])); n > len(inputs["text"])/10 {
+		t.Errorf("repetitive text: encoded %d bytes from %d", n, len(inputs["text"]))
+	}
+	random := inputs["random"]
+	if n := len(snappyEncode(nil, random)); n > len(random)+len(random)/50+32 {
+		t.Errorf("random data: encoded %d bytes from %d", n, len(random))
+	}
+}
+
+// 按格式说明（format_description.txt）手工构造的块，检查解压器对每种元素的理解
+var snappyGoldenBlocks = []struct {
+	name    string
+	encoded []byte
+	decoded string
+}{
+	{"empty", []byte{0x00}, ""},
+	// 长度 3，字面量的长度减一放在类型字节的高 6 位
+	{"literal", []byte{0x03, 0x08, 'a', 'b', 'c'}, "abc"},
+	// 长度 100 的字面量：高 6 位是 60，长度减一放在后面 1 个字节
+	{"literal 1-byte length", append([]byte{0x64, 60 << 2, 99}, strings.Repeat("z", 100)...), strings.Repeat("z", 100)},
+	// 长度 300 的字面量：高 6 位是 61，长度减一放在后面 2 个字节（小端）；原数据长度的 varint 占 2 个字节
+	{"literal 2-byte length", append([]byte{0xac, 0x02, 61 << 2, 0x2b, 0x01}, strings.Repeat("y", 300)...), strings.Repeat("y", 300)},
+	// 1 字节偏移的复制：长度 8（4+4）、偏移 4，复制的范围与正在写的部分重叠
+	{"copy1 overlapping", []byte{0x0c, 0x0c, 'a', 'b', 'c', 'd', 0x11, 0x04}, "abcdabcdabcd"},
+	// 1 字节偏移的复制，偏移的高 3 位在类型字节的高 3 位中：偏移 260 = 0x104
+	{"copy1 high offset bits", append(append([]byte{0x88, 0x02, 61 << 2, 0x03, 0x01}, bytes.Repeat([]byte{'p'}, 259)...), 'q', 0x21, 0x04), strings.Repeat("p", 259) + "q" + strings.Repeat("p", 4)},
+	// 2 字节偏移的复制：长度 4（3+1）、偏移 1
+	{"copy2", []byte{0x05, 0x00, 'a', 0x0e, 0x01, 0x00}, "aaaaa"},
+	// 4 字节偏移的复制：长度 64（63+1）、偏移 2
+	{"copy4", []byte{0x42, 0x04, 'x', 'y', 0xff, 0x02, 0x00, 0x00, 0x00}, strings.Repeat("xy", 33)},
+}
+
+func TestSnappyGoldenDecode(t *testing.T) {
+	for _, g := range snappyGoldenBlocks {
+		decoded, err := snappyDecodeAll(g.encoded)
+		if err != nil {
+			t.Errorf("%s: decode err: %v", g.name, err)
+			continue
+		}
+		if string(decoded) != g.decoded {
+			t.Errorf("%s: decoded %q, want %q", g.name, decoded, g.decoded)
+		}
+	}
+}
+
+// 太短而不去找重复的数据，编码就是长度加一个字面量，与格式说明中的写法一致
+func TestSnappyGoldenEncode(t *testing.T) {
+	if got, want := snappyEncode(nil, []byte("abc")), []byte{0x03, 0x08, 'a', 'b', 'c'}; !bytes.Equal(got, want) {
+		t.Errorf("encode abc = %x, want %x", got, want)
+	}
+	if got, want := snappyEncode(nil, nil), []byte{0x00}; !bytes.Equal(got, want) {
+		t.Errorf("encode empty = %x, want %x", got, want)
+	}
+}
+
+// 损坏的数据要返回错误，不能 panic，也不能写出 dst 的范围
+var snappyCorruptBlocks = map[string][]byte{
+	"no length":             {},
+	"length overflow":       {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+	"truncated literal":     {0x05, 0x10, 'a', 'b'},
+	"literal too long":      {0x02, 0x08, 'a', 'b', 'c'},
+	"short output":          {0x05, 0x08, 'a', 'b', 'c'},
+	"zero offset":           {0x05, 0x00, 'a', 0x0e, 0x00, 0x00},
+	"offset before start":   {0x05, 0x00, 'a', 0x0e, 0x02, 0x00},
+	"copy past end":         {0x03, 0x00, 'a', 0x0e, 0x01, 0x00},
+	"truncated copy1":       {0x05, 0x00, 'a', 0x01},
+	"truncated copy2":       {0x05, 0x00, 'a', 0x0e, 0x01},
+	"truncated copy4":       {0x05, 0x00, 'a', 0x0f, 0x01, 0x00, 0x00},
+	"truncated literal len": {0x64, 60 << 2},
+}
+
+func TestSnappyCorrupt(t *testing.T) {
+	for name, src := range snappyCorruptBlocks {
+		if _, err := snappyDecodeAll(src); err == nil {
+			t.Errorf("%s: decode succeeded", name)
+		}
+	}
+}
+
+func FuzzSnappyDecode(f *testing.F) {
+	for _, g := range snappyGoldenBlocks {
+		f.Add(g.encoded)
+	}
+	for _, src := range snappyCorruptBlocks {
+		f.Add(src)
+	}
+	f.Add(snappyEncode(nil, []byte(strings.Repeat("fuzz snappy ", 20))))
+	f.Fuzz(func(t *testing.T, src []byte) {
+		n, _, err := snappyDecodedLen(src)
+		if err != nil || n > 1<<20 { // 不去分配巨大的缓冲
+			return
+		}
+		decoded, err := snappyDecodeAll(src)
+		if err != nil {
+			return
+		}
+		// 能解压的数据，重新压缩再解压要得到一样的结果
+		again, err := snappyDecodeAll(snappyEncode(nil, decoded))
+		if err != nil {
+			t.Fatalf("decode of re-encoded data: %v", err)
+		}
+		if !bytes.Equal(again, decoded) {
+			t.Fatal("re-encoded data does not round trip")
+		}
+	})
+}
+
+func TestCompressDataRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("zinx compression test line ", 200))
+	for _, codec := range []ziface.CompressionCodec{ziface.CompressFlate, ziface.CompressGzip, ziface.CompressSnappy} {
+		compressed := compressData(codec, data)
+		if compressed == nil {
+			t.Errorf("%v: compressData returned nil for compressible data", codec)
+			continue
+		}
+		if ziface.CompressionCodec(compressed[0]) != codec {
+			t.Errorf("%v: codec byte is %d", codec, compressed[0])
+		}
+		if len(compressed) >= len(data) {
+			t.Errorf("%v: compressed %d bytes to %d", codec, len(data), len(compressed))
+		}
+		decompressed, err := decompressData(compressed, len(data))
+		if err != nil {
+			t.Errorf("%v: decompress err: %v", codec, err)
+			continue
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Errorf("%v: round trip mismatch", codec)
+		}
+	}
+}
+
+// 压缩后没有变小的数据，以及不认识的压缩算法，compressData 都返回 nil，调用方照原样发送
+func TestCompressDataIncompressible(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(2)).Read(random)
+	for _, codec := range []ziface.CompressionCodec{ziface.CompressFlate, ziface.CompressGzip, ziface.CompressSnappy, ziface.CompressNone, 200} {
+		if compressed := compressData(codec, random); compressed != nil {
+			t.Errorf("%v: compressData returned %d bytes for random data", codec, len(compressed))
+		}
+	}
+}
+
+// 解压后超过上限的数据要返回 errDecompressedSize，防止很小的帧解压出巨大的数据
+func TestDecompressDataSizeLimit(t *testing.T) {
+	data := make([]byte, 64<<10)
+	for _, codec := range []ziface.CompressionCodec{ziface.CompressFlate, ziface.CompressGzip, ziface.CompressSnappy} {
+		compressed := compressData(codec, data)
+		if compressed == nil {
+			t.Fatalf("%v: compressData returned nil", codec)
+		}
+		if _, err := decompressData(compressed, len(data)-1); !errors.Is(err, errDecompressedSize) {
+			t.Errorf("%v: decompress with a smaller limit: err = %v, want errDecompressedSize", codec, err)
+		}
+		if out, err := decompressData(compressed, len(data)); err != nil || len(out) != len(data) {
+			t.Errorf("%v: decompress at the exact limit: %d bytes, err = %v", codec, len(out), err)
+		}
+	}
+}
+
+func TestDecompressDataBadInput(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":         nil,
+		"unknown codec": {200, 1, 2, 3},
+		"bad flate":     {byte(ziface.CompressFlate), 0xff, 0xff, 0xff},
+		"bad gzip":      {byte(ziface.CompressGzip), 0x1f, 0x8b, 0x00},
+		"bad snappy":    {byte(ziface.CompressSnappy), 0x05, 0x00, 'a', 0x0e, 0x00, 0x00},
+	} {
+		if _, err := decompressData(data, 1<<20); err == nil {
+			t.Errorf("%s: decompress succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package znet
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/myZinx/utils"
+)
+
+const (
+	// 每一层时间轮的槽数是 2^wheelBits
+	wheelBits  = 6
+	wheelSlots = 1 << wheelBits
+	wheelMask  = wheelSlots - 1
+	// 时间轮的层数，能表示的最长时间是 2^(wheelBits*wheelLevels) 个 tick，更长的定时器按最长时间处理
+	wheelLevels   = 4
+	wheelMaxTicks = 1<<(wheelBits*wheelLevels) - 1
+)
+
+/*
+分层时间轮，所有连接的心跳检测共用一个，代替每个连接一个 goroutine 加一个 time.Ticker。
+第 0 层的每个槽是一个 tick，第 n 层的每个槽是第 n-1 层转一圈的时间。定时器按到期的 tick 数放进合适的层：
+到期时间与当前时间从高位开始第一个不同的层就是它所在的层，第 n 层的槽转到时，把里面的定时器重新放进下面的层，最后在第 0 层到期执行。
+添加、删除、重新设置定时器都是 O(1) 的，只有一个 goroutine 按 tick 推进时间轮
+*/
+type timingWheel struct {
+	tick   time.Duration
+	start  time.Time // 第 0 个 tick 的时间
+	now    uint64    // 已经推进到的 tick 数
+	wheels [wheelLevels][wheelSlots]*list.List
+	lock   sync.Mutex // 保护时间轮和所有定时器的位置
+	// 降层时暂存取下来的定时器，只在推进时间轮时使用
+	cascade []*wheelTimer
+}
+
+// 时间轮上的定时器。到期后在时间轮的 goroutine 中执行 f，f 不能阻塞，否则会推迟其他所有定时器
+type wheelTimer struct {
+	tw     *timingWheel
+	expire uint64 // 到期的 tick 数
+	f      func()
+	slot   *list.List    // 所在的槽，没有在时间轮上时为 nil
+	elem   *list.Element // 在槽中的位置
+}
+
+// 创建时间轮，并开启推进它的 goroutine
+func newTimingWheel(tick time.Duration) *timingWheel {
+	tw := &timingWheel{
+		tick:  tick,
+		start: time.Now(),
+	}
+	for level := range tw.wheels {
+		for slot := range tw.wheels[level] {
+			tw.wheels[level][slot] = list.New()
+		}
+	}
+	go tw.run()
+	return tw
+}
+
+var (
+	heartbeatWheel     *timingWheel
+	heartbeatWheelOnce sync.Once
+)
+
+// 得到所有心跳检测器共用的时间轮，第一次使用时创建，精度是 GlobalObj.HeartbeatTick 毫秒
+func getHeartbeatWheel() *timingWheel {
+	heartbeatWheelOnce.Do(func() {
+		tick := time.Duration(utils.GlobalObj.HeartbeatTick) * time.Millisecond
+		if tick <= 0 {
+			tick = 100 * time.Millisecond
+		}
+		heartbeatWheel = newTimingWheel(tick)
+	})
+	return heartbeatWheel
+}
+
+// 创建一个到期时执行 f 的定时器，用 Reset 启动它。先保存好定时器再启动，f 中就可以直接使用它
+func (tw *timingWheel) newTimer(f func()) *wheelTimer {
+	return &wheelTimer{tw: tw, f: f}
+}
+
+// 重新设置定时器为 d 之后到期，定时器还没到期的话先把它取下来。到期后也可以用它再次启动
+func (t *wheelTimer) Reset(d time.Duration) {
+	tw := t.tw
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	tw.remove(t)
+	// 不足一个 tick 的部分向上取整。到期时间从实际经过的 tick 数算起而不是 tw.now：推进时间轮的 goroutine 可能落后，
+	// 当前的 tick 也可能已经过了一部分，所以再加一个 tick，保证不会提前到期
+	var ticks uint64
+	if d > 0 {
+		ticks = uint64((d + tw.tick - 1) / tw.tick)
+	}
+	if ticks > wheelMaxTicks-1 {
+		ticks = wheelMaxTicks - 1
+	}
+	current := tw.now
+	if elapsed := time.Since(tw.start); elapsed > 0 && uint64(elapsed/tw.tick) > current {
+		current = uint64(elapsed / tw.tick)
+	}
+	t.expire = current + ticks + 1
+	tw.add(t)
+}
+
+// 停止定时器，返回它是否还没有到期
+func (t *wheelTimer) Stop() bool {
+	t.tw.lock.Lock()
+	defer t.tw.lock.Unlock()
+	return t.tw.remove(t)
+}
+
+// 按到期时间把定时器放进对应的层和槽，需要持有锁
+func (tw *timingWheel) add(t *wheelTimer) {
+	level := 0
+	for diff := t.expire ^ tw.now; diff >= wheelSlots && level < wheelLevels-1; diff >>= wheelBits {
+		level++
+	}
+	t.slot = tw.wheels[level][(t.expire>>(wheelBits*level))&wheelMask]
+	t.elem = t.slot.PushBack(t)
+}
+
+// 把定时器从它所在的槽中取下来，需要持有锁
+func (tw *timingWheel) remove(t *wheelTimer) bool {
+	if t.slot == nil {
+		return false
+	}
+	t.slot.Remove(t.elem)
+	t.slot, t.elem = nil, nil
+	return true
+}
+
+func (tw *timingWheel) run() {
+	ticker := time.NewTicker(tw.tick)
+	defer ticker.Stop()
+	var expired []*wheelTimer
+	for range ticker.C {
+		// 按实际经过的时间推进，ticker 因为调度延迟丢了 tick 也能追上
+		target := uint64(time.Since(tw.start) / tw.tick)
+		tw.lock.Lock()
+		for tw.now < target {
+			expired = tw.advance(expired)
+		}
+		tw.lock.Unlock()
+		for i, t := range expired {
+			t.f()
+			expired[i] = nil
+		}
+		expired = expired[:0]
+	}
+}
+
+// 推进一个 tick，把到期的定时器追加到 expired 中返回，需要持有锁
+func (tw *timingWheel) advance(expired []*wheelTimer) []*wheelTimer {
+	tw.now++
+	// 下面的层转完一圈时，把上一层当前槽中的定时器放进下面的层；先处理高层，放下来的定时器可能还要继续往下放
+	for level := wheelLevels - 1; level > 0; level-- {
+		if tw.now&(1<<(wheelBits*level)-1) != 0 {
+			continue
+		}
+		// 先把整个槽取下来再放：超出最大范围的定时器可能又放回最高层的这个槽，等下一圈再处理
+		slot := tw.wheels[level][(tw.now>>(wheelBits*level))&wheelMask]
+		for e := slot.Front(); e != nil; e = slot.Front() {
+			tw.cascade = append(tw.cascade, slot.Remove(e).(*wheelTimer))
+		}
+		for i, t := range tw.cascade {
+			tw.add(t)
+			tw.cascade[i] = nil
+		}
+		tw.cascade = tw.cascade[:0]
+	}
+	slot := tw.wheels[0][tw.now&wheelMask]
+	for e := slot.Front(); e != nil; e = slot.Front() {
+		t := slot.Remove(e).(*wheelTimer)
+		t.slot, t.elem = nil, nil
+		expired = append(expired, t)
+	}
+	return expired
+}
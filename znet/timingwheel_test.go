@@ -0,0 +1,142 @@
+package znet
+
+import (
+	"container/list"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 创建一个不开启推进 goroutine 的时间轮，由测试自己调用 advance 推进
+func newManualWheel(tick time.Duration, start time.Time) *timingWheel {
+	tw := &timingWheel{tick: tick, start: start}
+	for level := range tw.wheels {
+		for slot := range tw.wheels[level] {
+			tw.wheels[level][slot] = list.New()
+		}
+	}
+	return tw
+}
+
+// 推进到 target，返回每个 tick 到期的定时器
+func advanceTo(tw *timingWheel, target uint64) map[uint64][]*wheelTimer {
+	fired := make(map[uint64][]*wheelTimer)
+	for tw.now < target {
+		expired := tw.advance(nil)
+		if len(expired) > 0 {
+			fired[tw.now] = expired
+		}
+	}
+	return fired
+}
+
+// 推进时间轮的 goroutine 落后于实际时间时，新设置的定时器也要从实际时间算起，不能提前到期
+func TestTimingWheelResetWhenLagging(t *testing.T) {
+	tick := 10 * time.Millisecond
+	for _, lag := range []uint64{0, 1, 3, 70} {
+		// 实际已经过了 100 个多一点的 tick，时间轮只推进到了 100-lag
+		tw := newManualWheel(tick, time.Now().Add(-100*tick-tick/2))
+		advanceTo(tw, 100-lag)
+		for _, d := range []time.Duration{0, time.Millisecond, tick, tick + 1, 25 * time.Millisecond, time.Second} {
+			resetAt := time.Since(tw.start)
+			timer := tw.newTimer(func() {})
+			timer.Reset(d)
+			if fireAt := time.Duration(timer.expire) * tick; fireAt < resetAt+d {
+				t.Errorf("lag %d, Reset(%v): expires at %v, before %v", lag, d, fireAt, resetAt+d)
+			}
+			timer.Stop()
+		}
+	}
+}
+
+// 定时器按到期时间放进高层，随着时间轮转动逐层降下来，最后正好在到期的 tick 执行
+func TestTimingWheelCascade(t *testing.T) {
+	tick := time.Hour // 测试期间实际经过的 tick 数一直是 0，到期时间只取决于 tw.now
+	tw := newManualWheel(tick, time.Now())
+	advanceTo(tw, 5) // 不从 0 开始，让定时器跨过各层的边界
+	delays := []uint64{
+		1,
+		wheelSlots - 5,
+		wheelSlots,
+		3*wheelSlots + 7,
+		wheelSlots * wheelSlots,
+		wheelSlots*wheelSlots + wheelSlots + 1,
+		wheelSlots*wheelSlots*wheelSlots + 2,
+	}
+	want := make(map[*wheelTimer]uint64)
+	for _, ticks := range delays {
+		timer := tw.newTimer(func() {})
+		timer.Reset(time.Duration(ticks) * tick)
+		want[timer] = tw.now + ticks + 1
+	}
+	last := tw.now + delays[len(delays)-1] + 1
+	fired := advanceTo(tw, last)
+	got := make(map[*wheelTimer]uint64)
+	for now, timers := range fired {
+		for _, timer := range timers {
+			if _, dup := got[timer]; dup {
+				t.Errorf("timer fired twice, at %d and %d", got[timer], now)
+			}
+			got[timer] = now
+		}
+	}
+	for timer, expire := range want {
+		if got[timer] != expire {
+			t.Errorf("timer expiring at tick %d fired at tick %d", expire, got[timer])
+		}
+	}
+}
+
+// 停止了的定时器不会执行，重新设置的定时器只按最后一次设置的时间执行
+func TestTimingWheelStopAndReset(t *testing.T) {
+	tw := newManualWheel(time.Hour, time.Now())
+	stopped := tw.newTimer(func() {})
+	stopped.Reset(3 * time.Hour)
+	if !stopped.Stop() {
+		t.Fatal("Stop of a pending timer returned false")
+	}
+	if stopped.Stop() {
+		t.Fatal("second Stop returned true")
+	}
+	reset := tw.newTimer(func() {})
+	reset.Reset(2 * time.Hour)
+	reset.Reset(wheelSlots * time.Hour)
+	fired := advanceTo(tw, wheelSlots+10)
+	for now, timers := range fired {
+		for _, timer := range timers {
+			if timer == stopped {
+				t.Errorf("stopped timer fired at tick %d", now)
+			}
+			if timer == reset && now != wheelSlots+1 {
+				t.Errorf("reset timer fired at tick %d, want %d", now, wheelSlots+1)
+			}
+		}
+	}
+}
+
+// 运行中的时间轮：定时器不会早于设置的时间执行
+func TestTimingWheelNeverFiresEarly(t *testing.T) {
+	tw := newTimingWheel(5 * time.Millisecond)
+	delays := []time.Duration{0, time.Millisecond, 4 * time.Millisecond, 5 * time.Millisecond, 12 * time.Millisecond, 33 * time.Millisecond, 80 * time.Millisecond}
+	var wg sync.WaitGroup
+	for round := 0; round < 5; round++ {
+		for _, d := range delays {
+			d := d
+			wg.Add(1)
+			var start time.Time
+			done := make(chan struct{})
+			timer := tw.newTimer(func() {
+				<-done
+				if elapsed := time.Since(start); elapsed < d {
+					t.Errorf("timer of %v fired after %v", d, elapsed)
+				}
+				wg.Done()
+			})
+			start = time.Now()
+			timer.Reset(d)
+			close(done)
+		}
+		time.Sleep(3 * time.Millisecond) // 每一轮从 tick 中不同的位置开始
+	}
+	wg.Wait()
+}
@@ -0,0 +1,247 @@
+package znet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/myZinx/utils"
+	"github.com/myZinx/ziface"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+UDP 模式：按对端地址把收到的数据报分到不同的虚拟会话中，每个会话包装成一个实现了 net.Conn 的 udpSession，
+再交给 Connection，所以 router、工作池、中间件、SendMsg 和 Call 都与 TCP 连接一样。
+每个数据报必须正好是一个完整的 DataPack 帧，数据长度不能超过 GlobalObj.MaxPackageSize，否则丢弃。
+帧格式版本的协商与 TCP 连接一样，但 UDP 不保证送达，协商帧格式的数据报或者它的回复丢了的话，之后的数据报双方都无法解析，需要重新开始会话。
+UDP 会话没有心跳检测器，而是由连接管理器按空闲时间（GlobalObj.UdpSessionTimeout）让会话过期，为 0 时会话不会过期
+*/
+
+// 要发送的帧超过了一个 UDP 数据报的上限（MsgHeaderLengthV2 + GlobalObj.MaxPackageSize）
+var ErrDatagramTooLarge = errors.New("frame is too large for a UDP datagram")
+
+// 一个 UDP 会话，对应一个对端地址
+type udpSession struct {
+	listenner  *net.UDPConn // server 监听的 UDP socket，所有会话共用它发送数据
+	remoteAddr *net.UDPAddr // 对端地址
+	inbound    chan []byte  // 收到的数据报，每个是一个完整的帧
+	buf        []byte       // 当前正在被 Read 读取的数据报的剩余部分
+	exitChan   chan bool    // 会话关闭时关闭此通道
+	closeOnce  sync.Once    // 保证只关闭一次
+	onClose    func()       // 会话关闭时调用，把会话从 server 的会话表中删除
+	// 对端发来的帧的格式版本，收到协商帧格式的数据报后升级，用来检查之后的数据报是不是一个完整的帧。只在 udpReadLoop 中使用
+	version uint8
+}
+
+func newUDPSession(listenner *net.UDPConn, remoteAddr *net.UDPAddr, onClose func()) *udpSession {
+	return &udpSession{
+		listenner:  listenner,
+		remoteAddr: remoteAddr,
+		inbound:    make(chan []byte, 64), // 处理不过来的数据报直接丢掉，与 UDP 本身的语义一致
+		exitChan:   make(chan bool),
+		onClose:    onClose,
+		version:    MsgVersion1,
+	}
+}
+
+// 按字节流的方式读取收到的数据报，一个数据报读完了才会读下一个
+func (u *udpSession) Read(p []byte) (int, error) {
+	if len(u.buf) == 0 {
+		select {
+		case u.buf = <-u.inbound:
+		case <-u.exitChan:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, u.buf)
+	u.buf = u.buf[n:]
+	return n, nil
+}
+
+// 每次 Write 发出一个数据报，writer 每次写入的正好是一个完整的帧
+func (u *udpSession) Write(p []byte) (int, error) {
+	select {
+	case <-u.exitChan:
+		return 0, net.ErrClosed
+	default:
+	}
+	if uint32(len(p)) > maxDatagramSize() {
+		// SendMsg 已经拒绝了超长的帧，这里只防止自定义的封包模块之类的意外。丢弃而不是返回错误，否则 writer 会关闭整个会话
+		logrus.Warnf("UDP 数据报长度 %d 超过上限，丢弃，remote = %v", len(p), u.remoteAddr)
+		return len(p), nil
+	}
+	return u.listenner.WriteToUDP(p, u.remoteAddr)
+}
+
+func (u *udpSession) Close() error {
+	u.closeOnce.Do(func() {
+		close(u.exitChan)
+		u.onClose()
+	})
+	return nil
+}
+
+// 把收到的数据报交给会话，会话处理不过来时丢弃
+func (u *udpSession) push(datagram []byte) {
+	select {
+	case u.inbound <- datagram:
+	case <-u.exitChan:
+	default:
+		logrus.Debugf("UDP 会话 %v 的接收队列已满，丢弃数据报", u.remoteAddr)
+	}
+}
+
+func (u *udpSession) LocalAddr() net.Addr                { return u.listenner.LocalAddr() }
+func (u *udpSession) RemoteAddr() net.Addr               { return u.remoteAddr }
+func (u *udpSession) SetDeadline(t time.Time) error      { return nil }
+func (u *udpSession) SetReadDeadline(t time.Time) error  { return nil }
+func (u *udpSession) SetWriteDeadline(t time.Time) error { return nil }
+
+// 一个数据报最多能有多少字节
+func maxDatagramSize() uint32 {
+	return MsgHeaderLengthV2 + utils.GlobalObj.MaxPackageSize
+}
+
+// UDP 会话的每个帧都要单独作为一个数据报发出去，超过上限的帧在放进发送队列之前就拒绝，返回 ErrDatagramTooLarge
+func (c *Connection) checkDatagramSize(frame []byte) error {
+	if _, ok := c.Conn.(*udpSession); ok && uint32(len(frame)) > maxDatagramSize() {
+		return ErrDatagramTooLarge
+	}
+	return nil
+}
+
+// 是否是 UDP 的虚拟会话
+func isUDPSession(conn ziface.IConnection) bool {
+	_, ok := conn.GetConnection().(*udpSession)
+	return ok
+}
+
+// 打开 UDP 的 socket，GlobalObj.UdpPort 为 0 时不开启。工作池和连接管理器启动后 serveUDP 才开始读取数据报
+func (s *Server) startUDP() error {
+	if utils.GlobalObj.UdpPort == 0 {
+		return nil
+	}
+	addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", s.IP, utils.GlobalObj.UdpPort))
+	if err != nil {
+		return err
+	}
+	listenner, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return err
+	}
+	s.udpListenner = listenner
+	logrus.Infof("[start] Server %s UDP Listenner at %s is started", s.Name, listenner.LocalAddr())
+	return nil
+}
+
+// 开始读取数据报和清理过期的会话
+func (s *Server) serveUDP() {
+	go s.udpReadLoop(s.udpListenner)
+	if utils.GlobalObj.UdpSessionTimeout > 0 {
+		go s.udpSweepLoop(time.Duration(utils.GlobalObj.UdpSessionTimeout) * time.Second)
+	} else {
+		logrus.Warnf("Server %s UdpSessionTimeout 为 %d，UDP 会话不会过期", s.Name, utils.GlobalObj.UdpSessionTimeout)
+	}
+}
+
+// 不停地读取数据报，按对端地址分给对应的会话，没有会话的就新建一个
+func (s *Server) udpReadLoop(listenner *net.UDPConn) {
+	maxDatagram := maxDatagramSize()
+	buf := make([]byte, maxDatagram+1) // 多一个字节，用来判断数据报是否超长
+	for {
+		n, remoteAddr, err := listenner.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) { // Stop 中关闭了 UDP socket
+				logrus.Infof("[stop] Server %s UDP Listenner is closed", s.Name)
+				return
+			}
+			logrus.Warn("UDP read err: ", err)
+			continue
+		}
+		if uint32(n) > maxDatagram {
+			logrus.Warnf("收到来自 %v 的 UDP 数据报超过 MaxPackageSize，丢弃", remoteAddr)
+			continue
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		// 每个数据报必须正好是一个完整的帧（按会话协商出的版本），否则会话的 reader 会把后面的数据报当成这个帧的一部分
+		version := MsgVersion1
+		if session := s.findUDPSession(remoteAddr); session != nil {
+			version = session.version
+		}
+		reader := bytes.NewReader(datagram)
+		msg, err := unpackVersion(s.DataPack, reader, version)
+		if err != nil || reader.Len() != 0 || msg.GetLength() > utils.GlobalObj.MaxPackageSize {
+			if msg != nil {
+				freeMessage(msg)
+			}
+			logrus.Warnf("收到来自 %v 的 UDP 数据报不是一个完整的帧，丢弃", remoteAddr)
+			continue
+		}
+		// 与 Connection 处理协商帧格式的帧一样：对端要用 v2 的话，之后的数据报都按 v2 检查
+		upgrade := version == MsgVersion1 && msg.GetMsgId() == utils.MSGID_FRAME_VERSION &&
+			bytes.Equal(msg.GetData(), []byte{MsgVersion2})
+		freeMessage(msg)
+		session := s.getUDPSession(listenner, remoteAddr)
+		if session == nil {
+			continue
+		}
+		if upgrade {
+			session.version = MsgVersion2
+		}
+		session.push(datagram)
+	}
+}
+
+// 得到对端地址对应的会话，没有的话返回 nil
+func (s *Server) findUDPSession(remoteAddr *net.UDPAddr) *udpSession {
+	s.udpLock.Lock()
+	defer s.udpLock.Unlock()
+	return s.udpSessions[remoteAddr.String()]
+}
+
+// 得到对端地址对应的会话，没有的话新建一个并包装成 Connection 启动
+func (s *Server) getUDPSession(listenner *net.UDPConn, remoteAddr *net.UDPAddr) *udpSession {
+	key := remoteAddr.String()
+	s.udpLock.Lock()
+	defer s.udpLock.Unlock()
+	if session, has := s.udpSessions[key]; has {
+		return session
+	}
+	if s.isStopping() { // 服务器正在关闭，不再建立新的会话
+		return nil
+	}
+	// UDP 没有连接可以交给 OnConnReject，被拒绝时直接丢弃这个包
+	if _, ok := s.admitConn(remoteAddr); !ok {
+		return nil
+	}
+	session := newUDPSession(listenner, remoteAddr, func() {
+		s.udpLock.Lock()
+		delete(s.udpSessions, key)
+		s.udpLock.Unlock()
+	})
+	s.udpSessions[key] = session
+	go s.startConn(session, UDPListenerName)
+	return session
+}
+
+// 定时让空闲太久的 UDP 会话过期，相当于 TCP 连接的心跳检测
+func (s *Server) udpSweepLoop(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if n := s.ConnMgr.SweepIdle(timeout, isUDPSession); n > 0 {
+				logrus.Debugf("%d 个 UDP 会话空闲超过 %v，已过期", n, timeout)
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
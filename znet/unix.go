@@ -0,0 +1,77 @@
+package znet
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/myZinx/ziface"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+Unix domain socket 模式：Server.IPVersion 为 "unix" 时监听 GlobalObj.UnixSocketPath，连接的生命周期与 TCP 完全一样。
+路径以 "@" 开头时使用 Linux 的抽象命名空间，不会在文件系统中创建 socket 文件；否则 Stop 时删除 socket 文件。
+Linux 上每个连接都会把对端进程的凭证（SO_PEERCRED）保存为连接属性，见 PropPeerUid 等
+*/
+
+// 对端进程凭证的连接属性名，只有 Linux 上的 Unix domain socket 连接才有，值都是 int
+const (
+	PropPeerUid = "peer_uid"
+	PropPeerGid = "peer_gid"
+	PropPeerPid = "peer_pid"
+)
+
+// 是否是抽象命名空间的地址（Linux 特有，不对应文件系统中的文件）
+func isAbstractUnixPath(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// 监听 Unix domain socket。上次异常退出留下的 socket 文件会先删除，否则无法监听
+func listenUnix(path string) (*net.UnixListener, error) {
+	if !isAbstractUnixPath(path) {
+		if info, err := os.Stat(path); err == nil && info.Mode()&fs.ModeSocket != 0 {
+			logrus.Warnf("删除残留的 socket 文件 %s", path)
+			os.Remove(path)
+		}
+	}
+	listenner, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listenner.SetUnlinkOnClose(false) // 由 Stop 自己删除，保证所有连接都关闭后 socket 文件才消失
+	return listenner, nil
+}
+
+// 删除 Unix domain socket 的文件，抽象命名空间的地址没有文件
+func removeUnixSocket(path string) {
+	if isAbstractUnixPath(path) {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logrus.Warnf("删除 socket 文件 %s 出错: %v", path, err)
+	}
+}
+
+// 如果是 Unix domain socket 连接（包括在它上面的 TLS 连接），把对端进程的凭证保存为连接属性
+func setPeerCredProperties(conn ziface.IConnection) {
+	netConn := conn.GetConnection()
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		netConn = tlsConn.NetConn()
+	}
+	unixConn, ok := netConn.(*net.UnixConn)
+	if !ok {
+		return
+	}
+	uid, gid, pid, err := getPeerCred(unixConn)
+	if err != nil {
+		logrus.Debugf("连接 %d 获取对端凭证失败: %v", conn.GetConnID(), err)
+		return
+	}
+	conn.SetProperty(PropPeerUid, uid)
+	conn.SetProperty(PropPeerGid, gid)
+	conn.SetProperty(PropPeerPid, pid)
+}
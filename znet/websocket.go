@@ -0,0 +1,104 @@
+package znet
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/myZinx/utils"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocket 连接的包装。websocket.Conn 本身就实现了 net.Conn，每次 Write 发出一个二进制消息，Read 按字节流读取消息的内容，
+// 所以一个 DataPack 帧正好是一个 WebSocket 消息，Connection 的 reader/writer 不需要任何修改。
+// 只是它的 RemoteAddr 返回的是 Origin，这里换成对端真正的 IP 和端口
+type wsConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// 得到处理 WebSocket 连接的 http.Handler。可以挂在 gin 等已有的 http 服务上，与它们共用一个端口，
+// 例如 r.GET("/ws", gin.WrapH(s.WebSocketHandler()))；也可以配置 GlobalObj.WsPort 让 server 自己监听
+func (s *Server) WebSocketHandler() http.Handler {
+	return websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			if !checkWsOrigin(req) {
+				logrus.Warnf("拒绝来自 %s 的 WebSocket 连接，Origin = %s", req.RemoteAddr, req.Header.Get("Origin"))
+				return errWsOrigin // websocket 库会回复 403
+			}
+			return nil
+		},
+		Handler: s.serveWebSocket,
+	}
+}
+
+var errWsOrigin = errors.New("websocket origin not allowed")
+
+// 检查 WebSocket 请求的 Origin：没有 Origin 的（非浏览器的客户端）、与 Host 同源的和在 GlobalObj.WsAllowedOrigins 中的允许，
+// 否则可能是别的网站的页面借用户的浏览器连接过来
+func checkWsOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range utils.GlobalObj.WsAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
+
+// 处理一个 WebSocket 连接，包装成 Connection 后与 TCP 连接一样交给连接管理器、工作池和心跳检测器。
+// websocket 库在此函数返回后就会关闭连接，所以要一直阻塞到 Connection 关闭
+func (s *Server) serveWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame // 每个 DataPack 帧都用二进制消息发送
+	var remoteAddr net.Addr = ws.RemoteAddr()
+	if addr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr); err == nil {
+		remoteAddr = addr
+	}
+	if reason, ok := s.admitConn(remoteAddr); !ok {
+		s.rejectConn(ws, reason)
+		return
+	}
+	dealConn := s.startConn(&wsConn{Conn: ws, remoteAddr: remoteAddr}, WebSocketListenerName)
+	<-dealConn.ExitChan
+}
+
+// 打开 WebSocket 的监听，GlobalObj.WsPort 为 0 时不开启。这里只监听端口，工作池和连接管理器启动后 serveWsListener 才开始处理请求
+func (s *Server) startWebSocket() error {
+	if utils.GlobalObj.WsPort == 0 {
+		return nil
+	}
+	listenner, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.IP, utils.GlobalObj.WsPort))
+	if err != nil {
+		return err
+	}
+	// server 配置了 TLS 的话，WebSocket 也使用 TLS（wss）
+	if s.TLSConfig != nil {
+		listenner = tls.NewListener(listenner, s.TLSConfig)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(utils.GlobalObj.WsPath, s.WebSocketHandler())
+	s.wsServer = &http.Server{Handler: mux}
+	s.wsListenner = listenner
+	logrus.Infof("[start] Server %s WebSocket Listenner at %s%s is started", s.Name, listenner.Addr(), utils.GlobalObj.WsPath)
+	return nil
+}
+
+// 开始处理 WebSocket 的请求，直到 Stop 关闭 wsServer
+func (s *Server) serveWsListener() {
+	if err := s.wsServer.Serve(s.wsListenner); err != nil && err != http.ErrServerClosed {
+		logrus.Error("WebSocket server err: ", err)
+	}
+}
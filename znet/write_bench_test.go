@@ -0,0 +1,158 @@
+package znet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/myZinx/utils"
+	"github.com/myZinx/ziface"
+)
+
+/*
+收发路径的性能对比，运行：go test -run '^$' -bench . -benchmem ./znet
+发送路径（FILE_RESPOND 的 32KB 文件块是主要关心的场景）：
+  - old：binary.Write 反射封包到新的 bytes.Buffer，通过无缓冲通道交给 writer，每条消息一次 Write
+  - new：现在的 Connection，封包使用缓冲池，writer 把队列中的消息合并后用 writev 写入
+接收路径见 read_bench_test.go
+*/
+
+// 测试的消息大小：小消息、1KB 和一个文件块
+func benchSizes() []int {
+	return []int{64, 1024, int(utils.GlobalObj.MaxFilePackageSize)}
+}
+
+// 收到的字节数，对端全部收到之后一次测试才算完成
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&c.n, int64(len(p)))
+	return len(p), nil
+}
+
+// 建立一对本机的 TCP 连接
+func tcpConnPair(b *testing.B) (local net.Conn, remote net.Conn) {
+	b.Helper()
+	listenner, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listenner.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listenner.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	local, err = net.Dial("tcp4", listenner.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	if remote = <-accepted; remote == nil {
+		b.Fatal("accept failed")
+	}
+	return local, remote
+}
+
+// 建立一对本机的 TCP 连接，对端把收到的数据全部丢弃并计数
+func discardPair(b *testing.B) (net.Conn, *byteCounter) {
+	local, remote := tcpConnPair(b)
+	cnt := &byteCounter{}
+	go func() {
+		io.Copy(cnt, remote)
+		remote.Close()
+	}()
+	return local, cnt
+}
+
+// 等待对端收到 total 个字节
+func waitReceived(cnt *byteCounter, total int64) {
+	for atomic.LoadInt64(&cnt.n) < total {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 测试中一直等待，不因为队列满而出错
+func disableSendTimeout(b *testing.B) {
+	old := utils.GlobalObj.SendTimeout
+	utils.GlobalObj.SendTimeout = 0
+	b.Cleanup(func() { utils.GlobalObj.SendTimeout = old })
+}
+
+// 旧的封包方式
+func legacyPack(msg ziface.IMessage) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+	if err := binary.Write(buf, binary.LittleEndian, msg.GetMsgId()); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, msg.GetLength()); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, msg.GetData()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func BenchmarkWrite(b *testing.B) {
+	disableSendTimeout(b)
+	for _, size := range benchSizes() {
+		b.Run(fmt.Sprintf("%dB/old", size), func(b *testing.B) { benchWriteOld(b, size) })
+		b.Run(fmt.Sprintf("%dB/new", size), func(b *testing.B) { benchWriteNew(b, size) })
+	}
+}
+
+func benchWriteOld(b *testing.B, size int) {
+	conn, cnt := discardPair(b)
+	defer conn.Close()
+	data := make([]byte, size)
+	msgChan := make(chan []byte)
+	go func() {
+		for buf := range msgChan {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	frameLen := int64(size) + int64(MsgHeaderLength)
+	b.SetBytes(frameLen)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := legacyPack(&Message{MsgId: utils.MSGID_FILE_RESPOND, Length: uint32(size), Data: data})
+		if err != nil {
+			b.Fatal(err)
+		}
+		msgChan <- buf
+	}
+	close(msgChan)
+	waitReceived(cnt, int64(b.N)*frameLen)
+}
+
+func benchWriteNew(b *testing.B, size int) {
+	netConn, cnt := discardPair(b)
+	conn := NewConnection(netConn, 1, NewMessageHandler(), nil)
+	conn.Start()
+	defer conn.Stop()
+	data := make([]byte, size)
+	frameLen := int64(size) + int64(MsgHeaderLength)
+	b.SetBytes(frameLen)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := conn.SendMsg(utils.MSGID_FILE_RESPOND, uint32(size), data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	waitReceived(cnt, int64(b.N)*frameLen)
+}